@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/imneov/servicekeel/internal/config"
+	"github.com/imneov/servicekeel/router"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// CLI flags
+var (
+	flagConfig          = flag.String("config", "", "router configuration file (default: router.yaml in /etc/servicekeel, config or .)")
+	flagServerListen    = flag.String("server-listen", "", "address exported services register on (env: ROUTER_SERVER_LISTEN), e.g., /tmp/router.sock or 0.0.0.0:7000")
+	flagVisitorListen   = flag.String("visitor-listen", "", "address importing sidecars connect to (env: ROUTER_VISITOR_LISTEN), e.g., 127.0.0.1:7001")
+	flagQUICListen      = flag.String("quic-listen", "", "UDP address exported services and peers may register on over QUIC (env: ROUTER_QUIC_LISTEN), e.g., 0.0.0.0:7000")
+	flagSecretKey       = flag.String("secret-key", "", "secret key for authentication and encryption (env: ROUTER_SECRET_KEY)")
+	flagAllowUsers      = flag.String("allow-users", "", "comma separated users allowed to connect (env: ROUTER_ALLOW_USERS)")
+	flagName            = flag.String("name", "", "router name announced to peers (env: ROUTER_NAME)")
+	flagPeers           = flag.String("peers", "", "comma separated peer routers as name=addr, e.g., router-b=10.0.0.2:7000")
+	flagMetricsAddr     = flag.String("metrics-addr", "", "address for metrics and health endpoints (env: ROUTER_METRICS_ADDR), default :8080")
+	flagShutdownTimeout = flag.Duration("shutdown-timeout", 0, "time active sessions may take to finish on shutdown (env: ROUTER_SHUTDOWN_TIMEOUT), default 30s")
+	flagTLSCertFile     = flag.String("tls-cert-file", "", "router TLS certificate, enables TLS 1.3 (env: ROUTER_TLS_CERTFILE)")
+	flagTLSKeyFile      = flag.String("tls-key-file", "", "router TLS key (env: ROUTER_TLS_KEYFILE)")
+	flagTLSCAFile       = flag.String("tls-ca-file", "", "CA certificates for client and peer certificates, enables mutual TLS (env: ROUTER_TLS_CAFILE)")
+	flagLoadBalance     = flag.String("load-balance", "", "strategy for proxies registered by several servers: round_robin, least_conn or consistent_hash (env: ROUTER_LOAD_BALANCE)")
+	flagAdminAddr       = flag.String("admin-addr", "", "address for the admin API (env: ROUTER_ADMIN_ADDR), default is the metrics address")
+	flagStateDir        = flag.String("state-dir", "", "directory keeping the traffic quota usage across restarts (env: ROUTER_STATE_DIR), default /var/lib/servicekeel")
+)
+
+func main() {
+	// parse CLI flags
+	flag.Parse()
+
+	// Load configuration file
+	cfg, err := config.LoadRouterConfig(*flagConfig)
+	if err != nil {
+		log.Fatalf("Failed to load configuration file: %v", err)
+	}
+
+	if *flagServerListen != "" {
+		cfg.ServerListen = *flagServerListen
+	}
+	if *flagVisitorListen != "" {
+		cfg.VisitorListen = *flagVisitorListen
+	}
+	if *flagQUICListen != "" {
+		cfg.QUICListen = *flagQUICListen
+	}
+	if *flagSecretKey != "" {
+		cfg.SecretKey = *flagSecretKey
+	}
+	if *flagAllowUsers != "" {
+		cfg.AllowUsers = strings.Split(*flagAllowUsers, ",")
+	}
+	if *flagName != "" {
+		cfg.Name = *flagName
+	}
+	if *flagPeers != "" {
+		cfg.Peers, err = config.ParseRouterPeers(*flagPeers)
+		if err != nil {
+			log.Fatalf("Invalid --peers: %v", err)
+		}
+	}
+	if *flagMetricsAddr != "" {
+		cfg.Metrics.Addr = *flagMetricsAddr
+	}
+	if *flagShutdownTimeout > 0 {
+		cfg.ShutdownTimeout = *flagShutdownTimeout
+	}
+	if *flagTLSCertFile != "" {
+		cfg.TLS.CertFile = *flagTLSCertFile
+	}
+	if *flagTLSKeyFile != "" {
+		cfg.TLS.KeyFile = *flagTLSKeyFile
+	}
+	if *flagTLSCAFile != "" {
+		cfg.TLS.CAFile = *flagTLSCAFile
+	}
+	if *flagLoadBalance != "" {
+		cfg.LoadBalance = *flagLoadBalance
+	}
+	if *flagAdminAddr != "" {
+		cfg.Admin.Addr = *flagAdminAddr
+	}
+	if *flagStateDir != "" {
+		cfg.StateDir = *flagStateDir
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	klog.Infof("Configuration: \n%v", cfg.String())
+	if cfg.TLS.CAFile == "" && !(len(cfg.AllowUsers) == 1 && cfg.AllowUsers[0] == "*") {
+		klog.Warningf("Mutual TLS is off (tls.caFile), visitors holding the secret key may claim any identity and pass allowUsers")
+	}
+
+	// Start STCP router
+	stcpRouter, err := startRouter(cfg)
+	if err != nil {
+		log.Fatalf("Failed to start router: %v", err)
+	}
+	log.Printf("Router started, server listening on %s, visitor listening on %s", cfg.ServerListen, cfg.VisitorListen)
+
+	// setup metrics, health and admin HTTP servers
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	servers := []*http.Server{{Addr: cfg.Metrics.Addr, Handler: mux}}
+	admin := router.BasicAuth(stcpRouter.AdminHandler(), cfg.Admin.User, cfg.Admin.Password)
+	switch {
+	case cfg.Admin.User == "" || cfg.Admin.Password == "":
+		// the admin API can drop proxies and sessions, never serve it unauthenticated
+		klog.Warningf("Admin API disabled, set admin.user and admin.password to enable it")
+	case cfg.Admin.Addr == "" || cfg.Admin.Addr == cfg.Metrics.Addr:
+		mux.Handle("/api/", admin)
+	default:
+		servers = append(servers, &http.Server{Addr: cfg.Admin.Addr, Handler: admin})
+	}
+	for _, server := range servers {
+		go func(server *http.Server) {
+			log.Printf("HTTP server listening on %s", server.Addr)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP server on %s failed: %v", server.Addr, err)
+			}
+		}(server)
+	}
+
+	// Create signal channel
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	// Wait for signal
+	sig := <-sigChan
+	klog.Infof("Received signal %v, starting graceful shutdown...", sig)
+
+	// Drain the visitor sessions before closing the HTTP servers so that
+	// health checks and metrics stay available meanwhile
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer drainCancel()
+	if err := stcpRouter.Shutdown(drainCtx); err != nil {
+		klog.Warningf("Router sessions did not finish in %v: %v", cfg.ShutdownTimeout, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			klog.Errorf("Failed to shutdown HTTP server on %s: %v", server.Addr, err)
+		}
+	}
+
+	klog.Info("Program exited")
+}
+
+// startRouter creates the STCP router and starts its server and visitor listeners.
+func startRouter(cfg *config.RouterConfig) (*router.STCPRouter, error) {
+	mode, err := cfg.UnixSocket.FileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]router.PeerConfig, 0, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		peers = append(peers, router.PeerConfig{Name: p.Name, Addr: p.Addr})
+	}
+	if len(peers) > 0 && cfg.Name == "" {
+		return nil, fmt.Errorf("router name is required when peers are configured")
+	}
+	if !router.ValidLoadBalance(cfg.LoadBalance) {
+		return nil, fmt.Errorf("invalid load balancing strategy %q", cfg.LoadBalance)
+	}
+
+	var tlsConfig *router.TLSConfig
+	if cfg.TLS.Enabled() {
+		tlsConfig = &router.TLSConfig{
+			CertFile:   cfg.TLS.CertFile,
+			KeyFile:    cfg.TLS.KeyFile,
+			CAFile:     cfg.TLS.CAFile,
+			ServerName: cfg.TLS.ServerName,
+		}
+	}
+
+	limits := make([]router.TrafficLimit, 0, len(cfg.Limits))
+	quotaFile := ""
+	for _, l := range cfg.Limits {
+		if (l.DailyQuota > 0 || l.MonthlyQuota > 0) && cfg.StateDir != "" {
+			quotaFile = filepath.Join(cfg.StateDir, "router-quota.json")
+		}
+		limits = append(limits, router.TrafficLimit{
+			Proxy:            l.Proxy,
+			Bandwidth:        l.Bandwidth,
+			VisitorBandwidth: l.VisitorBandwidth,
+			DailyQuota:       l.DailyQuota,
+			MonthlyQuota:     l.MonthlyQuota,
+		})
+	}
+
+	r := router.NewSTCPRouter(&router.STCPConfig{
+		SecretKey:      cfg.SecretKey,
+		AllowUsers:     cfg.AllowUsers,
+		UseEncryption:  cfg.UseEncryption,
+		UseCompression: cfg.UseCompression,
+		UnixSocket: &router.UnixSocketOptions{
+			Mode: os.FileMode(mode),
+			UID:  cfg.UnixSocket.UID,
+			GID:  cfg.UnixSocket.GID,
+		},
+		TLS:               tlsConfig,
+		Name:              cfg.Name,
+		Peers:             peers,
+		LoadBalance:       cfg.LoadBalance,
+		MaxPoolCount:      cfg.MaxPoolCount,
+		HeartbeatInterval: cfg.HeartbeatInterval,
+		HeartbeatTimeout:  cfg.HeartbeatTimeout,
+		Limits:            limits,
+		QuotaFile:         quotaFile,
+	})
+	if err := r.StartQuotaUsage(); err != nil {
+		klog.Warningf("Traffic quotas start from zero: %v", err)
+	}
+	if err := r.StartServer(cfg.ServerListen); err != nil {
+		return nil, err
+	}
+	if cfg.QUICListen != "" {
+		addr := cfg.QUICListen
+		if network, _ := router.ParseAddr(addr); network != "quic" {
+			addr = "quic://" + addr
+		}
+		if err := r.StartServer(addr); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if err := r.StartVisitor(cfg.VisitorListen); err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.StartPeers()
+	return r, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/imneov/servicekeel/internal/config"
+	"github.com/imneov/servicekeel/internal/controller"
+	"github.com/imneov/servicekeel/internal/dns"
+)
+
+// commands are the subcommands run instead of the sidecar, they return the
+// exit code
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"validate":       runValidate,
+	"render":         runRender,
+	"migrate-config": runMigrateConfig,
+}
+
+// loadForCommand reads the configuration from a config directory or from
+// the annotations of a manifest file, empty reads the default directories
+func loadForCommand(path string) (*config.Config, *config.Validation, error) {
+	if path == "" {
+		cfg, _, validation := (&config.Loader{}).Load()
+		return cfg, validation, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		cfg, _, validation := (&config.Loader{Dir: path}).Load()
+		return cfg, validation, nil
+	}
+	return config.ReadManifest(path)
+}
+
+// printValidation writes warnings and errors, it returns false on errors
+func printValidation(w io.Writer, validation *config.Validation) bool {
+	for _, warning := range validation.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	for _, err := range validation.Errors {
+		fmt.Fprintf(w, "error: %s\n", err)
+	}
+	return len(validation.Errors) == 0
+}
+
+// runValidate checks a config directory or manifest without starting anything
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: sidecar validate [config-dir | manifest.yaml]")
+		fmt.Fprintln(stderr, "Checks the service configuration of a config directory, or the servicekeel.io annotations of a Pod or workload manifest.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cfg, validation, err := loadForCommand(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	if !printValidation(stderr, validation) {
+		return 1
+	}
+	fmt.Fprintf(stdout, "configuration is valid: %d exported and %d imported services\n",
+		len(cfg.ExportedServices.Services), len(cfg.ImportedServices.Services))
+	return 0
+}
+
+// runRender prints the DNS names, mapped IPs and frpc arguments the sidecar
+// would use, without binding ports or starting processes
+func runRender(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	ipRange := fs.String("ip-range", "", "CIDR notation IP range for mapping, overrides the configuration")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: sidecar render [-ip-range CIDR] [config-dir | manifest.yaml]")
+		fmt.Fprintln(stderr, "Prints the DNS mappings and frpc arguments of a configuration without starting anything.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cfg, validation, err := loadForCommand(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	if !printValidation(stderr, validation) {
+		return 1
+	}
+	if *ipRange != "" {
+		cfg.DNS.IPRange = *ipRange
+	}
+
+	dnsServer, err := dns.NewServer(cfg.DNS.IPRange)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	ctrl, err := controller.NewController(cfg, dnsServer)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	if err := ctrl.Plan(); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "dns: %s, ip range %s\n", cfg.DNS.Addr, cfg.DNS.IPRange)
+	fmt.Fprintln(stdout, "\nimported services:")
+	printEndpoints(stdout, ctrl.GetAllImportedEndpoints())
+	fmt.Fprintln(stdout, "\nexported services:")
+	printEndpoints(stdout, ctrl.GetAllExportedEndpoints())
+	return 0
+}
+
+// runMigrateConfig converts configuration documents to another API version
+func runMigrateConfig(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate-config", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	to := fs.String("to", config.APIVersionV1alpha2, "API version to convert to")
+	write := fs.Bool("w", false, "write the result back to the files instead of printing it")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: sidecar migrate-config [-to apiVersion] [-w] file...")
+		fmt.Fprintf(stderr, "Converts config.yaml, service files or annotation values in YAML or JSON between %s.\n",
+			strings.Join(config.APIVersions, " and "))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	status := 0
+	for i, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			data, err = config.MigrateDocument(data, *to)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		if *write {
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				fmt.Fprintf(stderr, "error: %v\n", err)
+				status = 1
+			}
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintln(stdout, "---")
+		}
+		stdout.Write(data)
+	}
+	return status
+}
+
+// printEndpoints writes endpoints sorted by proxy name, secret keys are redacted
+func printEndpoints(w io.Writer, endpoints map[string]*controller.EndpointInfo) {
+	if len(endpoints) == 0 {
+		fmt.Fprintln(w, "  none")
+		return
+	}
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		endpoint := endpoints[name]
+		fmt.Fprintf(w, "  %s\n", name)
+		if endpoint.MappedIP != "" {
+			dnsNames := endpoint.ServiceName
+			if endpoint.Alias != "" {
+				dnsNames += ", " + endpoint.Alias
+			}
+			fmt.Fprintf(w, "    dns:  %s -> %s\n", dnsNames, endpoint.MappedIP)
+		}
+		if endpoint.TargetPort != "" && endpoint.TargetPort != endpoint.ServicePort {
+			fmt.Fprintf(w, "    port: %s/%s -> %s\n", endpoint.ServicePort, endpoint.ServiceProtocol, endpoint.TargetPort)
+		} else {
+			fmt.Fprintf(w, "    port: %s/%s\n", endpoint.ServicePort, endpoint.ServiceProtocol)
+		}
+		fmt.Fprintf(w, "    frpc: %s\n", strings.Join(redactArgs(endpoint.FRPClient.Args), " "))
+	}
+}
+
+// redactArgs hides the value of --sk
+func redactArgs(args []string) []string {
+	redacted := append([]string(nil), args...)
+	for i := 0; i+1 < len(redacted); i++ {
+		if redacted[i] == "--sk" {
+			redacted[i+1] = "******"
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testImportedServices = `apiVersion: servicekeel.io/v1alpha2
+kind: ServiceList
+services:
+  - name: db
+    namespace: default
+    ports:
+      - {name: mysql, port: 3306, targetPort: 3306, protocol: TCP}
+`
+
+// writeConfigDir creates a config directory holding the imported services
+func writeConfigDir(t *testing.T, dir, imported string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "imported-services-config.yaml"), []byte(imported), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// run runs a subcommand and returns its exit code and output
+func run(t *testing.T, name string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := commands[name](args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunValidate(t *testing.T) {
+	dir := writeConfigDir(t, t.TempDir(), testImportedServices)
+	code, stdout, stderr := run(t, "validate", dir)
+	if code != 0 || !strings.Contains(stdout, "0 exported and 1 imported services") {
+		t.Errorf("validate = %d, %q; stderr:\n%s", code, stdout, stderr)
+	}
+
+	invalid := writeConfigDir(t, t.TempDir(), strings.Replace(testImportedServices, "protocol: TCP", "protocol: SCTP", 1))
+	code, _, stderr = run(t, "validate", invalid)
+	if code != 1 || !strings.Contains(stderr, `error: `) || !strings.Contains(stderr, `invalid protocol type: "SCTP"`) {
+		t.Errorf("validate = %d; stderr:\n%s", code, stderr)
+	}
+}
+
+func TestRunValidateDefaultDir(t *testing.T) {
+	// Without a directory the config directory of the working directory is used
+	dir := t.TempDir()
+	writeConfigDir(t, filepath.Join(dir, "config"), testImportedServices)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	code, stdout, stderr := run(t, "validate")
+	if code != 0 || !strings.Contains(stdout, "0 exported and 1 imported services") {
+		t.Errorf("validate = %d, %q; stderr:\n%s", code, stdout, stderr)
+	}
+}
+
+func TestRunValidateManifest(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "pod.yaml")
+	if err := os.WriteFile(manifest, []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: client
+  namespace: web
+  annotations:
+    multicluster.kubernetes.io/import-services: |
+      {"apiVersion": "servicekeel.io/v1alpha2", "kind": "ServiceList",
+       "services": [{"name": "db", "ports": [{"name": "mysql", "port": 3306, "targetPort": 3306, "protocol": "TCP"}]}]}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, stdout, stderr := run(t, "validate", manifest)
+	if code != 0 || !strings.Contains(stdout, "0 exported and 1 imported services") {
+		t.Errorf("validate = %d, %q; stderr:\n%s", code, stdout, stderr)
+	}
+
+	// The services take the namespace of the manifest
+	code, stdout, stderr = run(t, "render", manifest)
+	if code != 0 || !strings.Contains(stdout, "dns:  db.web.svc -> ") {
+		t.Errorf("render = %d, %q; stderr:\n%s", code, stdout, stderr)
+	}
+}
+
+func TestRunRender(t *testing.T) {
+	dir := writeConfigDir(t, t.TempDir(), testImportedServices)
+	code, stdout, stderr := run(t, "render", "-ip-range", "127.0.77.0/24", dir)
+	if code != 0 {
+		t.Fatalf("render = %d; stderr:\n%s", code, stderr)
+	}
+	for _, want := range []string{
+		"ip range 127.0.77.0/24",
+		"dns:  db.default.svc -> 127.0.77.0",
+		"--bind-addr 127.0.77.0 --bind-port 3306",
+		"--sk ******",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("render output lacks %q:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "servicekeel-secret-key") {
+		t.Errorf("render output shows the secret key:\n%s", stdout)
+	}
+
+	if code, _, _ := run(t, "render", filepath.Join(t.TempDir(), "missing")); code != 1 {
+		t.Errorf("render of a missing path = %d; want 1", code)
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	zap "sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -21,56 +27,101 @@ import (
 // CLI flags
 var (
 	flagVerssion    = flag.String("version", "", "service keel version")
-	flagDNSAddr     = flag.String("dns-addr", "", "DNS listen address (env: SIDECAR_DNS_ADDR), e.g., 127.0.0.2:53")
-	flagMetricsAddr = flag.String("metrics-addr", "", "address for metrics and health endpoints (env: METRICS_ADDR), default :8080")
-	flagIPRange     = flag.String("ip-range", "", "CIDR notation IP range for mapping (env: SIDECAR_IP_RANGE)")
+	flagDNSAddr     = flag.String("dns-addr", "", "DNS listen address (env: SIDECAR_DNS_ADDR), default "+config.DefaultDNSAddr)
+	flagMetricsAddr = flag.String("metrics-addr", "", "address for metrics and health endpoints (env: SIDECAR_METRICS_ADDR), default "+config.DefaultMetricsAddr)
+	flagIPRange     = flag.String("ip-range", "", "CIDR notation IP range for mapping (env: SIDECAR_IP_RANGE), default "+config.DefaultIPRange)
+	flagWatchPod    = flag.Bool("watch-pod", false, "read service annotations of the own Pod through the Kubernetes API (env: SIDECAR_POD_WATCH)")
+	flagMaxRange    = flag.Int("max-port-range", 0, fmt.Sprintf("largest number of ports a port range may hold (env: SIDECAR_MAX_PORT_RANGE), default %d", config.DefaultMaxPortRange))
+	flagStateDir    = flag.String("state-dir", "", "directory keeping the last-known-good configuration (env: SIDECAR_STATE_DIR), default "+config.DefaultStateDir)
+	flagConfigDir   = flag.String("config-dir", "", "directory of config.yaml and the service files, default /etc/servicekeel, ./config or .")
+	flagConfigFiles stringList
 )
 
+// flagSettings maps flags to the configuration settings they set
+var flagSettings = map[string]string{
+	"dns-addr":       "dns.addr",
+	"metrics-addr":   "metrics.addr",
+	"ip-range":       "dns.ipRange",
+	"watch-pod":      "pod.watch",
+	"max-port-range": "ports.maxRange",
+	"state-dir":      "state.dir",
+}
+
+func init() {
+	flag.Var(&flagConfigFiles, "config", "extra config file applied over the config directory, may be repeated")
+}
+
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	// run a subcommand instead of the sidecar
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	// parse CLI flags
 	flag.Parse()
 
 	// initialize controller-runtime logger
 	logf.SetLogger(zap.New(zap.UseDevMode(true)))
 
-	// setup metrics and health HTTP server
-	metricsAddr := *flagMetricsAddr
-	if metricsAddr == "" {
-		metricsAddr = os.Getenv("METRICS_ADDR")
-		if metricsAddr == "" {
-			metricsAddr = ":1080"
+	// Load configuration from all sources, flags set explicitly win. All
+	// settings are resolved here, before any listener starts.
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagSettings[f.Name]; ok {
+			flags[key] = f.Value.String()
 		}
+	})
+	loader := &config.Loader{Dir: *flagConfigDir, Files: flagConfigFiles, Flags: flags}
+	sources, validation := loader.Sources()
+	cfg, provenance, merged := config.Merge(sources)
+	validation.Errors = append(validation.Errors, merged.Errors...)
+	validation.Warnings = append(validation.Warnings, merged.Warnings...)
+	for _, warning := range validation.Warnings {
+		klog.Warningf("configuration: %s", warning)
 	}
-	go func() {
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", promhttp.Handler())
-		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-		})
-		log.Printf("Metrics and health listening on %s", metricsAddr)
-		if err := http.ListenAndServe(metricsAddr, mux); err != nil {
-			log.Fatalf("metrics server failed: %v", err)
+	// The services of a broken configuration are replaced by the last ones
+	// applied, the settings stay
+	state := config.NewState(cfg.State.Dir)
+	fallback := false
+	if err := validation.Err(); err != nil {
+		if err := state.Fallback(cfg, provenance, err); err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
 		}
-	}()
-
-	// Load configuration file
-	cfg, err := config.LoadConfig()
-	if err != nil {
-		log.Fatalf("Failed to load configuration file: %v", err)
+		klog.Errorf("Failed to load configuration, using the last-known-good one: %v", validation.Err())
+		fallback = true
 	}
+	effective := &config.Effective{}
+	effective.Set(cfg, provenance)
 
-	if *flagDNSAddr != "" {
-		cfg.DNS.Addr = *flagDNSAddr
+	names := make([]string, len(sources))
+	for i, source := range sources {
+		names[i] = source.Name
 	}
-	if *flagIPRange != "" {
-		cfg.DNS.IPRange = *flagIPRange
+	klog.Infof("Configuration sources: %s", strings.Join(names, ", "))
+	for _, setting := range config.Resolved(cfg, provenance) {
+		klog.Infof("Setting %s", setting)
 	}
-	if *flagMetricsAddr != "" {
-		cfg.Metrics.Addr = *flagMetricsAddr
-	}
-
 	klog.Infof("Configuration: \n%v", cfg.String())
 
+	// setup metrics and health HTTP server
+	if err := startMetricsServer(cfg.Metrics.Addr, effective, state); err != nil {
+		log.Fatalf("Failed to start metrics server: %v", err)
+	}
+
 	// Start DNS hijacking server
 	dnsServer, err := startDNSServer(cfg.DNS.IPRange, cfg.DNS.Addr, cfg.DNS.SearchDomains)
 	if err != nil {
@@ -92,6 +143,19 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to start Controller: %v", err)
 	}
+	if !fallback {
+		if err := state.Save(cfg, provenance); err != nil {
+			klog.Warningf("Failed to keep the configuration as last-known-good: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.Pod.Watch {
+		if err := watchPod(ctx, cfg, sources, ctrl, effective, state); err != nil {
+			log.Fatalf("Failed to watch pod: %v", err)
+		}
+	}
 
 	// Create signal channel
 	sigChan := make(chan os.Signal, 1)
@@ -107,6 +171,55 @@ func main() {
 	klog.Info("Program exited")
 }
 
+// watchPod applies the service annotations of the sidecar Pod over sources
+// to the controller whenever they change
+func watchPod(ctx context.Context, cfg *config.Config, sources []*config.Source, ctrl *controller.Controller,
+	effective *config.Effective, state *config.State) error {
+	if cfg.Pod.Name == "" || cfg.Pod.Namespace == "" {
+		return fmt.Errorf("SIDECAR_POD_NAME and SIDECAR_POD_NAMESPACE must be set")
+	}
+	restConfig, err := ctrlconfig.GetConfig()
+	if err != nil {
+		return err
+	}
+	c, err := client.NewWithWatch(restConfig, client.Options{})
+	if err != nil {
+		return err
+	}
+	klog.Infof("Watching service annotations of pod %s/%s", cfg.Pod.Namespace, cfg.Pod.Name)
+	go config.NewPodWatcher(c, cfg.Pod.Namespace, cfg.Pod.Name).Run(ctx, sources, func(updated *config.Config, provenance config.Provenance) error {
+		if err := ctrl.Update(updated); err != nil {
+			return err
+		}
+		effective.Set(updated, provenance)
+		if err := state.Save(updated, provenance); err != nil {
+			klog.Warningf("Failed to keep the configuration as last-known-good: %v", err)
+		}
+		return nil
+	}, state.Failed)
+	return nil
+}
+
+// startMetricsServer serves metrics, health and the effective configuration
+// on addr, it fails if addr cannot be bound
+func startMetricsServer(addr string, effective *config.Effective, state *config.State) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/config", effective)
+	mux.Handle("/healthz", state)
+	log.Printf("Metrics and health listening on %s", addr)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Fatalf("metrics server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
 // startDNSServer creates and starts the DNS hijacking server for sidecar.
 func startDNSServer(ipRange, addr string, searchDomains []string) (*dns.Server, error) {
 	server, err := dns.NewServer(ipRange)
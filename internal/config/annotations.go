@@ -0,0 +1,142 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// Pod annotations holding the service lists as YAML or JSON, mounted by the
+// downward API as exported-services-config.yaml and
+// imported-services-config.yaml. The multicluster.kubernetes.io keys of the
+// Multi-Cluster Services design are accepted as well.
+const (
+	ExportedServicesAnnotation  = "servicekeel.io/exported-services"
+	ImportedServicesAnnotation  = "servicekeel.io/imported-services"
+	MCSExportServicesAnnotation = "multicluster.kubernetes.io/export-services"
+	MCSImportServicesAnnotation = "multicluster.kubernetes.io/import-services"
+)
+
+var (
+	exportedAnnotations = []string{ExportedServicesAnnotation, MCSExportServicesAnnotation}
+	importedAnnotations = []string{ImportedServicesAnnotation, MCSImportServicesAnnotation}
+)
+
+// manifest holds the annotations of a Kubernetes object, pod templates of
+// workloads such as Deployments are looked at as well
+type manifest struct {
+	Metadata struct {
+		Namespace   string            `yaml:"namespace"`
+		Annotations map[string]string `yaml:"annotations"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Template struct {
+			Metadata struct {
+				Annotations map[string]string `yaml:"annotations"`
+			} `yaml:"metadata"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+// ReadManifest reads the service annotations of the first object in a YAML
+// manifest carrying any, and validates them like the mounted files. The
+// main configuration is left at its defaults, the Pod namespace is the
+// namespace of the object or "default".
+func ReadManifest(path string) (*Config, *Validation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	validation := &Validation{}
+	config := DefaultConfig()
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var m manifest
+		if err := decoder.Decode(&m); errors.Is(err, io.EOF) {
+			return nil, nil, fmt.Errorf("no %s or %s annotation found in %s",
+				strings.Join(exportedAnnotations, ", "), strings.Join(importedAnnotations, ", "), path)
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse manifest %s: %v", path, err)
+		}
+		annotations := m.Metadata.Annotations
+		if !hasServiceAnnotations(annotations) {
+			annotations = m.Spec.Template.Metadata.Annotations
+		}
+		if !hasServiceAnnotations(annotations) {
+			continue
+		}
+
+		config.Pod.Namespace = m.Metadata.Namespace
+		if config.Pod.Namespace == "" {
+			config.Pod.Namespace = "default"
+		}
+		config.ExportedServices, err = readServiceAnnotation(validation, path, annotations, exportedAnnotations)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ImportedServices, err = readServiceAnnotation(validation, path, annotations, importedAnnotations)
+		if err != nil {
+			return nil, nil, err
+		}
+		DefaultNamespaces(config)
+		services := ValidateServices(config)
+		validation.Errors = append(validation.Errors, services.Errors...)
+		validation.Warnings = append(validation.Warnings, services.Warnings...)
+		return config, validation, nil
+	}
+}
+
+// readServiceAnnotation parses the first of keys set in annotations
+func readServiceAnnotation(v *Validation, path string, annotations map[string]string, keys []string) (ServiceList, error) {
+	var list ServiceList
+	found := ""
+	for _, key := range keys {
+		value, ok := annotations[key]
+		if !ok {
+			continue
+		}
+		if found != "" {
+			v.warnf(path+": "+key, "ignored, %s is set as well", found)
+			continue
+		}
+		found = key
+		var err error
+		list, err = ParseServiceList(value)
+		if err != nil {
+			return list, fmt.Errorf("failed to parse annotation %s: %v", key, err)
+		}
+		list.file = path + ": " + key
+	}
+	return list, nil
+}
+
+func hasServiceAnnotations(annotations map[string]string) bool {
+	for _, key := range append(exportedAnnotations, importedAnnotations...) {
+		if _, ok := annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseServiceList parses a ServiceList document in YAML or JSON the way
+// the mounted files are read, so that keys match case-insensitively
+func ParseServiceList(value string) (ServiceList, error) {
+	var list ServiceList
+	if strings.TrimSpace(value) == "" {
+		return list, nil
+	}
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(value)); err != nil {
+		return list, err
+	}
+	return readServiceList(v)
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseServiceListJSON(t *testing.T) {
+	list, err := ParseServiceList(`{
+  "apiVersion": "servicekeel.io/v1alpha2",
+  "kind": "ServiceList",
+  "services": [
+    {"name": "backend", "cluster": "cluster-a", "alias": "backend",
+     "ports": [{"name": "http", "port": 80, "targetPort": 8080, "protocol": "TCP"}]}
+  ]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Services) != 1 {
+		t.Fatalf("Unexpected services: %+v", list.Services)
+	}
+	svc := list.Services[0]
+	if svc.Name != "backend" || svc.Cluster != "cluster-a" || svc.Alias != "backend" || svc.Namespace != "" {
+		t.Errorf("Unexpected service: %+v", svc)
+	}
+	if len(svc.Ports) != 1 || svc.Ports[0].TargetPort != 8080 || svc.Ports[0].Protocol != "TCP" {
+		t.Errorf("Unexpected ports: %+v", svc.Ports)
+	}
+
+	if list, err := ParseServiceList("  \n"); err != nil || len(list.Services) != 0 {
+		t.Errorf("Empty value = %+v, %v; want no services", list, err)
+	}
+}
+
+// writeManifest writes a manifest to a temporary file
+func writeManifest(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "manifest.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadManifest(t *testing.T) {
+	// The servicekeel.io and multicluster.kubernetes.io keys are both read,
+	// services without a namespace take the one of the object
+	path := writeManifest(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unrelated
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: client
+  namespace: web
+spec:
+  template:
+    metadata:
+      annotations:
+        servicekeel.io/exported-services: |
+          apiVersion: servicekeel.io/v1alpha2
+          kind: ServiceList
+          services:
+            - name: frontend
+              ports:
+                - {name: http, port: 80, targetPort: 8080, protocol: TCP}
+        multicluster.kubernetes.io/import-services: |
+          {"apiVersion": "servicekeel.io/v1alpha2", "kind": "ServiceList",
+           "services": [{"name": "db", "namespace": "data", "ports": [{"name": "mysql", "port": 3306, "targetPort": 3306, "protocol": "TCP"}]},
+                        {"name": "cache", "ports": [{"name": "redis", "port": 6379, "targetPort": 6379, "protocol": "TCP"}]}]}
+`)
+	cfg, validation, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validation.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Pod.Namespace != "web" {
+		t.Errorf("Pod namespace = %q; want web", cfg.Pod.Namespace)
+	}
+	exported := cfg.ExportedServices.Services
+	if len(exported) != 1 || exported[0].Name != "frontend" || exported[0].Namespace != "web" {
+		t.Errorf("Unexpected exported services: %+v", exported)
+	}
+	imported := cfg.ImportedServices.Services
+	if len(imported) != 2 || imported[0].Namespace != "data" || imported[1].Namespace != "web" {
+		t.Errorf("Unexpected imported services: %+v", imported)
+	}
+}
+
+func TestReadManifestMCS(t *testing.T) {
+	// The import annotation of docs/arch2.md, without apiVersion, ports and
+	// with comments and an alias
+	path := writeManifest(t, `apiVersion: v1
+kind: Pod
+metadata:
+  name: frontend-pod
+  namespace: web
+  annotations:
+    multicluster.kubernetes.io/import-services: |
+      {
+        "services": [
+          {
+            "name": "backend-service",
+            "namespace": "default",  # 可选，默认为 Pod 所在命名空间
+            "cluster": "cluster-2",   # 可选，如果不指定则表示任意集群
+            "alias": "backend"        # 可选，本地服务别名
+          },
+          {
+            "name": "database-service"
+          }
+        ]
+      }
+`)
+	cfg, validation, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validation.Err(); err != nil {
+		t.Fatal(err)
+	}
+	imported := cfg.ImportedServices.Services
+	if len(imported) != 2 {
+		t.Fatalf("Unexpected imported services: %+v", imported)
+	}
+	if svc := imported[0]; svc.Name != "backend-service" || svc.Namespace != "default" || svc.Cluster != "cluster-2" || svc.Alias != "backend" {
+		t.Errorf("Unexpected service: %+v", svc)
+	}
+	if svc := imported[1]; svc.Name != "database-service" || svc.Namespace != "web" || svc.Cluster != "" {
+		t.Errorf("Unexpected service: %+v", svc)
+	}
+}
+
+func TestReadManifestAnnotationKeys(t *testing.T) {
+	// Both keys of a family set: the servicekeel.io one wins with a warning
+	path := writeManifest(t, `apiVersion: v1
+kind: Pod
+metadata:
+  name: client
+  annotations:
+    servicekeel.io/imported-services: |
+      services:
+        - name: db
+          ports:
+            - {name: mysql, port: 3306, targetport: 3306, protocol: TCP}
+    multicluster.kubernetes.io/import-services: |
+      services:
+        - name: other
+`)
+	cfg, validation, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := cfg.ImportedServices.Services
+	if len(imported) != 1 || imported[0].Name != "db" || imported[0].Namespace != "default" {
+		t.Errorf("Unexpected imported services: %+v", imported)
+	}
+	if len(validation.Warnings) != 1 || !strings.HasSuffix(validation.Warnings[0].Path, MCSImportServicesAnnotation) ||
+		!strings.Contains(validation.Warnings[0].Message, ImportedServicesAnnotation+" is set as well") {
+		t.Errorf("Unexpected warnings: %v", validation.Warnings)
+	}
+
+	// Issues are reported at the annotation
+	path = writeManifest(t, `metadata:
+  annotations:
+    multicluster.kubernetes.io/export-services: |
+      services:
+        - name: web
+          ports:
+            - {name: http, port: 80, targetport: 80, protocol: SCTP}
+`)
+	_, validation, err = ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validation.Errors) != 1 || validation.Errors[0].Path != path+": "+MCSExportServicesAnnotation+": services[0] (web): ports[0] (http)" {
+		t.Errorf("Unexpected errors: %v", validation.Errors)
+	}
+
+	if _, _, err := ReadManifest(writeManifest(t, "metadata:\n  name: plain\n")); err == nil {
+		t.Error("Expected an error for a manifest without service annotations")
+	}
+}
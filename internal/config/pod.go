@@ -0,0 +1,180 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// minWatchBackoff is the first delay before watching the Pod again
+	minWatchBackoff = time.Second
+	// maxWatchBackoff caps the delay between watches of the Pod
+	maxWatchBackoff = 30 * time.Second
+)
+
+// PodWatcher reads the service annotations of the sidecar Pod through the
+// Kubernetes API, changes are seen at once and no downward API volume is
+// needed. The sidecar needs permission to get and watch its Pod.
+type PodWatcher struct {
+	client    client.WithWatch
+	namespace string
+	name      string
+
+	// annotations last applied by update, by key
+	last map[string]string
+	// rejected are the last annotations failing validation, they are not
+	// reported again until they change
+	rejected map[string]string
+}
+
+// NewPodWatcher creates a watcher of the Pod namespace/name
+func NewPodWatcher(c client.WithWatch, namespace, name string) *PodWatcher {
+	return &PodWatcher{client: c, namespace: namespace, name: name}
+}
+
+// Run calls update with sources merged with the service annotations of the
+// Pod whenever they change, until ctx is done. Configurations failing
+// validation or update are logged and passed to failed, the previous one
+// stays in effect. Annotations update failed on are applied again with the
+// next event of the Pod.
+func (w *PodWatcher) Run(ctx context.Context, sources []*Source, update func(*Config, Provenance) error, failed func(error)) {
+	backoff := minWatchBackoff
+	for {
+		started := time.Now()
+		if err := w.watch(ctx, sources, update, failed); err != nil {
+			klog.Errorf("failed to watch pod %s/%s: %v", w.namespace, w.name, err)
+		}
+		// a watch that ran for a while is restarted quickly again
+		if time.Since(started) > maxWatchBackoff {
+			backoff = minWatchBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// watch reads the Pod and follows its changes until the watch ends. The
+// watch is opened first so that no change between reading and watching is
+// missed, unchanged annotations are not passed on twice.
+func (w *PodWatcher) watch(ctx context.Context, sources []*Source, update func(*Config, Provenance) error, failed func(error)) error {
+	watcher, err := w.client.Watch(ctx, &corev1.PodList{},
+		client.InNamespace(w.namespace),
+		client.MatchingFields{"metadata.name": w.name})
+	if err != nil {
+		return err
+	}
+	pod := &corev1.Pod{}
+	if err := w.client.Get(ctx, client.ObjectKey{Namespace: w.namespace, Name: w.name}, pod); err != nil {
+		watcher.Stop()
+		return err
+	}
+	w.changed(pod, sources, update, failed)
+
+	defer watcher.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				// not every client filters by field
+				if pod, ok := event.Object.(*corev1.Pod); ok && pod.Name == w.name {
+					w.changed(pod, sources, update, failed)
+				}
+			case watch.Error:
+				return fmt.Errorf("watch error: %v", event.Object)
+			}
+		}
+	}
+}
+
+// changed passes on the services of pod if its annotations differ from the
+// ones applied last
+func (w *PodWatcher) changed(pod *corev1.Pod, sources []*Source, update func(*Config, Provenance) error, failed func(error)) {
+	annotations := make(map[string]string)
+	for _, key := range append(exportedAnnotations, importedAnnotations...) {
+		if value, ok := pod.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+	if w.last != nil && reflect.DeepEqual(annotations, w.last) ||
+		w.rejected != nil && reflect.DeepEqual(annotations, w.rejected) {
+		return
+	}
+
+	cfg, provenance, validation, err := w.config(annotations, sources)
+	if err != nil {
+		klog.Errorf("pod %s/%s: %v, keeping the current services", w.namespace, w.name, err)
+		w.rejected = annotations
+		failed(err)
+		return
+	}
+	for _, warning := range validation.Warnings {
+		klog.Warningf("configuration: %s", warning)
+	}
+	if err := validation.Err(); err != nil {
+		klog.Errorf("pod %s/%s: invalid service configuration, keeping the current services: %v", w.namespace, w.name, err)
+		w.rejected = annotations
+		failed(err)
+		return
+	}
+	klog.Infof("Services of pod %s/%s changed: %d exported, %d imported",
+		w.namespace, w.name, len(cfg.ExportedServices.Services), len(cfg.ImportedServices.Services))
+	if err := update(cfg, provenance); err != nil {
+		klog.Errorf("pod %s/%s: failed to apply services, retrying with the next event: %v", w.namespace, w.name, err)
+		failed(err)
+		return
+	}
+	w.last = annotations
+	w.rejected = nil
+}
+
+// config merges sources with the services of annotations, an annotation
+// replaces the service list of the sources below
+func (w *PodWatcher) config(annotations map[string]string, sources []*Source) (*Config, Provenance, *Validation, error) {
+	path := fmt.Sprintf("pod %s/%s", w.namespace, w.name)
+	validation := &Validation{}
+	pod := &Source{
+		Name:            path,
+		values:          map[string]string{"pod.name": w.name, "pod.namespace": w.namespace},
+		replaceServices: true,
+	}
+	for _, list := range []struct {
+		keys     []string
+		services **ServiceList
+	}{
+		{exportedAnnotations, &pod.exported},
+		{importedAnnotations, &pod.imported},
+	} {
+		services, err := readServiceAnnotation(validation, path, annotations, list.keys)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if services.file != "" {
+			*list.services = &services
+		}
+	}
+
+	cfg, provenance, merged := Merge(append(sources[:len(sources):len(sources)], pod))
+	validation.Errors = append(validation.Errors, merged.Errors...)
+	validation.Warnings = append(validation.Warnings, merged.Warnings...)
+	return cfg, provenance, validation, nil
+}
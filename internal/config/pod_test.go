@@ -0,0 +1,149 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testImports = `apiVersion: servicekeel.io/v1alpha2
+kind: ServiceList
+services:
+  - name: backend
+    cluster: cluster-a
+    ports:
+      - name: http
+        port: 80
+        targetPort: 8080
+        protocol: TCP
+`
+
+// nextConfig waits for the next configuration passed on by the watcher
+func nextConfig(t *testing.T, updates <-chan *Config) *Config {
+	t.Helper()
+	select {
+	case cfg := <-updates:
+		return cfg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for configuration")
+		return nil
+	}
+}
+
+func TestPodWatcher(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "frontend",
+		Namespace:   "web",
+		Annotations: map[string]string{ImportedServicesAnnotation: testImports},
+	}}
+	c := fake.NewClientBuilder().WithObjects(pod).Build()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan *Config, 8)
+	sources := []*Source{defaultSource(), {Name: "test", values: map[string]string{"dns.ipRange": "127.0.66.0/24"}}}
+	failures := make(chan error, 8)
+	go NewPodWatcher(c, "web", "frontend").Run(ctx, sources,
+		func(cfg *Config, _ Provenance) error { updates <- cfg; return nil },
+		func(err error) { failures <- err })
+
+	// The namespace defaults to the namespace of the Pod
+	cfg := nextConfig(t, updates)
+	if got := cfg.ImportedServices.Services; len(got) != 1 || got[0].Name != "backend" || got[0].Namespace != "web" {
+		t.Fatalf("Unexpected imported services: %+v", got)
+	}
+	if cfg.DNS.IPRange != "127.0.66.0/24" {
+		t.Errorf("IP range = %q; want the one of the sources", cfg.DNS.IPRange)
+	}
+
+	// Invalid annotations keep the current services
+	pod.Annotations[ImportedServicesAnnotation] = testImports + "    alias: Not_A_Name\n"
+	if err := c.Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-failures:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the failure of invalid annotations")
+	}
+
+	// Changes of other annotations are ignored, the multicluster keys are read
+	pod.Annotations["example.com/other"] = "changed"
+	pod.Annotations[MCSExportServicesAnnotation] = `{"services": [{"name": "api", "cluster": "cluster-b",
+		"ports": [{"name": "grpc", "port": 9000, "targetPort": 9000, "protocol": "TCP"}]}]}`
+	pod.Annotations[ImportedServicesAnnotation] = testImports
+	if err := c.Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	cfg = nextConfig(t, updates)
+	if got := cfg.ExportedServices.Services; len(got) != 1 || got[0].Name != "api" || got[0].Namespace != "web" {
+		t.Fatalf("Unexpected exported services: %+v", got)
+	}
+
+	pod.Annotations["example.com/other"] = "changed again"
+	if err := c.Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cfg := <-updates:
+		t.Fatalf("Unexpected configuration after an unrelated change: %+v", cfg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPodWatcherRetry(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "frontend",
+		Namespace:   "web",
+		Annotations: map[string]string{ImportedServicesAnnotation: testImports},
+	}}
+	c := fake.NewClientBuilder().WithObjects(pod).Build()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan *Config, 8)
+	failures := make(chan error, 8)
+	fail := true
+	go NewPodWatcher(c, "web", "frontend").Run(ctx, []*Source{defaultSource()},
+		func(cfg *Config, _ Provenance) error {
+			updates <- cfg
+			if fail {
+				fail = false
+				return fmt.Errorf("update failed")
+			}
+			return nil
+		},
+		func(err error) { failures <- err })
+
+	nextConfig(t, updates)
+	select {
+	case <-failures:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the failed update")
+	}
+
+	// The annotations update failed on are applied again with the next event
+	pod.Annotations["example.com/other"] = "changed"
+	if err := c.Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextConfig(t, updates).ImportedServices.Services; len(got) != 1 || got[0].Name != "backend" {
+		t.Fatalf("Unexpected imported services: %+v", got)
+	}
+
+	// Once applied they are not passed on again
+	pod.Annotations["example.com/other"] = "changed again"
+	if err := c.Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cfg := <-updates:
+		t.Fatalf("Unexpected configuration after an unrelated change: %+v", cfg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
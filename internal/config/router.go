@@ -0,0 +1,275 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// RouterConfig represents the complete router configuration
+type RouterConfig struct {
+	// ServerListen is the address exported services register on
+	ServerListen string `json:"serverListen"`
+	// VisitorListen is the address importing sidecars connect to
+	VisitorListen string `json:"visitorListen"`
+	// QUICListen is an additional UDP address exported services and peers
+	// may register on over QUIC instead of TCP, empty disables QUIC
+	QUICListen string `json:"quicListen"`
+	// SecretKey is used for authentication and encryption
+	SecretKey string `json:"secretKey"`
+	// AllowUsers specifies which users are allowed to connect. Identities are
+	// only verified with mutual TLS (tls.caFile), otherwise any client with
+	// the secret key may claim any user.
+	AllowUsers []string `json:"allowUsers"`
+	// UseEncryption controls whether to encrypt the traffic
+	UseEncryption bool `json:"useEncryption"`
+	// UseCompression controls whether to compress the traffic
+	UseCompression bool `json:"useCompression"`
+	// UnixSocket controls mode and ownership of Unix domain socket listeners
+	UnixSocket UnixSocketConfig `json:"unixSocket"`
+	// TLS enables TLS 1.3 on the listeners and peer connections
+	TLS RouterTLSConfig `json:"tls"`
+	// Name identifies this router to its peers
+	Name string `json:"name"`
+	// Peers lists the routers this router links to and accepts links from,
+	// both routers of a link list each other
+	Peers []RouterPeerConfig `json:"peers"`
+	// Metrics configures the Prometheus and health endpoints
+	Metrics MetricsConfig `json:"metrics"`
+	// Admin configures the admin API
+	Admin RouterAdminConfig `json:"admin"`
+	// ShutdownTimeout bounds the time active sessions may take to finish on shutdown
+	ShutdownTimeout time.Duration `json:"shutdownTimeout"`
+	// LoadBalance chooses among the servers registered under the same proxy
+	// name: round_robin, least_conn or consistent_hash
+	LoadBalance string `json:"loadBalance"`
+	// MaxPoolCount caps the idle work connection pool a server may request per proxy
+	MaxPoolCount int `json:"maxPoolCount"`
+	// HeartbeatInterval is the time between pings on peer links
+	HeartbeatInterval time.Duration `json:"heartbeatInterval"`
+	// HeartbeatTimeout is the time without any message after which a control
+	// connection or peer link is closed as dead
+	HeartbeatTimeout time.Duration `json:"heartbeatTimeout"`
+	// Limits holds bandwidth limits and traffic quotas per proxy
+	Limits []RouterLimitConfig `json:"limits"`
+	// StateDir keeps the traffic quota usage across restarts, empty resets
+	// the quotas with every restart
+	StateDir string `json:"stateDir"`
+}
+
+// RouterLimitConfig limits the bandwidth and traffic of a proxy, zero values are unlimited
+type RouterLimitConfig struct {
+	// Proxy is the proxy name, "*" applies to proxies without a limit of their own
+	Proxy string `json:"proxy"`
+	// Bandwidth is the bytes per second shared by all visitors in each direction
+	Bandwidth int64 `json:"bandwidth"`
+	// VisitorBandwidth is the bytes per second of a single visitor in each direction
+	VisitorBandwidth int64 `json:"visitorBandwidth"`
+	// DailyQuota and MonthlyQuota are the bytes the proxy may carry per day
+	// and month, new visitor streams are rejected once exhausted. The usage
+	// is kept in stateDir across restarts.
+	DailyQuota   int64 `json:"dailyQuota"`
+	MonthlyQuota int64 `json:"monthlyQuota"`
+}
+
+// RouterAdminConfig configures the admin API listing and managing proxies and sessions
+type RouterAdminConfig struct {
+	// Addr is the admin API address, empty serves it on the metrics address
+	Addr string `json:"addr"`
+	// User and Password are the basic authentication credentials, the admin
+	// API is only served when both are set
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// RouterPeerConfig describes another router to link to
+type RouterPeerConfig struct {
+	// Name is the router name the peer logs in with
+	Name string `json:"name"`
+	// Addr is the server listener address of the peer visitors are
+	// forwarded to, "quic://host:port" links over QUIC
+	Addr string `json:"addr"`
+}
+
+// RouterTLSConfig configures TLS for router connections, files are reloaded on rotation
+type RouterTLSConfig struct {
+	// CertFile and KeyFile hold the router certificate, setting them enables TLS
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// CAFile enables mutual TLS, clients and peers must present a certificate
+	// signed by one of its CAs. The certificate common name is the user,
+	// organizational unit the namespace and organization the cluster.
+	CAFile string `json:"caFile"`
+	// ServerName is verified in the certificates of peers, empty uses the peer host
+	ServerName string `json:"serverName"`
+}
+
+// Enabled reports whether TLS is configured
+func (c RouterTLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
+// UnixSocketConfig configures the socket files created for Unix listeners
+type UnixSocketConfig struct {
+	// Mode is the octal file mode, e.g. "0660"; empty keeps the umask default
+	Mode string `json:"mode"`
+	// UID is the socket owner, -1 keeps the current owner
+	UID int `json:"uid"`
+	// GID is the socket group, -1 keeps the current group
+	GID int `json:"gid"`
+}
+
+func (c *RouterConfig) String() string {
+	// never print the secret key or admin password
+	redacted := *c
+	if redacted.SecretKey != "" {
+		redacted.SecretKey = "******"
+	}
+	if redacted.Admin.Password != "" {
+		redacted.Admin.Password = "******"
+	}
+	var buf bytes.Buffer
+	err := yaml.NewEncoder(&buf).Encode(&redacted)
+	if err != nil {
+		return fmt.Sprintf("failed to marshal config: %v", err)
+	}
+	return buf.String()
+}
+
+// FileMode parses the configured octal socket mode, 0 means unset
+func (c UnixSocketConfig) FileMode() (uint32, error) {
+	if c.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unix socket mode %q: %v", c.Mode, err)
+	}
+	return uint32(mode), nil
+}
+
+// LoadRouterConfig reads the router configuration using Viper.
+// When path is empty the "router" config file is searched in the default
+// config directories; a missing file is not an error and leaves the defaults.
+func LoadRouterConfig(path string) (*RouterConfig, error) {
+	v := viper.New()
+
+	// Set default values
+	v.SetDefault("serverListen", "/tmp/router.sock")
+	v.SetDefault("visitorListen", "127.0.0.1:7001")
+	v.SetDefault("quicListen", "")
+	v.SetDefault("secretKey", "")
+	v.SetDefault("allowUsers", []string{})
+	v.SetDefault("useEncryption", false)
+	v.SetDefault("useCompression", false)
+	v.SetDefault("unixSocket.mode", "")
+	v.SetDefault("unixSocket.uid", -1)
+	v.SetDefault("unixSocket.gid", -1)
+	v.SetDefault("tls.certFile", "")
+	v.SetDefault("tls.keyFile", "")
+	v.SetDefault("tls.caFile", "")
+	v.SetDefault("tls.serverName", "")
+	v.SetDefault("name", "")
+	v.SetDefault("metrics.addr", ":8080")
+	v.SetDefault("admin.addr", "")
+	v.SetDefault("admin.user", "")
+	v.SetDefault("admin.password", "")
+	v.SetDefault("shutdownTimeout", "30s")
+	v.SetDefault("loadBalance", "round_robin")
+	v.SetDefault("maxPoolCount", 16)
+	v.SetDefault("heartbeatInterval", "10s")
+	v.SetDefault("heartbeatTimeout", "30s")
+	v.SetDefault("stateDir", "/var/lib/servicekeel")
+
+	// Set environment variable prefix
+	v.SetEnvPrefix("ROUTER")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	_ = v.BindEnv("serverListen", "ROUTER_SERVER_LISTEN")
+	_ = v.BindEnv("visitorListen", "ROUTER_VISITOR_LISTEN")
+	_ = v.BindEnv("quicListen", "ROUTER_QUIC_LISTEN")
+	_ = v.BindEnv("secretKey", "ROUTER_SECRET_KEY")
+	_ = v.BindEnv("allowUsers", "ROUTER_ALLOW_USERS")
+	_ = v.BindEnv("name", "ROUTER_NAME")
+	_ = v.BindEnv("admin.password", "ROUTER_ADMIN_PASSWORD")
+	_ = v.BindEnv("shutdownTimeout", "ROUTER_SHUTDOWN_TIMEOUT")
+	_ = v.BindEnv("loadBalance", "ROUTER_LOAD_BALANCE")
+	_ = v.BindEnv("maxPoolCount", "ROUTER_MAX_POOL_COUNT")
+	_ = v.BindEnv("heartbeatInterval", "ROUTER_HEARTBEAT_INTERVAL")
+	_ = v.BindEnv("heartbeatTimeout", "ROUTER_HEARTBEAT_TIMEOUT")
+	_ = v.BindEnv("stateDir", "ROUTER_STATE_DIR")
+
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("router")
+		v.AddConfigPath(defaultConfigDir)
+		v.AddConfigPath("config")
+		v.AddConfigPath(".")
+		v.SetConfigType("yaml")
+	}
+
+	// Read configuration file
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || path != "" {
+			return nil, fmt.Errorf("failed to read router configuration file: %v", err)
+		}
+	}
+
+	var config RouterConfig
+	if err := v.Unmarshal(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse router configuration file: %v", err)
+	}
+	if _, err := config.UnixSocket.FileMode(); err != nil {
+		return nil, err
+	}
+	if config.HeartbeatTimeout > 0 && config.HeartbeatInterval >= config.HeartbeatTimeout {
+		return nil, fmt.Errorf("heartbeatInterval %v must be shorter than heartbeatTimeout %v", config.HeartbeatInterval, config.HeartbeatTimeout)
+	}
+	limited := make(map[string]bool)
+	for _, l := range config.Limits {
+		if l.Proxy == "" {
+			return nil, fmt.Errorf("limit without proxy name")
+		}
+		if limited[l.Proxy] {
+			return nil, fmt.Errorf("duplicate limit for proxy %s", l.Proxy)
+		}
+		limited[l.Proxy] = true
+		if l.Bandwidth < 0 || l.VisitorBandwidth < 0 || l.DailyQuota < 0 || l.MonthlyQuota < 0 {
+			return nil, fmt.Errorf("limit for proxy %s must not be negative", l.Proxy)
+		}
+	}
+	return &config, nil
+}
+
+// Validate checks the settings that may also be set by flags after the
+// configuration was loaded
+func (c *RouterConfig) Validate() error {
+	// logins are signed with the secret key, an empty key lets anyone log in
+	if c.SecretKey == "" {
+		return fmt.Errorf("secretKey is required (--secret-key or ROUTER_SECRET_KEY)")
+	}
+	return nil
+}
+
+// ParseRouterPeers parses a comma separated list of name=addr peers
+func ParseRouterPeers(s string) ([]RouterPeerConfig, error) {
+	var peers []RouterPeerConfig
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(item, "=")
+		if !ok || name == "" || addr == "" {
+			return nil, fmt.Errorf("invalid peer %q, expected name=addr", item)
+		}
+		peers = append(peers, RouterPeerConfig{Name: name, Addr: addr})
+	}
+	return peers, nil
+}
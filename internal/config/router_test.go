@@ -0,0 +1,17 @@
+package config
+
+import "testing"
+
+func TestRouterConfigSecretKey(t *testing.T) {
+	cfg, err := LoadRouterConfig("../../config/router.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected an error without secretKey")
+	}
+	cfg.SecretKey = "secret"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() returned error: %v", err)
+	}
+}
@@ -0,0 +1,522 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// API versions and kinds of the sidecar configuration documents. Config
+// documents without apiVersion are read as v1alpha1, the format of the
+// first releases. Service lists without apiVersion are read as v1alpha2,
+// which reads v1alpha1 lists the same way and takes the alias of the
+// Multi-Cluster Services annotations.
+const (
+	APIVersionV1alpha1 = "servicekeel.io/v1alpha1"
+	APIVersionV1alpha2 = "servicekeel.io/v1alpha2"
+
+	// KindServiceList is the kind of the exported and imported services
+	// files and annotations
+	KindServiceList = "ServiceList"
+	// KindSidecarConfig is the kind of config.yaml and extra config files
+	KindSidecarConfig = "SidecarConfig"
+)
+
+// APIVersions lists the supported API versions, oldest first
+var APIVersions = []string{APIVersionV1alpha1, APIVersionV1alpha2}
+
+// v1alpha1 is the format documented in the first releases, targetport is
+// written in lower case
+type v1alpha1Port struct {
+	Name       string `yaml:"name"`
+	Port       int    `yaml:"port"`
+	TargetPort int    `yaml:"targetport"`
+	Protocol   string `yaml:"protocol"`
+}
+
+type v1alpha1Service struct {
+	Name      string         `yaml:"name"`
+	Namespace string         `yaml:"namespace"`
+	Cluster   string         `yaml:"cluster"`
+	Ports     []v1alpha1Port `yaml:"ports"`
+}
+
+type v1alpha1ServiceList struct {
+	APIVersion string            `yaml:"apiVersion,omitempty"`
+	Kind       string            `yaml:"kind,omitempty"`
+	Services   []v1alpha1Service `yaml:"services"`
+}
+
+type v1alpha1DNS struct {
+	IPRange       string   `yaml:"ipRange,omitempty"`
+	Addr          string   `yaml:"addr,omitempty"`
+	SearchDomains []string `yaml:"searchDomains,omitempty"`
+}
+
+type v1alpha1Metrics struct {
+	Addr string `yaml:"addr,omitempty"`
+}
+
+type v1alpha1SidecarConfig struct {
+	APIVersion string           `yaml:"apiVersion,omitempty"`
+	Kind       string           `yaml:"kind,omitempty"`
+	DNS        *v1alpha1DNS     `yaml:"dns,omitempty"`
+	Metrics    *v1alpha1Metrics `yaml:"metrics,omitempty"`
+}
+
+// v1alpha2 adds service aliases, optional namespaces and clusters, the
+// PROXY protocol, port ranges, mapped IPs, the Pod, port and state settings
+// and service lists in config files
+type v1alpha2Port struct {
+	Name          string    `yaml:"name"`
+	Port          portRange `yaml:"port"`
+	TargetPort    portRange `yaml:"targetPort"`
+	Protocol      string    `yaml:"protocol"`
+	ProxyProtocol string    `yaml:"proxyProtocol,omitempty"`
+}
+
+// portRange is a port or a range of ports such as "30000-30100"
+type portRange string
+
+// newPortRange formats the range start-end, end is 0 for a single port
+func newPortRange(start, end int) portRange {
+	if end == 0 {
+		return portRange(strconv.Itoa(start))
+	}
+	return portRange(fmt.Sprintf("%d-%d", start, end))
+}
+
+// parse returns the first and last port, last is 0 for a single port
+func (r portRange) parse() (start, end int, err error) {
+	if r == "" {
+		return 0, 0, nil
+	}
+	first, last, isRange := strings.Cut(string(r), "-")
+	if start, err = strconv.Atoi(strings.TrimSpace(first)); err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", r)
+	}
+	if !isRange {
+		return start, 0, nil
+	}
+	if end, err = strconv.Atoi(strings.TrimSpace(last)); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", r)
+	}
+	return start, end, nil
+}
+
+// MarshalYAML writes single ports as numbers
+func (r portRange) MarshalYAML() (interface{}, error) {
+	start, end, err := r.parse()
+	if err != nil || end != 0 {
+		return string(r), nil
+	}
+	return start, nil
+}
+
+type v1alpha2Service struct {
+	Name      string         `yaml:"name"`
+	Namespace string         `yaml:"namespace,omitempty"`
+	Cluster   string         `yaml:"cluster,omitempty"`
+	Alias     string         `yaml:"alias,omitempty"`
+	MappedIP  string         `yaml:"mappedIP,omitempty"`
+	Ports     []v1alpha2Port `yaml:"ports"`
+}
+
+type v1alpha2Services struct {
+	Services []v1alpha2Service `yaml:"services"`
+}
+
+type v1alpha2ServiceList struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Services   []v1alpha2Service `yaml:"services"`
+}
+
+type v1alpha2Pod struct {
+	Name      string `yaml:"name,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+	Watch     *bool  `yaml:"watch,omitempty"`
+}
+
+type v1alpha2Ports struct {
+	MaxRange int `yaml:"maxRange,omitempty"`
+}
+
+type v1alpha2State struct {
+	Dir string `yaml:"dir,omitempty"`
+}
+
+type v1alpha2SidecarConfig struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	DNS        *v1alpha1DNS      `yaml:"dns,omitempty"`
+	Metrics    *v1alpha1Metrics  `yaml:"metrics,omitempty"`
+	Pod        *v1alpha2Pod      `yaml:"pod,omitempty"`
+	Ports      *v1alpha2Ports    `yaml:"ports,omitempty"`
+	State      *v1alpha2State    `yaml:"state,omitempty"`
+	Exported   *v1alpha2Services `yaml:"exported,omitempty"`
+	Imported   *v1alpha2Services `yaml:"imported,omitempty"`
+}
+
+// documentType returns the API version and kind of a document, the kind
+// is guessed from its content when not set
+func documentType(v *viper.Viper) (apiVersion, kind string, err error) {
+	kind = v.GetString("kind")
+	switch {
+	case kind == "" && v.IsSet("services"):
+		kind = KindServiceList
+	case kind == "":
+		kind = KindSidecarConfig
+	case kind != KindServiceList && kind != KindSidecarConfig:
+		return "", "", fmt.Errorf("unsupported kind %q, supported are %s and %s", kind, KindServiceList, KindSidecarConfig)
+	}
+	apiVersion = v.GetString("apiVersion")
+	switch {
+	case apiVersion == "" && kind == KindServiceList:
+		apiVersion = APIVersionV1alpha2
+	case apiVersion == "":
+		apiVersion = APIVersionV1alpha1
+	case !supportedAPIVersion(apiVersion):
+		return "", "", fmt.Errorf("unsupported apiVersion %q, supported are %s", apiVersion, strings.Join(APIVersions, ", "))
+	}
+	return apiVersion, kind, nil
+}
+
+func supportedAPIVersion(apiVersion string) bool {
+	for _, version := range APIVersions {
+		if version == apiVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeDocument decodes a document into its versioned type, keys match
+// case-insensitively and unknown keys are errors
+func decodeDocument(v *viper.Viper, apiVersion, kind string, out interface{}) error {
+	err := v.Unmarshal(out, func(c *mapstructure.DecoderConfig) {
+		c.ErrorUnused = true
+	})
+	if err == nil {
+		return nil
+	}
+	// drop the heading of the decoder and list all problems on one line
+	if inner := errors.Unwrap(err); inner != nil {
+		err = inner
+	}
+	err = errors.New(strings.ReplaceAll(err.Error(), "\n", "; "))
+	if apiVersion == APIVersionV1alpha1 {
+		return fmt.Errorf("invalid %s %s, fields added later need apiVersion: %s: %v", apiVersion, kind, APIVersionV1alpha2, err)
+	}
+	return fmt.Errorf("invalid %s %s: %v", apiVersion, kind, err)
+}
+
+// readServiceList reads a ServiceList document of any supported version
+func readServiceList(v *viper.Viper) (ServiceList, error) {
+	apiVersion, kind, err := documentType(v)
+	if err != nil {
+		return ServiceList{}, err
+	}
+	if kind != KindServiceList {
+		return ServiceList{}, fmt.Errorf("kind is %s, want %s", kind, KindServiceList)
+	}
+	switch apiVersion {
+	case APIVersionV1alpha1:
+		var doc v1alpha1ServiceList
+		if err := decodeDocument(v, apiVersion, kind, &doc); err != nil {
+			return ServiceList{}, err
+		}
+		return fromV1alpha1Services(doc.Services), nil
+	default:
+		var doc v1alpha2ServiceList
+		if err := decodeDocument(v, apiVersion, kind, &doc); err != nil {
+			return ServiceList{}, err
+		}
+		return fromV1alpha2Services(doc.Services)
+	}
+}
+
+// readSidecarConfig reads a SidecarConfig document of any supported
+// version as the source name
+func readSidecarConfig(v *viper.Viper, name string) (*Source, error) {
+	apiVersion, kind, err := documentType(v)
+	if err != nil {
+		return nil, err
+	}
+	if kind != KindSidecarConfig {
+		return nil, fmt.Errorf("kind is %s, want %s", kind, KindSidecarConfig)
+	}
+	s := &Source{Name: name, values: make(map[string]string)}
+	var doc v1alpha2SidecarConfig
+	switch apiVersion {
+	case APIVersionV1alpha1:
+		var old v1alpha1SidecarConfig
+		if err := decodeDocument(v, apiVersion, kind, &old); err != nil {
+			return nil, err
+		}
+		doc.DNS, doc.Metrics = old.DNS, old.Metrics
+	default:
+		if err := decodeDocument(v, apiVersion, kind, &doc); err != nil {
+			return nil, err
+		}
+	}
+
+	set := func(key, value string) {
+		if value != "" {
+			s.values[key] = value
+		}
+	}
+	if doc.DNS != nil {
+		set("dns.addr", doc.DNS.Addr)
+		set("dns.ipRange", doc.DNS.IPRange)
+		s.searchDomains = doc.DNS.SearchDomains
+	}
+	if doc.Metrics != nil {
+		set("metrics.addr", doc.Metrics.Addr)
+	}
+	if doc.Pod != nil {
+		set("pod.name", doc.Pod.Name)
+		set("pod.namespace", doc.Pod.Namespace)
+		if doc.Pod.Watch != nil {
+			s.values["pod.watch"] = strconv.FormatBool(*doc.Pod.Watch)
+		}
+	}
+	if doc.Ports != nil && doc.Ports.MaxRange != 0 {
+		s.values["ports.maxRange"] = strconv.Itoa(doc.Ports.MaxRange)
+	}
+	if doc.State != nil {
+		set("state.dir", doc.State.Dir)
+	}
+	for _, services := range []struct {
+		key  string
+		doc  *v1alpha2Services
+		list **ServiceList
+	}{
+		{keyExported, doc.Exported, &s.exported},
+		{keyImported, doc.Imported, &s.imported},
+	} {
+		if services.doc == nil {
+			continue
+		}
+		list, err := fromV1alpha2Services(services.doc.Services)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", services.key, err)
+		}
+		list.file = name
+		*services.list = &list
+	}
+	return s, nil
+}
+
+func fromV1alpha1Services(services []v1alpha1Service) ServiceList {
+	list := ServiceList{Services: []ServiceConfig{}}
+	for _, svc := range services {
+		converted := ServiceConfig{Name: svc.Name, Namespace: svc.Namespace, Cluster: svc.Cluster}
+		for _, port := range svc.Ports {
+			converted.Ports = append(converted.Ports, Port{
+				Name:       port.Name,
+				Port:       port.Port,
+				TargetPort: port.TargetPort,
+				Protocol:   port.Protocol,
+			})
+		}
+		list.Services = append(list.Services, converted)
+	}
+	return list
+}
+
+func fromV1alpha2Services(services []v1alpha2Service) (ServiceList, error) {
+	list := ServiceList{Services: []ServiceConfig{}}
+	for i, svc := range services {
+		converted := ServiceConfig{
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+			Cluster:   svc.Cluster,
+			Alias:     svc.Alias,
+			MappedIP:  svc.MappedIP,
+		}
+		for j, port := range svc.Ports {
+			start, end, err := port.Port.parse()
+			if err != nil {
+				return list, fmt.Errorf("services[%d]: ports[%d]: %v", i, j, err)
+			}
+			targetStart, targetEnd, err := port.TargetPort.parse()
+			if err != nil {
+				return list, fmt.Errorf("services[%d]: ports[%d]: target %v", i, j, err)
+			}
+			converted.Ports = append(converted.Ports, Port{
+				Name:          port.Name,
+				Port:          start,
+				EndPort:       end,
+				TargetPort:    targetStart,
+				TargetEndPort: targetEnd,
+				Protocol:      port.Protocol,
+				ProxyProtocol: port.ProxyProtocol,
+			})
+		}
+		list.Services = append(list.Services, converted)
+	}
+	return list, nil
+}
+
+// toV1alpha1Services fails on settings v1alpha1 cannot hold
+func toV1alpha1Services(list *ServiceList) ([]v1alpha1Service, error) {
+	services := []v1alpha1Service{}
+	for _, svc := range list.Services {
+		if svc.Alias != "" {
+			return nil, fmt.Errorf("service %s: alias needs %s", svc.Name, APIVersionV1alpha2)
+		}
+		if svc.MappedIP != "" {
+			return nil, fmt.Errorf("service %s: mappedIP needs %s", svc.Name, APIVersionV1alpha2)
+		}
+		converted := v1alpha1Service{Name: svc.Name, Namespace: svc.Namespace, Cluster: svc.Cluster}
+		for _, port := range svc.Ports {
+			if port.ProxyProtocol != "" {
+				return nil, fmt.Errorf("service %s port %s: proxyProtocol needs %s", svc.Name, port.Name, APIVersionV1alpha2)
+			}
+			if port.EndPort != 0 || port.TargetEndPort != 0 {
+				return nil, fmt.Errorf("service %s port %s: port ranges need %s", svc.Name, port.Name, APIVersionV1alpha2)
+			}
+			converted.Ports = append(converted.Ports, v1alpha1Port{
+				Name:       port.Name,
+				Port:       port.Port,
+				TargetPort: port.TargetPort,
+				Protocol:   port.Protocol,
+			})
+		}
+		services = append(services, converted)
+	}
+	return services, nil
+}
+
+func toV1alpha2Services(list *ServiceList) []v1alpha2Service {
+	services := []v1alpha2Service{}
+	for _, svc := range list.Services {
+		converted := v1alpha2Service{
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+			Cluster:   svc.Cluster,
+			Alias:     svc.Alias,
+			MappedIP:  svc.MappedIP,
+		}
+		for _, port := range svc.Ports {
+			converted.Ports = append(converted.Ports, v1alpha2Port{
+				Name:          port.Name,
+				Port:          newPortRange(port.Port, port.EndPort),
+				TargetPort:    newPortRange(port.TargetPort, port.TargetEndPort),
+				Protocol:      port.Protocol,
+				ProxyProtocol: port.ProxyProtocol,
+			})
+		}
+		services = append(services, converted)
+	}
+	return services
+}
+
+// toV1alpha2SidecarConfig converts the settings and services of a source
+func toV1alpha2SidecarConfig(s *Source) *v1alpha2SidecarConfig {
+	doc := &v1alpha2SidecarConfig{APIVersion: APIVersionV1alpha2, Kind: KindSidecarConfig}
+	if s.values["dns.addr"] != "" || s.values["dns.ipRange"] != "" || s.searchDomains != nil {
+		doc.DNS = &v1alpha1DNS{Addr: s.values["dns.addr"], IPRange: s.values["dns.ipRange"], SearchDomains: s.searchDomains}
+	}
+	if s.values["metrics.addr"] != "" {
+		doc.Metrics = &v1alpha1Metrics{Addr: s.values["metrics.addr"]}
+	}
+	if watch, ok := s.values["pod.watch"]; ok || s.values["pod.name"] != "" || s.values["pod.namespace"] != "" {
+		doc.Pod = &v1alpha2Pod{Name: s.values["pod.name"], Namespace: s.values["pod.namespace"]}
+		if ok {
+			w, _ := strconv.ParseBool(watch)
+			doc.Pod.Watch = &w
+		}
+	}
+	if maxRange, ok := s.values["ports.maxRange"]; ok {
+		doc.Ports = &v1alpha2Ports{}
+		doc.Ports.MaxRange, _ = strconv.Atoi(maxRange)
+	}
+	if dir := s.values["state.dir"]; dir != "" {
+		doc.State = &v1alpha2State{Dir: dir}
+	}
+	if s.exported != nil {
+		doc.Exported = &v1alpha2Services{Services: toV1alpha2Services(s.exported)}
+	}
+	if s.imported != nil {
+		doc.Imported = &v1alpha2Services{Services: toV1alpha2Services(s.imported)}
+	}
+	return doc
+}
+
+// toV1alpha1SidecarConfig fails on settings v1alpha1 cannot hold
+func toV1alpha1SidecarConfig(s *Source) (*v1alpha1SidecarConfig, error) {
+	doc := toV1alpha2SidecarConfig(s)
+	switch {
+	case doc.Pod != nil:
+		return nil, fmt.Errorf("pod needs %s", APIVersionV1alpha2)
+	case doc.Ports != nil:
+		return nil, fmt.Errorf("ports needs %s", APIVersionV1alpha2)
+	case doc.State != nil:
+		return nil, fmt.Errorf("state needs %s", APIVersionV1alpha2)
+	case doc.Exported != nil || doc.Imported != nil:
+		return nil, fmt.Errorf("service lists in config files need %s", APIVersionV1alpha2)
+	}
+	return &v1alpha1SidecarConfig{APIVersion: APIVersionV1alpha1, Kind: KindSidecarConfig, DNS: doc.DNS, Metrics: doc.Metrics}, nil
+}
+
+// MigrateDocument converts a configuration document in YAML or JSON of any
+// supported version to apiVersion and returns it as YAML
+func MigrateDocument(data []byte, apiVersion string) ([]byte, error) {
+	if !supportedAPIVersion(apiVersion) {
+		return nil, fmt.Errorf("unsupported apiVersion %q, supported are %s", apiVersion, strings.Join(APIVersions, ", "))
+	}
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	_, kind, err := documentType(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if kind == KindServiceList {
+		list, err := readServiceList(v)
+		if err != nil {
+			return nil, err
+		}
+		if apiVersion == APIVersionV1alpha1 {
+			services, err := toV1alpha1Services(&list)
+			if err != nil {
+				return nil, err
+			}
+			doc = &v1alpha1ServiceList{APIVersion: apiVersion, Kind: kind, Services: services}
+		} else {
+			doc = &v1alpha2ServiceList{APIVersion: apiVersion, Kind: kind, Services: toV1alpha2Services(&list)}
+		}
+	} else {
+		s, err := readSidecarConfig(v, "")
+		if err != nil {
+			return nil, err
+		}
+		if apiVersion == APIVersionV1alpha1 {
+			if doc, err = toV1alpha1SidecarConfig(s); err != nil {
+				return nil, err
+			}
+		} else {
+			doc = toV1alpha2SidecarConfig(s)
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
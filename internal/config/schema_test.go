@@ -0,0 +1,170 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const testV1alpha1Services = `services:
+  - cluster: cluster-a
+    name: backend
+    namespace: default
+    ports:
+      - name: http
+        port: 80
+        protocol: TCP
+        targetport: 8080
+`
+
+func TestMigrateDocument(t *testing.T) {
+	migrated, err := MigrateDocument([]byte(testV1alpha1Services), APIVersionV1alpha2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"apiVersion: servicekeel.io/v1alpha2", "kind: ServiceList", "targetPort: 8080"} {
+		if !strings.Contains(string(migrated), want) {
+			t.Errorf("Migrated document lacks %q:\n%s", want, migrated)
+		}
+	}
+
+	// Converting back gives the same services
+	list, err := ParseServiceList(string(migrated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := list.Services; len(got) != 1 || got[0].Ports[0].TargetPort != 8080 {
+		t.Fatalf("Unexpected services: %+v", got)
+	}
+	back, err := MigrateDocument(migrated, APIVersionV1alpha1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(back), "targetport: 8080") {
+		t.Errorf("Unexpected v1alpha1 document:\n%s", back)
+	}
+
+	// Fields added in v1alpha2 cannot be converted to or read as v1alpha1
+	aliased := strings.Replace(string(migrated), "    cluster: cluster-a\n", "    cluster: cluster-a\n    alias: db\n", 1)
+	if _, err := MigrateDocument([]byte(aliased), APIVersionV1alpha1); err == nil {
+		t.Error("Expected an error converting an alias to v1alpha1")
+	}
+	if _, err := ParseServiceList("apiVersion: servicekeel.io/v1alpha1\n" + testV1alpha1Services + "    alias: db\n"); err == nil {
+		t.Error("Expected an error reading an alias in v1alpha1")
+	}
+	// Service lists without apiVersion take the fields of v1alpha2
+	if list, err := ParseServiceList(testV1alpha1Services + "    alias: db\n"); err != nil || list.Services[0].Alias != "db" {
+		t.Errorf("Unversioned service list with an alias = %+v, %v; want alias db", list, err)
+	}
+
+	// Config files
+	migrated, err = MigrateDocument([]byte("dns:\n  addr: 127.0.0.2:53\n"), APIVersionV1alpha2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(migrated), "kind: SidecarConfig") || strings.Contains(string(migrated), "metrics") {
+		t.Errorf("Unexpected config document:\n%s", migrated)
+	}
+	if _, err := MigrateDocument([]byte("apiVersion: servicekeel.io/v1\n"), APIVersionV1alpha2); err == nil {
+		t.Error("Expected an error for an unsupported apiVersion")
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	list, err := ParseServiceList(`apiVersion: servicekeel.io/v1alpha2
+kind: ServiceList
+services:
+  - name: media
+    namespace: default
+    ports:
+      - name: rtp
+        port: 30000-30100
+        targetPort: 40000-40100
+        protocol: UDP
+      - name: rtcp
+        port: 30100
+        targetPort: 30100
+        protocol: UDP
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := list.Services[0].Ports[0]
+	if port.Port != 30000 || port.EndPort != 30100 || port.TargetPort != 40000 || port.TargetEndPort != 40100 {
+		t.Fatalf("Unexpected port: %+v", port)
+	}
+
+	// The range is too long and overlaps the next port
+	cfg := &Config{ImportedServices: list, Ports: PortsConfig{MaxRange: 100}}
+	validation := ValidateServices(cfg)
+	if len(validation.Errors) != 1 || !strings.Contains(validation.Errors[0].Message, "at most 100") {
+		t.Errorf("Unexpected errors: %v", validation.Errors)
+	}
+	cfg.Ports.MaxRange = 200
+	validation = ValidateServices(cfg)
+	if len(validation.Errors) != 1 || !strings.Contains(validation.Errors[0].Message, "duplicate port 30100/UDP") {
+		t.Errorf("Unexpected errors: %v", validation.Errors)
+	}
+
+	// Target ranges must be as long as the port range
+	cfg.ImportedServices.Services[0].Ports = []Port{{Name: "rtp", Port: 30000, EndPort: 30010,
+		TargetPort: 40000, TargetEndPort: 40005, Protocol: "UDP"}}
+	validation = ValidateServices(cfg)
+	if len(validation.Errors) != 1 || !strings.Contains(validation.Errors[0].Message, "has 6 ports") {
+		t.Errorf("Unexpected errors: %v", validation.Errors)
+	}
+
+	if _, err := MigrateDocument([]byte(`apiVersion: servicekeel.io/v1alpha2
+kind: ServiceList
+services:
+  - name: media
+    ports:
+      - {name: rtp, port: 30000-30001, targetPort: 30000-30001, protocol: UDP}
+`), APIVersionV1alpha1); err == nil {
+		t.Error("Expected an error converting a port range to v1alpha1")
+	}
+}
+
+func TestMappedIP(t *testing.T) {
+	list, err := ParseServiceList(`apiVersion: servicekeel.io/v1alpha2
+kind: ServiceList
+services:
+  - name: db
+    namespace: default
+    mappedIP: 127.0.66.10
+    ports:
+      - {name: mysql, port: 3306, targetPort: 3306, protocol: TCP}
+  - name: cache
+    namespace: default
+    mappedIP: 127.0.66.10
+    ports:
+      - {name: redis, port: 6379, targetPort: 6379, protocol: TCP}
+  - name: web
+    namespace: default
+    mappedIP: 10.0.0.1
+    ports:
+      - {name: http, port: 80, targetPort: 80, protocol: TCP}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := list.Services[0].MappedIP; got != "127.0.66.10" {
+		t.Fatalf("Unexpected mappedIP %q", got)
+	}
+
+	cfg := &Config{DNS: DNSConfig{IPRange: DefaultIPRange}, ImportedServices: list, Ports: PortsConfig{MaxRange: 100}}
+	validation := ValidateServices(cfg)
+	if len(validation.Errors) != 2 ||
+		!strings.Contains(validation.Errors[0].Message, "already used by services[0]") ||
+		!strings.Contains(validation.Errors[1].Message, "not within dns.ipRange") {
+		t.Errorf("Unexpected errors: %v", validation.Errors)
+	}
+
+	if _, err := MigrateDocument([]byte(`apiVersion: servicekeel.io/v1alpha2
+kind: ServiceList
+services:
+  - name: db
+    mappedIP: 127.0.66.10
+`), APIVersionV1alpha1); err == nil {
+		t.Error("Expected an error converting a mapped IP to v1alpha1")
+	}
+}
@@ -0,0 +1,413 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Names of the sources without a file
+const (
+	SourceDefaults   = "defaults"
+	SourceResolvConf = "resolv.conf"
+	SourceEnv        = "env"
+	SourceFlags      = "flags"
+)
+
+// setting is a value sources may set, env lists the environment variables
+// setting it, the first one set wins
+type setting struct {
+	key string
+	env []string
+	set func(c *Config, value string) error
+	get func(c *Config) string
+}
+
+var settings = []setting{
+	{"dns.addr", []string{"SIDECAR_DNS_ADDR"}, func(c *Config, v string) error {
+		c.DNS.Addr = v
+		return nil
+	}, func(c *Config) string { return c.DNS.Addr }},
+	{"dns.ipRange", []string{"SIDECAR_IP_RANGE", "SIDECAR_DNS_IPRANGE"}, func(c *Config, v string) error {
+		c.DNS.IPRange = v
+		return nil
+	}, func(c *Config) string { return c.DNS.IPRange }},
+	// METRICS_ADDR is still read for sidecars deployed before the SIDECAR_ prefix
+	{"metrics.addr", []string{"SIDECAR_METRICS_ADDR", "METRICS_ADDR"}, func(c *Config, v string) error {
+		c.Metrics.Addr = v
+		return nil
+	}, func(c *Config) string { return c.Metrics.Addr }},
+	{"pod.name", []string{"SIDECAR_POD_NAME"}, func(c *Config, v string) error {
+		c.Pod.Name = v
+		return nil
+	}, func(c *Config) string { return c.Pod.Name }},
+	{"pod.namespace", []string{"SIDECAR_POD_NAMESPACE"}, func(c *Config, v string) error {
+		c.Pod.Namespace = v
+		return nil
+	}, func(c *Config) string { return c.Pod.Namespace }},
+	{"pod.watch", []string{"SIDECAR_POD_WATCH"}, func(c *Config, v string) error {
+		watch, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		c.Pod.Watch = watch
+		return nil
+	}, func(c *Config) string { return strconv.FormatBool(c.Pod.Watch) }},
+	{"ports.maxRange", []string{"SIDECAR_MAX_PORT_RANGE"}, func(c *Config, v string) error {
+		maxRange, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if maxRange < 1 {
+			return fmt.Errorf("must be at least 1")
+		}
+		c.Ports.MaxRange = maxRange
+		return nil
+	}, func(c *Config) string { return strconv.Itoa(c.Ports.MaxRange) }},
+	{"state.dir", []string{"SIDECAR_STATE_DIR"}, func(c *Config, v string) error {
+		c.State.Dir = v
+		return nil
+	}, func(c *Config) string { return c.State.Dir }},
+}
+
+// Defaults of the settings, the sidecar, validate and render use the same
+const (
+	DefaultDNSAddr      = "127.0.0.2:53"
+	DefaultIPRange      = "127.0.66.0/24"
+	DefaultMetricsAddr  = ":1080"
+	DefaultMaxPortRange = 100
+	DefaultStateDir     = "/var/lib/servicekeel"
+)
+
+// Keys of the service lists and search domains in Provenance, services
+// are listed as e.g. "imported/backend.default.cluster-a"
+const (
+	keySearchDomains = "dns.searchDomains"
+	keyExported      = "exported"
+	keyImported      = "imported"
+)
+
+// Source is one layer of the configuration, only the settings it contains
+// are applied over the sources below it
+type Source struct {
+	Name string
+
+	values        map[string]string
+	searchDomains []string
+	exported      *ServiceList
+	imported      *ServiceList
+	// replaceServices makes the service lists of the source replace the
+	// lists of the sources below instead of being merged into them
+	replaceServices bool
+}
+
+// Provenance names the source that set each setting of a configuration
+type Provenance map[string]string
+
+// defaultSource holds the built-in defaults
+func defaultSource() *Source {
+	return &Source{
+		Name: SourceDefaults,
+		values: map[string]string{
+			"dns.addr":       DefaultDNSAddr,
+			"dns.ipRange":    DefaultIPRange,
+			"metrics.addr":   DefaultMetricsAddr,
+			"pod.name":       "",
+			"pod.namespace":  "",
+			"pod.watch":      "false",
+			"ports.maxRange": strconv.Itoa(DefaultMaxPortRange),
+			"state.dir":      DefaultStateDir,
+		},
+		searchDomains: []string{
+			"default.svc.cluster.local",
+			"svc.cluster.local",
+			"cluster.local",
+		},
+		exported: &ServiceList{},
+		imported: &ServiceList{},
+	}
+}
+
+// envSource reads the SIDECAR_ environment variables
+func envSource() *Source {
+	s := &Source{Name: SourceEnv, values: make(map[string]string)}
+	for _, f := range settings {
+		for _, env := range f.env {
+			if value, ok := os.LookupEnv(env); ok {
+				s.values[f.key] = value
+				break
+			}
+		}
+	}
+	return s
+}
+
+// flagSource holds the settings given on the command line
+func flagSource(flags map[string]string) *Source {
+	s := &Source{Name: SourceFlags, values: make(map[string]string)}
+	for key, value := range flags {
+		s.values[key] = value
+	}
+	return s
+}
+
+// fileSource reads an extra config file
+func fileSource(path string) (*Source, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if filepath.Ext(path) == "" {
+		v.SetConfigType("yaml")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read configuration file %s: %v", path, err)
+	}
+	s, err := readSidecarConfig(v, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// servicesSource reads an exported or imported services file of the config
+// directory, name is the file name without extension
+func servicesSource(dir, name, key string) (*Source, error) {
+	v := viper.New()
+	v.SetConfigName(name)
+	addConfigPaths(v, dir)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	services, err := readServiceList(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", v.ConfigFileUsed(), err)
+	}
+	services.file = v.ConfigFileUsed()
+	s := &Source{Name: services.file}
+	if key == keyExported {
+		s.exported = &services
+	} else {
+		s.imported = &services
+	}
+	return s, nil
+}
+
+// Merge applies sources in order, later sources take precedence. Settings
+// are replaced as a whole. Services in files are merged by
+// name.namespace.cluster: a service of a later file replaces the service
+// with the same key, other services are appended, services without a
+// namespace are keyed on the namespace of the Pod. Sources replacing
+// services, i.e. the Pod annotations, replace the lists as a whole.
+// Namespaces are defaulted and the services validated.
+func Merge(sources []*Source) (*Config, Provenance, *Validation) {
+	cfg := &Config{}
+	provenance := make(Provenance)
+	validation := &Validation{}
+	for _, s := range sources {
+		for _, f := range settings {
+			value, ok := s.values[f.key]
+			if !ok {
+				continue
+			}
+			if err := f.set(cfg, value); err != nil {
+				validation.errorf(s.Name, "invalid %s %q: %v", f.key, value, err)
+				continue
+			}
+			provenance[f.key] = s.Name
+		}
+		if s.searchDomains != nil {
+			cfg.DNS.SearchDomains = s.searchDomains
+			provenance[keySearchDomains] = s.Name
+		}
+	}
+	// the Pod namespace of all sources is known before services are keyed
+	for _, s := range sources {
+		mergeServices(&cfg.ExportedServices, s.exported, s, keyExported, cfg.Pod.Namespace, provenance)
+		mergeServices(&cfg.ImportedServices, s.imported, s, keyImported, cfg.Pod.Namespace, provenance)
+	}
+
+	DefaultNamespaces(cfg)
+	services := ValidateServices(cfg)
+	validation.Errors = append(validation.Errors, services.Errors...)
+	validation.Warnings = append(validation.Warnings, services.Warnings...)
+	return cfg, provenance, validation
+}
+
+// mergeServices merges the services of source s into list, services without
+// a namespace are keyed on namespace
+func mergeServices(list, services *ServiceList, s *Source, key, namespace string, provenance Provenance) {
+	if services == nil {
+		return
+	}
+	if s.replaceServices {
+		for k := range provenance {
+			if len(k) > len(key) && k[:len(key)+1] == key+"/" {
+				delete(provenance, k)
+			}
+		}
+		*list = ServiceList{}
+	}
+	if services.file != "" {
+		list.file = services.file
+	}
+
+	index := make(map[string]int)
+	for i, svc := range list.Services {
+		index[serviceKey(svc, namespace)] = i
+	}
+	for _, svc := range services.Services {
+		k := serviceKey(svc, namespace)
+		if i, ok := index[k]; ok {
+			list.Services[i] = svc
+		} else {
+			index[k] = len(list.Services)
+			list.Services = append(list.Services, svc)
+		}
+		provenance[key+"/"+k] = s.Name
+	}
+}
+
+// serviceKey identifies a service across sources, namespace is used for
+// services without one
+func serviceKey(svc ServiceConfig, namespace string) string {
+	if svc.Namespace != "" {
+		namespace = svc.Namespace
+	}
+	return fmt.Sprintf("%s.%s.%s", svc.Name, namespace, svc.Cluster)
+}
+
+// Loader reads the configuration sources, from lowest to highest
+// precedence: the built-in defaults, the search domains of resolv.conf, the
+// config directory (config.yaml, exported-services-config.yaml and
+// imported-services-config.yaml), the extra config files in order, the
+// SIDECAR_ environment variables and the command line flags. The service
+// annotations of the Pod, when watched, are applied over all of them.
+type Loader struct {
+	// Dir is the config directory, empty searches /etc/servicekeel, config
+	// and the working directory
+	Dir string
+	// Files are extra config files, they may hold any setting as well as
+	// exported and imported service lists
+	Files []string
+	// Flags are the settings given on the command line by key, e.g. "dns.addr"
+	Flags map[string]string
+}
+
+// Sources reads the sources of the configuration. Missing files of the
+// config directory are reported as warnings, invalid files and extra
+// config files that cannot be read as errors.
+func (l *Loader) Sources() ([]*Source, *Validation) {
+	validation := &Validation{}
+	sources := []*Source{defaultSource()}
+
+	if domains, err := parseResolvConf(); err != nil {
+		validation.warnf(SourceResolvConf, "%v, using the default search domains", err)
+	} else if len(domains) > 0 {
+		sources = append(sources, &Source{Name: SourceResolvConf, searchDomains: domains})
+	}
+
+	v := viper.New()
+	v.SetConfigName("config")
+	addConfigPaths(v, l.Dir)
+	v.SetConfigType("yaml")
+	var notFound viper.ConfigFileNotFoundError
+	if err := v.ReadInConfig(); errors.As(err, &notFound) {
+		validation.warnf("config", "%v, using defaults", err)
+	} else if err != nil {
+		validation.errorf("config", "failed to read main configuration file: %v", err)
+	} else if s, err := readSidecarConfig(v, v.ConfigFileUsed()); err != nil {
+		validation.errorf(v.ConfigFileUsed(), "failed to parse main configuration file: %v", err)
+	} else {
+		sources = append(sources, s)
+	}
+	for _, file := range []struct{ name, key string }{
+		{"exported-services-config", keyExported},
+		{"imported-services-config", keyImported},
+	} {
+		s, err := servicesSource(l.Dir, file.name, file.key)
+		if errors.As(err, &notFound) {
+			validation.warnf(file.name, "%v, no services %s", err, file.key)
+			continue
+		} else if err != nil {
+			validation.errorf(file.name, "%v", err)
+			continue
+		}
+		sources = append(sources, s)
+	}
+
+	for _, path := range l.Files {
+		s, err := fileSource(path)
+		if err != nil {
+			validation.errorf(path, "%v", err)
+			continue
+		}
+		sources = append(sources, s)
+	}
+
+	return append(sources, envSource(), flagSource(l.Flags)), validation
+}
+
+// Load reads and merges the sources of the configuration
+func (l *Loader) Load() (*Config, Provenance, *Validation) {
+	sources, validation := l.Sources()
+	cfg, provenance, merged := Merge(sources)
+	validation.Errors = append(validation.Errors, merged.Errors...)
+	validation.Warnings = append(validation.Warnings, merged.Warnings...)
+	return cfg, provenance, validation
+}
+
+// Resolved lists every setting of cfg with its value and the source that
+// set it, e.g. "dns.addr=127.0.0.2:53 (defaults)"
+func Resolved(cfg *Config, provenance Provenance) []string {
+	resolved := make([]string, 0, len(settings)+1)
+	for _, f := range settings {
+		resolved = append(resolved, fmt.Sprintf("%s=%s (%s)", f.key, f.get(cfg), provenance[f.key]))
+	}
+	return append(resolved, fmt.Sprintf("%s=%s (%s)", keySearchDomains,
+		strings.Join(cfg.DNS.SearchDomains, ","), provenance[keySearchDomains]))
+}
+
+// DefaultConfig returns the built-in defaults without services
+func DefaultConfig() *Config {
+	cfg, _, _ := Merge([]*Source{defaultSource()})
+	return cfg
+}
+
+// Effective holds the configuration in effect and serves it together with
+// the source of every setting
+type Effective struct {
+	mu         sync.RWMutex
+	config     *Config
+	provenance Provenance
+}
+
+// Set replaces the configuration in effect
+func (e *Effective) Set(cfg *Config, provenance Provenance) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.config = cfg
+	e.provenance = provenance
+}
+
+// ServeHTTP writes the configuration in effect as JSON
+func (e *Effective) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.config == nil {
+		http.Error(w, "configuration not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Config  *Config    `json:"config"`
+		Sources Provenance `json:"sources"`
+	}{e.config, e.provenance})
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	file := func(name string, services ...ServiceConfig) *Source {
+		return &Source{Name: name, imported: &ServiceList{Services: services, file: name}}
+	}
+	backend := ServiceConfig{Name: "backend", Namespace: "web", Cluster: "cluster-a",
+		Ports: []Port{{Name: "http", Port: 80, TargetPort: 8080, Protocol: "TCP"}}}
+	override := backend
+	override.Alias = "backend.local"
+	api := ServiceConfig{Name: "api", Namespace: "web",
+		Ports: []Port{{Name: "grpc", Port: 9000, TargetPort: 9000, Protocol: "TCP"}}}
+
+	sources := []*Source{
+		defaultSource(),
+		file("dir", backend),
+		file("extra", override, api),
+		{Name: SourceEnv, values: map[string]string{"dns.addr": "127.0.0.3:53"}},
+		{Name: SourceFlags, values: map[string]string{"dns.addr": "127.0.0.4:53"}},
+	}
+	cfg, provenance, validation := Merge(sources)
+	if err := validation.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DNS.Addr != "127.0.0.4:53" || provenance["dns.addr"] != SourceFlags {
+		t.Errorf("dns.addr = %q from %q; want the flag", cfg.DNS.Addr, provenance["dns.addr"])
+	}
+	if cfg.DNS.IPRange != DefaultIPRange || provenance["dns.ipRange"] != SourceDefaults {
+		t.Errorf("dns.ipRange = %q from %q; want the default", cfg.DNS.IPRange, provenance["dns.ipRange"])
+	}
+
+	// Services with the same name, namespace and cluster are replaced, others appended
+	got := cfg.ImportedServices.Services
+	if len(got) != 2 || got[0].Alias != "backend.local" || got[1].Name != "api" {
+		t.Fatalf("Unexpected imported services: %+v", got)
+	}
+	if source := provenance["imported/backend.web.cluster-a"]; source != "extra" {
+		t.Errorf("backend set by %q; want extra", source)
+	}
+
+	// Sources replacing services drop the lists below
+	pod := file("pod", api)
+	pod.replaceServices = true
+	cfg, provenance, _ = Merge(append(sources, pod))
+	if got := cfg.ImportedServices.Services; len(got) != 1 || got[0].Name != "api" {
+		t.Fatalf("Unexpected imported services: %+v", got)
+	}
+	if _, ok := provenance["imported/backend.web.cluster-a"]; ok {
+		t.Error("Replaced service still listed in the sources")
+	}
+
+	// Services without a namespace replace the ones in the namespace of the Pod
+	unqualified := backend
+	unqualified.Namespace = ""
+	unqualified.Alias = "backend.pod"
+	cfg, provenance, validation = Merge(append(sources, file("pod-file", unqualified),
+		&Source{Name: SourceFlags, values: map[string]string{"pod.namespace": "web"}}))
+	if err := validation.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.ImportedServices.Services; len(got) != 2 || got[0].Alias != "backend.pod" || got[0].Namespace != "web" {
+		t.Fatalf("Unexpected imported services: %+v", got)
+	}
+	if source := provenance["imported/backend.web.cluster-a"]; source != "pod-file" {
+		t.Errorf("backend set by %q; want pod-file", source)
+	}
+
+	// Invalid values are reported with their source
+	_, _, validation = Merge([]*Source{{Name: SourceEnv, values: map[string]string{"pod.watch": "maybe"}}})
+	if len(validation.Errors) != 1 || validation.Errors[0].Path != SourceEnv {
+		t.Errorf("Unexpected errors: %v", validation.Errors)
+	}
+}
+
+func TestEnvSource(t *testing.T) {
+	t.Setenv("METRICS_ADDR", ":1081")
+	t.Setenv("SIDECAR_IP_RANGE", "127.0.77.0/24")
+	cfg, provenance, _ := Merge([]*Source{defaultSource(), envSource()})
+	if cfg.Metrics.Addr != ":1081" || cfg.DNS.IPRange != "127.0.77.0/24" {
+		t.Errorf("Unexpected settings from env: %+v, %+v", cfg.Metrics, cfg.DNS)
+	}
+
+	// The SIDECAR_ variable wins over the old name
+	t.Setenv("SIDECAR_METRICS_ADDR", ":9090")
+	cfg, provenance, _ = Merge([]*Source{defaultSource(), envSource()})
+	if cfg.Metrics.Addr != ":9090" || provenance["metrics.addr"] != SourceEnv {
+		t.Errorf("metrics.addr = %q from %q; want :9090 from env", cfg.Metrics.Addr, provenance["metrics.addr"])
+	}
+	resolved := Resolved(cfg, provenance)
+	if resolved[0] != "dns.addr="+DefaultDNSAddr+" (defaults)" {
+		t.Errorf("Unexpected resolved setting %q", resolved[0])
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lastKnownGoodFile holds the last configuration applied successfully in
+// the state directory
+const lastKnownGoodFile = "last-known-good.json"
+
+var (
+	configFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servicekeel_config_failures_total",
+		Help: "Number of new configurations that failed to load or validate",
+	})
+	configLastKnownGood = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "servicekeel_config_last_known_good",
+		Help: "1 while an older configuration is in effect because the newest one failed",
+	})
+	configLastApplied = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "servicekeel_config_last_applied_timestamp_seconds",
+		Help: "Time the configuration in effect was applied",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configFailures, configLastKnownGood, configLastApplied)
+}
+
+// snapshot is the stored last-known-good configuration
+type snapshot struct {
+	Saved   time.Time  `json:"saved"`
+	Config  *Config    `json:"config"`
+	Sources Provenance `json:"sources"`
+}
+
+// State keeps the last-known-good configuration in the state directory, so
+// that a sidecar restarted with a broken configuration keeps serving the
+// previous one, and tracks whether the newest configuration is in effect.
+type State struct {
+	dir string
+
+	mu sync.RWMutex
+	// err is why the newest configuration is not in effect
+	err error
+	// since is when the configuration in effect was applied
+	since time.Time
+}
+
+// NewState creates the state kept in dir, empty keeps nothing on disk
+func NewState(dir string) *State {
+	return &State{dir: dir}
+}
+
+// Save stores the configuration just applied as last-known-good
+func (s *State) Save(cfg *Config, provenance Provenance) error {
+	now := time.Now()
+	s.mu.Lock()
+	s.err = nil
+	s.since = now
+	s.mu.Unlock()
+	configLastKnownGood.Set(0)
+	configLastApplied.Set(float64(now.Unix()))
+
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(snapshot{Saved: now, Config: cfg, Sources: provenance}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	// replace the file at once, a crash never leaves half a configuration
+	tmp, err := os.CreateTemp(s.dir, lastKnownGoodFile+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save last-known-good configuration: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save last-known-good configuration: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save last-known-good configuration: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, lastKnownGoodFile)); err != nil {
+		return fmt.Errorf("failed to save last-known-good configuration: %v", err)
+	}
+	return nil
+}
+
+// Failed records that a new configuration could not be used, the one in
+// effect stays
+func (s *State) Failed(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	configFailures.Inc()
+	configLastKnownGood.Set(1)
+}
+
+// Fallback replaces the services of cfg, which failed with cause, by the
+// ones of the last-known-good configuration and records the failure. The
+// settings of cfg are kept.
+func (s *State) Fallback(cfg *Config, provenance Provenance, cause error) error {
+	if s.dir == "" {
+		return fmt.Errorf("%v (no state directory for a last-known-good configuration)", cause)
+	}
+	path := filepath.Join(s.dir, lastKnownGoodFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%v (no last-known-good configuration: %v)", cause, err)
+	}
+	var saved snapshot
+	if err := json.Unmarshal(data, &saved); err != nil || saved.Config == nil {
+		return fmt.Errorf("%v (invalid last-known-good configuration %s: %v)", cause, path, err)
+	}
+
+	cfg.ExportedServices = saved.Config.ExportedServices
+	cfg.ImportedServices = saved.Config.ImportedServices
+	for k := range provenance {
+		if strings.HasPrefix(k, keyExported+"/") || strings.HasPrefix(k, keyImported+"/") {
+			delete(provenance, k)
+		}
+	}
+	for k, source := range saved.Sources {
+		if strings.HasPrefix(k, keyExported+"/") || strings.HasPrefix(k, keyImported+"/") {
+			provenance[k] = source
+		}
+	}
+
+	s.Failed(cause)
+	s.mu.Lock()
+	s.since = saved.Saved
+	s.mu.Unlock()
+	configLastApplied.Set(float64(saved.Saved.Unix()))
+	return nil
+}
+
+// ServeHTTP reports whether the newest configuration is in effect. The
+// status is always 200, the sidecar keeps working on the last-known-good
+// configuration and must not be restarted by a liveness probe.
+func (s *State) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status := struct {
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+		// Since is when the configuration in effect was applied
+		Since *time.Time `json:"since,omitempty"`
+	}{Status: "ok"}
+	if s.err != nil {
+		status.Status = "degraded"
+		status.Error = s.err.Error()
+	}
+	if !s.since.IsZero() {
+		status.Since = &s.since
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
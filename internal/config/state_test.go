@@ -0,0 +1,64 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStateFallback(t *testing.T) {
+	state := NewState(t.TempDir())
+	cause := errors.New("invalid annotation")
+	if err := state.Fallback(DefaultConfig(), Provenance{}, cause); err == nil {
+		t.Fatal("Expected an error without a last-known-good configuration")
+	}
+
+	cfg := DefaultConfig()
+	cfg.ImportedServices.Services = []ServiceConfig{{Name: "backend", Namespace: "web",
+		Ports: []Port{{Name: "http", Port: 80, TargetPort: 8080, Protocol: "TCP"}}}}
+	if err := state.Save(cfg, Provenance{"imported/backend.web.": "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if status := health(t, state); status["status"] != "ok" {
+		t.Errorf("Unexpected health: %v", status)
+	}
+
+	// A restarted sidecar falls back to the saved services and keeps its
+	// current settings
+	restarted := NewState(state.dir)
+	current := DefaultConfig()
+	current.DNS.IPRange = "127.0.77.0/24"
+	current.ImportedServices.Services = []ServiceConfig{{Name: "Broken"}}
+	provenance := Provenance{"dns.ipRange": SourceFlags, "imported/Broken..": "pod"}
+	if err := restarted.Fallback(current, provenance, cause); err != nil {
+		t.Fatal(err)
+	}
+	if got := current.ImportedServices.Services; len(got) != 1 || got[0].Ports[0].TargetPort != 8080 {
+		t.Errorf("Unexpected services: %+v", got)
+	}
+	if current.DNS.IPRange != "127.0.77.0/24" {
+		t.Errorf("IP range = %q; want the current one", current.DNS.IPRange)
+	}
+	if provenance["imported/backend.web."] != "test" || provenance["dns.ipRange"] != SourceFlags || len(provenance) != 2 {
+		t.Errorf("Unexpected sources: %v", provenance)
+	}
+	if status := health(t, restarted); status["status"] != "degraded" || status["error"] != cause.Error() {
+		t.Errorf("Unexpected health: %v", status)
+	}
+}
+
+// health returns the status served by state
+func health(t *testing.T, state *State) map[string]interface{} {
+	t.Helper()
+	w := httptest.NewRecorder()
+	state.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 {
+		t.Fatalf("Health status = %d; want 200", w.Code)
+	}
+	var status map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
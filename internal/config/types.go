@@ -9,29 +9,52 @@ import (
 
 // ServiceConfig represents the configuration for a service
 type ServiceConfig struct {
-	Name      string `json:"name"`
+	Name string `json:"name"`
+	// Namespace defaults to the namespace of the sidecar Pod
 	Namespace string `json:"namespace"`
-	Cluster   string `json:"cluster"`
-	Ports     []Port `json:"ports"`
+	// Cluster may be left empty, the service is then named
+	// name.namespace.svc. An import without a cluster only reaches exports
+	// without a cluster, not the same service exported with one
+	Cluster string `json:"cluster"`
+	// Alias is an additional DNS name of an imported service
+	Alias string `json:"alias"`
+	// MappedIP pins an imported service to an IP of dns.ipRange instead of
+	// the next unused one
+	MappedIP string `json:"mappedIP,omitempty"`
+	Ports    []Port `json:"ports"`
 }
 
 // Port represents a service port configuration
 type Port struct {
-	Name       string `json:"name"`
-	Port       int    `json:"port"`
-	TargetPort int    `json:"targetPort"`
-	Protocol   string `json:"protocol"`
+	Name string `json:"name"`
+	Port int    `json:"port"`
+	// EndPort makes the port the range Port-EndPort, the controller creates
+	// an endpoint named <name>-<port> for every port of the range
+	EndPort    int `json:"endPort,omitempty"`
+	TargetPort int `json:"targetPort"`
+	// TargetEndPort ends the range of target ports, which must be as long as
+	// the range of ports
+	TargetEndPort int    `json:"targetEndPort,omitempty"`
+	Protocol      string `json:"protocol"`
+	// ProxyProtocol prepends a PROXY protocol header ("v1" or "v2") carrying
+	// the visitor address to connections toward an exported port, empty disables it
+	ProxyProtocol string `json:"proxyProtocol"`
 }
 
 // ServiceList represents the list of services in the configuration
 type ServiceList struct {
 	Services []ServiceConfig `json:"services"`
+	// file is the configuration file the list was read from
+	file string
 }
 
 // Config represents the complete configuration
 type Config struct {
 	DNS              DNSConfig     `json:"dns"`
 	Metrics          MetricsConfig `json:"metrics"`
+	Pod              PodConfig     `json:"pod"`
+	Ports            PortsConfig   `json:"ports"`
+	State            StateConfig   `json:"state"`
 	ExportedServices ServiceList   `json:"exported"`
 	ImportedServices ServiceList   `json:"imported"`
 }
@@ -54,3 +77,27 @@ type DNSConfig struct {
 type MetricsConfig struct {
 	Addr string `json:"addr"`
 }
+
+// PodConfig describes the Pod the sidecar runs in, usually set from the
+// downward API through SIDECAR_POD_NAME and SIDECAR_POD_NAMESPACE
+type PodConfig struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Watch reads the service annotations of the Pod through the Kubernetes
+	// API and applies their changes at once (env: SIDECAR_POD_WATCH)
+	Watch bool `json:"watch"`
+}
+
+// PortsConfig limits the expansion of port ranges
+type PortsConfig struct {
+	// MaxRange is the largest number of ports a range may hold (env:
+	// SIDECAR_MAX_PORT_RANGE), every port takes an frpc process
+	MaxRange int `json:"maxRange"`
+}
+
+// StateConfig configures what the sidecar keeps across restarts
+type StateConfig struct {
+	// Dir holds the last-known-good configuration (env: SIDECAR_STATE_DIR),
+	// empty keeps nothing
+	Dir string `json:"dir"`
+}
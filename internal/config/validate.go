@@ -0,0 +1,256 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Issue is a problem found at a location of the configuration, e.g.
+// "imported-services-config.yaml: services[0] (web): ports[1] (http)"
+type Issue struct {
+	Path    string
+	Message string
+}
+
+func (i Issue) String() string {
+	return i.Path + ": " + i.Message
+}
+
+// Validation collects all problems of a configuration. Errors make the
+// configuration unusable, warnings are logged and the configuration is used.
+type Validation struct {
+	Errors   []Issue
+	Warnings []Issue
+}
+
+func (v *Validation) errorf(path, format string, args ...interface{}) {
+	v.Errors = append(v.Errors, Issue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *Validation) warnf(path, format string, args ...interface{}) {
+	v.Warnings = append(v.Warnings, Issue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Err returns all errors as one, or nil if there are none
+func (v *Validation) Err() error {
+	switch len(v.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s", v.Errors[0])
+	}
+	msgs := make([]string, len(v.Errors))
+	for i, issue := range v.Errors {
+		msgs[i] = issue.String()
+	}
+	return fmt.Errorf("%d errors:\n  %s", len(msgs), strings.Join(msgs, "\n  "))
+}
+
+// ValidateServices checks the exported and imported services of config
+func ValidateServices(config *Config) *Validation {
+	v := &Validation{}
+	maxRange := config.Ports.MaxRange
+	exported := validateServices(v, listPath(config.ExportedServices, "exported"), config.ExportedServices, true, maxRange)
+	imported := validateServices(v, listPath(config.ImportedServices, "imported"), config.ImportedServices, false, maxRange)
+	for key, path := range imported {
+		if exportedPath, ok := exported[key]; ok {
+			v.warnf(path, "service %s is also exported at %s", key, exportedPath)
+		}
+	}
+	validateAliases(v, listPath(config.ImportedServices, "imported"), config.ImportedServices)
+	validateMappedIPs(v, listPath(config.ImportedServices, "imported"), config.ImportedServices, config.DNS.IPRange)
+	return v
+}
+
+// listPath names a service list by the file it was read from
+func listPath(services ServiceList, name string) string {
+	if services.file != "" {
+		return services.file
+	}
+	return name
+}
+
+// validateServices checks a service list and returns the path of every
+// service by its name.namespace.cluster key
+func validateServices(v *Validation, file string, services ServiceList, exported bool, maxRange int) map[string]string {
+	seen := make(map[string]string)
+	for i, svc := range services.Services {
+		path := fmt.Sprintf("%s: services[%d]", file, i)
+		if svc.Name != "" {
+			path += fmt.Sprintf(" (%s)", svc.Name)
+		}
+
+		checkName(v, path, "service name", svc.Name, validation.IsDNS1123Label)
+		if svc.Namespace == "" {
+			v.errorf(path, "namespace cannot be empty, set it or the Pod namespace (SIDECAR_POD_NAMESPACE)")
+		} else {
+			checkName(v, path, "namespace", svc.Namespace, validation.IsDNS1123Label)
+		}
+		// an empty cluster matches any cluster
+		if svc.Cluster != "" {
+			checkName(v, path, "cluster", svc.Cluster, validation.IsDNS1123Subdomain)
+		}
+		if svc.Alias != "" && exported {
+			v.warnf(path, "alias %s is only used for imported services and is ignored", svc.Alias)
+		}
+		if svc.MappedIP != "" && exported {
+			v.warnf(path, "mappedIP %s is only used for imported services and is ignored", svc.MappedIP)
+		}
+		key := fmt.Sprintf("%s.%s.%s", svc.Name, svc.Namespace, svc.Cluster)
+		if first, ok := seen[key]; ok {
+			v.errorf(path, "duplicate service %s, first defined at %s", key, first)
+		} else {
+			seen[key] = path
+		}
+
+		if len(svc.Ports) == 0 {
+			v.warnf(path, "service has no ports")
+		}
+		names := make(map[string]int)
+		ports := make(map[string]int)
+		for j, port := range svc.Ports {
+			portPath := fmt.Sprintf("%s: ports[%d]", path, j)
+			if port.Name != "" {
+				portPath += fmt.Sprintf(" (%s)", port.Name)
+			}
+			validatePort(v, portPath, port, exported, maxRange)
+
+			if first, ok := names[port.Name]; ok && port.Name != "" {
+				v.errorf(portPath, "duplicate port name %s, first used by ports[%d]", port.Name, first)
+			} else {
+				names[port.Name] = j
+			}
+			end := port.EndPort
+			if end < port.Port || end-port.Port >= maxRange {
+				end = port.Port
+			}
+			for number := port.Port; number <= end; number++ {
+				key := fmt.Sprintf("%d/%s", number, port.Protocol)
+				if first, ok := ports[key]; ok {
+					v.errorf(portPath, "duplicate port %s, first used by ports[%d]", key, first)
+					break
+				}
+				ports[key] = j
+			}
+		}
+	}
+	return seen
+}
+
+// validateAliases checks that aliases of imported services are DNS names
+// used by no other service
+func validateAliases(v *Validation, file string, services ServiceList) {
+	names := make(map[string]string)
+	for i, svc := range services.Services {
+		names[fmt.Sprintf("%s.%s.svc", svc.Name, svc.Namespace)] = fmt.Sprintf("services[%d]", i)
+	}
+	for i, svc := range services.Services {
+		if svc.Alias == "" {
+			continue
+		}
+		path := fmt.Sprintf("%s: services[%d] (%s)", file, i, svc.Name)
+		checkName(v, path, "alias", svc.Alias, validation.IsDNS1123Subdomain)
+		if first, ok := names[svc.Alias]; ok {
+			v.errorf(path, "alias %s is already used by %s", svc.Alias, first)
+		} else {
+			names[svc.Alias] = fmt.Sprintf("services[%d]", i)
+		}
+	}
+}
+
+// validateMappedIPs checks that the mapped IPs of imported services lie
+// within ipRange and are pinned to no other service
+func validateMappedIPs(v *Validation, file string, services ServiceList, ipRange string) {
+	_, ipNet, rangeErr := net.ParseCIDR(ipRange)
+	ips := make(map[string]string)
+	for i, svc := range services.Services {
+		if svc.MappedIP == "" {
+			continue
+		}
+		path := fmt.Sprintf("%s: services[%d] (%s)", file, i, svc.Name)
+		ip := net.ParseIP(svc.MappedIP).To4()
+		if ip == nil {
+			v.errorf(path, "invalid mappedIP %q, must be an IPv4 address", svc.MappedIP)
+			continue
+		}
+		if rangeErr != nil {
+			v.errorf(path, "mappedIP %s needs a valid dns.ipRange: %v", ip, rangeErr)
+		} else if !ipNet.Contains(ip) {
+			v.errorf(path, "mappedIP %s is not within dns.ipRange %s", ip, ipRange)
+		}
+		if first, ok := ips[ip.String()]; ok {
+			v.errorf(path, "mappedIP %s is already used by %s", ip, first)
+		} else {
+			ips[ip.String()] = fmt.Sprintf("services[%d]", i)
+		}
+	}
+}
+
+// validatePort checks a single service port
+func validatePort(v *Validation, path string, port Port, exported bool, maxRange int) {
+	checkName(v, path, "port name", port.Name, validation.IsDNS1123Label)
+	if port.Port <= 0 || port.Port > 65535 {
+		v.errorf(path, "invalid port number: %d", port.Port)
+	}
+	if port.TargetPort <= 0 || port.TargetPort > 65535 {
+		v.errorf(path, "invalid target port number: %d", port.TargetPort)
+	}
+	validatePortRange(v, path, port, maxRange)
+	if port.Protocol != "TCP" && port.Protocol != "UDP" {
+		v.errorf(path, "invalid protocol type: %q, expected TCP or UDP", port.Protocol)
+	}
+	if port.ProxyProtocol != "" && port.ProxyProtocol != "v1" && port.ProxyProtocol != "v2" {
+		v.errorf(path, "invalid PROXY protocol version: %s", port.ProxyProtocol)
+	}
+	if port.ProxyProtocol != "" && port.Protocol != "TCP" {
+		v.errorf(path, "PROXY protocol requires a TCP port")
+	}
+	if port.ProxyProtocol != "" && !exported {
+		v.warnf(path, "PROXY protocol is only sent to exported services and is ignored")
+	}
+}
+
+// validatePortRange checks the ranges of a port, the target range must be
+// as long as the port range
+func validatePortRange(v *Validation, path string, port Port, maxRange int) {
+	if port.EndPort == 0 {
+		if port.TargetEndPort != 0 {
+			v.errorf(path, "target port range %d-%d needs a port range", port.TargetPort, port.TargetEndPort)
+		}
+		return
+	}
+	size := port.EndPort - port.Port + 1
+	switch {
+	case port.EndPort <= port.Port || port.EndPort > 65535:
+		v.errorf(path, "invalid port range: %d-%d", port.Port, port.EndPort)
+		return
+	case size > maxRange:
+		v.errorf(path, "port range %d-%d has %d ports, at most %d are allowed (ports.maxRange)", port.Port, port.EndPort, size, maxRange)
+	}
+	if port.TargetEndPort == 0 {
+		v.errorf(path, "port range %d-%d needs a target port range of the same length", port.Port, port.EndPort)
+	} else if port.TargetEndPort <= port.TargetPort || port.TargetEndPort > 65535 {
+		v.errorf(path, "invalid target port range: %d-%d", port.TargetPort, port.TargetEndPort)
+	} else if targets := port.TargetEndPort - port.TargetPort + 1; targets != size {
+		v.errorf(path, "target port range %d-%d has %d ports, port range %d-%d has %d",
+			port.TargetPort, port.TargetEndPort, targets, port.Port, port.EndPort, size)
+	}
+	// the endpoints of the range are named <name>-<port>
+	if port.Name != "" {
+		checkName(v, path, "port name", fmt.Sprintf("%s-%d", port.Name, port.EndPort), validation.IsDNS1123Label)
+	}
+}
+
+// checkName reports an empty name or one failing the RFC 1123 check
+func checkName(v *Validation, path, what, name string, check func(string) []string) {
+	if name == "" {
+		v.errorf(path, "%s cannot be empty", what)
+		return
+	}
+	for _, msg := range check(name) {
+		v.errorf(path, "invalid %s %q: %s", what, name, msg)
+	}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateServices(t *testing.T) {
+	cfg := &Config{
+		Ports: PortsConfig{MaxRange: DefaultMaxPortRange},
+		ExportedServices: ServiceList{file: "exported-services-config.yaml", Services: []ServiceConfig{
+			{Name: "web", Namespace: "default", Ports: []Port{{Name: "http", Port: 80, TargetPort: 8080, Protocol: "TCP"}}},
+		}},
+		ImportedServices: ServiceList{file: "imported-services-config.yaml", Services: []ServiceConfig{
+			{Name: "web", Namespace: "default", Ports: []Port{{Name: "http", Port: 80, TargetPort: 80, Protocol: "TCP"}}},
+			{Name: "Bad_Name", Namespace: "default", Ports: []Port{
+				{Name: "http", Port: 0, TargetPort: 80, Protocol: "SCTP"},
+				{Name: "http", Port: 81, TargetPort: 81, Protocol: "TCP"},
+			}},
+			{Name: "db", Namespace: "default", Ports: []Port{
+				{Name: "mysql", Port: 3306, TargetPort: 3306, Protocol: "TCP"},
+				{Name: "mysql-admin", Port: 3306, TargetPort: 33062, Protocol: "TCP"},
+			}},
+			{Name: "db", Namespace: "default", Ports: []Port{{Name: "mysql", Port: 3306, TargetPort: 3306, Protocol: "TCP"}}},
+		}},
+	}
+
+	validation := ValidateServices(cfg)
+
+	// All problems are reported at once, at the service and port they concern
+	want := []Issue{
+		{"imported-services-config.yaml: services[1] (Bad_Name)", `invalid service name "Bad_Name"`},
+		{"imported-services-config.yaml: services[1] (Bad_Name): ports[0] (http)", "invalid port number: 0"},
+		{"imported-services-config.yaml: services[1] (Bad_Name): ports[0] (http)", `invalid protocol type: "SCTP"`},
+		{"imported-services-config.yaml: services[1] (Bad_Name): ports[1] (http)", "duplicate port name http, first used by ports[0]"},
+		{"imported-services-config.yaml: services[2] (db): ports[1] (mysql-admin)", "duplicate port 3306/TCP, first used by ports[0]"},
+		{"imported-services-config.yaml: services[3] (db)", "duplicate service db.default., first defined at imported-services-config.yaml: services[2] (db)"},
+	}
+	if len(validation.Errors) != len(want) {
+		t.Fatalf("Got %d errors, want %d:\n%v", len(validation.Errors), len(want), validation.Err())
+	}
+	for i, issue := range validation.Errors {
+		if issue.Path != want[i].Path || !strings.HasPrefix(issue.Message, want[i].Message) {
+			t.Errorf("Error %d = %q; want %q at %s", i, issue, want[i].Message, want[i].Path)
+		}
+	}
+	if err := validation.Err(); err == nil || !strings.HasPrefix(err.Error(), "6 errors:") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// A service both exported and imported is a warning only
+	if len(validation.Warnings) != 1 {
+		t.Fatalf("Unexpected warnings: %v", validation.Warnings)
+	}
+	warning := validation.Warnings[0]
+	if warning.Path != "imported-services-config.yaml: services[0] (web)" ||
+		warning.Message != "service web.default. is also exported at exported-services-config.yaml: services[0] (web)" {
+		t.Errorf("Unexpected warning: %s", warning)
+	}
+}
+
+func TestValidateServicesNamespace(t *testing.T) {
+	cfg := &Config{ImportedServices: ServiceList{Services: []ServiceConfig{
+		{Name: "web", Ports: []Port{{Name: "http", Port: 80, TargetPort: 80, Protocol: "TCP"}}},
+	}}}
+	validation := ValidateServices(cfg)
+	if len(validation.Errors) != 1 || validation.Errors[0].Path != "imported: services[0] (web)" ||
+		!strings.HasPrefix(validation.Errors[0].Message, "namespace cannot be empty") {
+		t.Errorf("Unexpected errors: %v", validation.Errors)
+	}
+	if validation := ValidateServices(&Config{}); validation.Err() != nil {
+		t.Errorf("Empty configuration is invalid: %v", validation.Err())
+	}
+}
@@ -4,14 +4,29 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 
 	"k8s.io/klog"
 )
 
+const (
+	// minRestartBackoff is the first delay before restarting an exited frpc
+	minRestartBackoff = time.Second
+	// maxRestartBackoff caps the delay between frpc restarts
+	maxRestartBackoff = 30 * time.Second
+)
+
+// FRPClient runs and supervises a frpc process. frpc exits when it loses
+// the router for good; it is restarted with backoff, which re-registers
+// exported services, until Stop is called.
 type FRPClient struct {
 	Name string
 	Args []string
 	Cmd  *exec.Cmd
+
+	mu   sync.Mutex
+	stop chan struct{}
 }
 
 // NewFRPClient creates a new FRP client
@@ -61,17 +76,25 @@ func NewFRPClient(name string, args *EndpointInfo) (*FRPClient, error) {
 		// frpc stcp
 		// --sk servicekeel-secret-key
 		// -n 172.31.19.5:80/123
-		// --local-ip 172.31.19.5 --local-port 80
+		// --local-ip 172.31.19.5 --local-port 8080
 		// --server-listen /tmp/frp.sock
+		// --proxy-protocol-version v2
+		localPort := args.TargetPort
+		if localPort == "" {
+			localPort = args.ServicePort
+		}
 		client.Args = []string{
 			"stcp",
 			"server",
 			"-n", name,
 			"--sk", args.FrpSecretKey,
 			// "--local-ip", args.MappedIP,
-			"--local-port", args.ServicePort,
+			"--local-port", localPort,
 			"--server-listen", args.FrpServerListen,
 		}
+		if args.ProxyProtocol != "" {
+			client.Args = append(client.Args, "--proxy-protocol-version", args.ProxyProtocol)
+		}
 	case EndpointTypeRelay:
 		// e.g.
 		// frpc stcp relay
@@ -103,6 +126,18 @@ func NewFRPClient(name string, args *EndpointInfo) (*FRPClient, error) {
 }
 
 func (c *FRPClient) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.start(); err != nil {
+		return err
+	}
+	c.stop = make(chan struct{})
+	go c.supervise(c.Cmd, c.stop)
+	return nil
+}
+
+// start launches frpc, c.mu must be held
+func (c *FRPClient) start() error {
 	cmd := exec.Command("frpc", c.Args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -114,8 +149,61 @@ func (c *FRPClient) Start() error {
 	return nil
 }
 
+// supervise restarts frpc whenever it exits until stop is closed
+func (c *FRPClient) supervise(cmd *exec.Cmd, stop chan struct{}) {
+	backoff := minRestartBackoff
+	for {
+		started := time.Now()
+		err := cmd.Wait()
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		// a client that ran for a while is restarted quickly again
+		if time.Since(started) > maxRestartBackoff {
+			backoff = minRestartBackoff
+		}
+		klog.Warningf("FRP client %s exited: %v, restarting in %v", c.Name, err, backoff)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxRestartBackoff {
+				backoff = maxRestartBackoff
+			}
+
+			c.mu.Lock()
+			select {
+			case <-stop:
+				c.mu.Unlock()
+				return
+			default:
+			}
+			err := c.start()
+			cmd = c.Cmd
+			c.mu.Unlock()
+			if err == nil {
+				frpClientRestarts.WithLabelValues(c.Name).Inc()
+				break
+			}
+			klog.Errorf("Failed to restart FRP client %s, retrying in %v: %v", c.Name, backoff, err)
+		}
+	}
+}
+
 func (c *FRPClient) Stop() error {
 	klog.Infof("Stopping FRP client %s: %v", c.Name, c.Args)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
 	if c.Cmd != nil && c.Cmd.Process != nil {
 		return c.Cmd.Process.Kill()
 	}
@@ -2,11 +2,14 @@ package controller
 
 import (
 	"fmt"
+	"net"
+	"reflect"
+	"strings"
 	"sync"
 
 	"github.com/imneov/servicekeel/internal/config"
-	"github.com/imneov/servicekeel/internal/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
 )
 
 var (
@@ -14,23 +17,38 @@ var (
 		Name: "servicekeel_frp_endpoint_count",
 		Help: "Number of active FRP endpoints currently watched",
 	})
+	frpClientRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicekeel_frp_client_restarts_total",
+		Help: "Number of times an exited FRP client was restarted",
+	}, []string{"name"})
 )
 
 func init() {
-	prometheus.MustRegister(frpEndpointCount)
+	prometheus.MustRegister(frpEndpointCount, frpClientRestarts)
+}
+
+// DNS maps the names of imported services to local IPs, it is implemented
+// by dns.Server
+type DNS interface {
+	AddMapping(name string) (net.IP, error)
+	AddStaticMapping(name string, ip net.IP) error
+	UnpinMapping(name string)
+	AddMappingAlias(name string, alias ...string) error
+	RemoveMappingAlias(name string, alias ...string)
+	RemoveMapping(name string) (net.IP, error)
 }
 
 // Controller manages FRP client connections and DNS mappings
 type Controller struct {
 	config            *config.Config
-	dnsServer         *dns.Server
+	dnsServer         DNS
 	importedEndpoints map[string]*EndpointInfo
 	exportedEndpoints map[string]*EndpointInfo
 	lock              sync.RWMutex
 }
 
 // NewController creates a new controller and initializes all FRP connections
-func NewController(cfg *config.Config, dnsServer *dns.Server) (*Controller, error) {
+func NewController(cfg *config.Config, dnsServer DNS) (*Controller, error) {
 	r := &Controller{
 		config:            cfg,
 		dnsServer:         dnsServer,
@@ -41,90 +59,256 @@ func NewController(cfg *config.Config, dnsServer *dns.Server) (*Controller, erro
 	return r, nil
 }
 
-// Start reconciliation
-func (r *Controller) Start() error {
-	// Since the configuration is static, no periodic reconciliation is needed
+// Plan creates the endpoints of the configured services: DNS mappings are
+// added for imported services and FRP clients are created, but no process
+// is started and no port is bound
+func (r *Controller) Plan() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-	exportedServices := r.config.ExportedServices
-	importedServices := r.config.ImportedServices
+	exported, imported, err := r.plan(r.config)
+	if err != nil {
+		return err
+	}
+	r.exportedEndpoints = exported
+	r.importedEndpoints = imported
+	return nil
+}
+
+// plan returns the endpoints of cfg by proxy name. DNS mappings already
+// used by the current endpoints are kept, mappings added for other services
+// are removed again on failure and the current ones restored.
+func (r *Controller) plan(cfg *config.Config) (exported, imported map[string]*EndpointInfo, err error) {
+	exported = make(map[string]*EndpointInfo)
+	imported = make(map[string]*EndpointInfo)
+	current := serviceAliases(r.importedEndpoints)
+	var added []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, name := range added {
+			if _, ok := current[name]; !ok {
+				r.dnsServer.RemoveMapping(name)
+			}
+		}
+		r.restoreMappings()
+	}()
 
 	// Handle exported services
-	for _, svc := range exportedServices.Services {
-		for _, port := range svc.Ports {
+	for _, svc := range cfg.ExportedServices.Services {
+		ports, err := expandPorts(svc.Ports, cfg.Ports.MaxRange)
+		if err != nil {
+			return nil, nil, fmt.Errorf("exported service %s: %v", svc.Name, err)
+		}
+		for _, port := range ports {
 			// Create service name
 			serviceName := ServiceName(svc, port)
 			proxyName := EndpointName(svc, port)
 
-			// Create and start FRP client
+			// Create FRP client
 			endpoint := &EndpointInfo{
 				Type:            EndpointTypeExported,
 				ServiceName:     serviceName,
 				ServicePort:     fmt.Sprintf("%d", port.Port),
+				TargetPort:      targetPort(port),
 				ServiceProtocol: port.Protocol,
+				ProxyProtocol:   port.ProxyProtocol,
 				FrpServerListen: "/tmp/frp.sock",
 				FrpSecretKey:    "servicekeel-secret-key",
 			}
 
 			frpClient, err := NewFRPClient(proxyName, endpoint)
 			if err != nil {
-				return fmt.Errorf("failed to create FRP client %s: %v", proxyName, err)
+				return nil, nil, fmt.Errorf("failed to create FRP client %s: %v", proxyName, err)
 			}
-
-			if err := frpClient.Start(); err != nil {
-				return fmt.Errorf("failed to start FRP client %s: %v", proxyName, err)
-			}
-
 			endpoint.FRPClient = frpClient
-			r.exportedEndpoints[proxyName] = endpoint
-			frpEndpointCount.Inc()
+			exported[proxyName] = endpoint
 		}
 	}
 
+	// Release the current pins so that services dropping or swapping their
+	// mapped IPs do not conflict, then pin mapped IPs before any IP is
+	// assigned dynamically
+	for name := range current {
+		r.dnsServer.UnpinMapping(name)
+	}
+	for _, svc := range cfg.ImportedServices.Services {
+		if svc.MappedIP == "" {
+			continue
+		}
+		serviceName := ServiceName(svc, config.Port{})
+		if err := r.dnsServer.AddStaticMapping(serviceName, net.ParseIP(svc.MappedIP)); err != nil {
+			return nil, nil, fmt.Errorf("failed to pin DNS mapping %s to %s: %v", serviceName, svc.MappedIP, err)
+		}
+		added = append(added, serviceName)
+	}
+
 	// Handle imported services
-	for _, svc := range importedServices.Services {
-		for _, port := range svc.Ports {
+	for _, svc := range cfg.ImportedServices.Services {
+		ports, err := expandPorts(svc.Ports, cfg.Ports.MaxRange)
+		if err != nil {
+			return nil, nil, fmt.Errorf("imported service %s: %v", svc.Name, err)
+		}
+		for _, port := range ports {
 			// Create service name
 			serviceName := ServiceName(svc, port)
 			proxyName := EndpointName(svc, port)
 
 			// Add DNS mapping
-			mappedIP, err := r.dnsServer.AddMapping(serviceName)
-			if err != nil {
-				r.dnsServer.RemoveMapping(serviceName)
-				return fmt.Errorf("failed to add DNS mapping %s: %v", serviceName, err)
+			mappedIP := net.ParseIP(svc.MappedIP)
+			if mappedIP == nil {
+				mappedIP, err = r.dnsServer.AddMapping(serviceName)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to add DNS mapping %s: %v", serviceName, err)
+				}
+				added = append(added, serviceName)
+			}
+			if svc.Alias != "" {
+				if err := r.dnsServer.AddMappingAlias(serviceName, svc.Alias); err != nil {
+					return nil, nil, fmt.Errorf("failed to add DNS alias %s for %s: %v", svc.Alias, serviceName, err)
+				}
 			}
 
-			// Create and start FRP client
+			// Create FRP client
 			endpoint := &EndpointInfo{
 				Type:            EndpointTypeImported,
 				ServiceName:     serviceName,
 				ServicePort:     fmt.Sprintf("%d", port.Port),
 				ServiceProtocol: port.Protocol,
 				MappedIP:        mappedIP.String(),
+				Alias:           svc.Alias,
 				FrpServerListen: "/tmp/frp.sock",
 				FrpSecretKey:    "servicekeel-secret-key",
 			}
 
 			frpClient, err := NewFRPClient(proxyName, endpoint)
 			if err != nil {
-				r.dnsServer.RemoveMapping(serviceName)
-				return fmt.Errorf("failed to create FRP client %s: %v", proxyName, err)
+				return nil, nil, fmt.Errorf("failed to create FRP client %s: %v", proxyName, err)
 			}
+			endpoint.FRPClient = frpClient
+			imported[proxyName] = endpoint
+		}
+	}
 
-			if err := frpClient.Start(); err != nil {
-				r.dnsServer.RemoveMapping(serviceName)
-				return fmt.Errorf("failed to start FRP client %s: %v", proxyName, err)
-			}
+	return exported, imported, nil
+}
 
-			endpoint.FRPClient = frpClient
-			r.importedEndpoints[proxyName] = endpoint
-			frpEndpointCount.Inc()
+// restoreMappings moves the DNS names of the current endpoints back to
+// their IPs after a failed plan pinned or moved them. All names are pinned
+// while they are restored so that they do not move each other, and only
+// the ones pinned by the current configuration stay pinned.
+func (r *Controller) restoreMappings() {
+	pinned := pinnedNames(r.config)
+	ips := make(map[string]string)
+	for _, endpoint := range r.importedEndpoints {
+		ips[endpoint.ServiceName] = endpoint.MappedIP
+	}
+	for name := range ips {
+		r.dnsServer.UnpinMapping(name)
+	}
+	for name, ip := range ips {
+		if err := r.dnsServer.AddStaticMapping(name, net.ParseIP(ip)); err != nil {
+			klog.Errorf("Failed to restore DNS mapping %s to %s: %v", name, ip, err)
+		}
+	}
+	for name := range ips {
+		if !pinned[name] {
+			r.dnsServer.UnpinMapping(name)
+		}
+	}
+}
+
+// pinnedNames returns the DNS names of the imported services of cfg that
+// set a mapped IP
+func pinnedNames(cfg *config.Config) map[string]bool {
+	pinned := make(map[string]bool)
+	for _, svc := range cfg.ImportedServices.Services {
+		if svc.MappedIP != "" {
+			pinned[ServiceName(svc, config.Port{})] = true
+		}
+	}
+	return pinned
+}
+
+// Start creates the endpoints of the configuration and starts their FRP clients
+func (r *Controller) Start() error {
+	return r.Update(r.config)
+}
+
+// Update applies a changed service configuration, e.g. read from the Pod
+// annotations. Endpoints that were removed or whose frpc arguments changed
+// are stopped, new ones are started and unchanged ones keep running.
+func (r *Controller) Update(cfg *config.Config) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	exported, imported, err := r.plan(cfg)
+	if err != nil {
+		return err
+	}
+	before := serviceAliases(r.importedEndpoints)
+	after := serviceAliases(imported)
+
+	var errs []string
+	r.exportedEndpoints = apply(r.exportedEndpoints, exported, &errs)
+	r.importedEndpoints = apply(r.importedEndpoints, imported, &errs)
+	r.config = cfg
+
+	// Release the DNS names of services no longer imported
+	for name, alias := range before {
+		newAlias, ok := after[name]
+		if !ok {
+			r.dnsServer.RemoveMapping(name)
+			continue
+		}
+		if alias != "" && alias != newAlias {
+			r.dnsServer.RemoveMappingAlias(name, alias)
 		}
 	}
 
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to start FRP clients: %s", strings.Join(errs, "; "))
+	}
 	return nil
 }
 
+// apply stops the current endpoints missing from or changed in planned and
+// starts the new ones, it returns the endpoints running afterwards
+func apply(current, planned map[string]*EndpointInfo, errs *[]string) map[string]*EndpointInfo {
+	running := make(map[string]*EndpointInfo)
+	for proxyName, endpoint := range current {
+		if p, ok := planned[proxyName]; ok && reflect.DeepEqual(p.FRPClient.Args, endpoint.FRPClient.Args) {
+			p.FRPClient = endpoint.FRPClient
+			running[proxyName] = p
+			continue
+		}
+		endpoint.FRPClient.Stop()
+		frpEndpointCount.Dec()
+	}
+	for proxyName, endpoint := range planned {
+		if _, ok := running[proxyName]; ok {
+			continue
+		}
+		if err := endpoint.FRPClient.Start(); err != nil {
+			*errs = append(*errs, fmt.Sprintf("%s: %v", proxyName, err))
+			continue
+		}
+		running[proxyName] = endpoint
+		frpEndpointCount.Inc()
+	}
+	return running
+}
+
+// serviceAliases returns the alias of every service name of endpoints
+func serviceAliases(endpoints map[string]*EndpointInfo) map[string]string {
+	names := make(map[string]string)
+	for _, endpoint := range endpoints {
+		names[endpoint.ServiceName] = endpoint.Alias
+	}
+	return names
+}
+
 // GetEndpoint returns the endpoint info for a given proxy name
 func (r *Controller) GetImportedEndpoint(proxyName string) *EndpointInfo {
 	r.lock.RLock()
@@ -151,7 +335,49 @@ func (r *Controller) GetAllExportedEndpoints() map[string]*EndpointInfo {
 	return r.exportedEndpoints
 }
 
+// expandPorts replaces port ranges by their single ports named
+// <name>-<port>, ranges holding more than maxRange ports are refused
+func expandPorts(ports []config.Port, maxRange int) ([]config.Port, error) {
+	var expanded []config.Port
+	for _, port := range ports {
+		if port.EndPort == 0 {
+			expanded = append(expanded, port)
+			continue
+		}
+		size := port.EndPort - port.Port + 1
+		if size < 1 || size > maxRange {
+			return nil, fmt.Errorf("port range %d-%d of %s exceeds %d ports", port.Port, port.EndPort, port.Name, maxRange)
+		}
+		if port.TargetEndPort-port.TargetPort+1 != size {
+			return nil, fmt.Errorf("target port range %d-%d of %s does not match port range %d-%d",
+				port.TargetPort, port.TargetEndPort, port.Name, port.Port, port.EndPort)
+		}
+		for i := 0; i < size; i++ {
+			single := port
+			single.Name = fmt.Sprintf("%s-%d", port.Name, port.Port+i)
+			single.Port, single.EndPort = port.Port+i, 0
+			single.TargetPort, single.TargetEndPort = port.TargetPort+i, 0
+			expanded = append(expanded, single)
+		}
+	}
+	return expanded, nil
+}
+
+// targetPort returns the target port of port, ports without one target
+// their own port
+func targetPort(port config.Port) string {
+	if port.TargetPort == 0 {
+		return fmt.Sprintf("%d", port.Port)
+	}
+	return fmt.Sprintf("%d", port.TargetPort)
+}
+
+// ServiceName is the DNS name of a service, services without cluster are
+// named name.namespace.svc
 func ServiceName(svc config.ServiceConfig, port config.Port) string {
+	if svc.Cluster == "" {
+		return fmt.Sprintf("%s.%s.svc", svc.Name, svc.Namespace)
+	}
 	return fmt.Sprintf("%s.%s.svc.%s", svc.Name, svc.Namespace, svc.Cluster)
 }
 
@@ -0,0 +1,309 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/imneov/servicekeel/internal/config"
+	"github.com/imneov/servicekeel/internal/dns"
+)
+
+// fakeDNS records the mappings of the controller
+type fakeDNS struct {
+	mappings map[string]net.IP
+	aliases  map[string]string
+}
+
+func newFakeDNS() *fakeDNS {
+	return &fakeDNS{mappings: make(map[string]net.IP), aliases: make(map[string]string)}
+}
+
+func (d *fakeDNS) AddMapping(name string) (net.IP, error) {
+	if ip, ok := d.mappings[name]; ok {
+		return ip, nil
+	}
+	ip := net.IPv4(127, 0, 99, byte(len(d.mappings)+1))
+	d.mappings[name] = ip
+	return ip, nil
+}
+
+func (d *fakeDNS) AddStaticMapping(name string, ip net.IP) error {
+	d.mappings[name] = ip
+	return nil
+}
+
+func (d *fakeDNS) UnpinMapping(name string) {}
+
+func (d *fakeDNS) AddMappingAlias(name string, alias ...string) error {
+	for _, a := range alias {
+		d.aliases[a] = name
+	}
+	return nil
+}
+
+func (d *fakeDNS) RemoveMappingAlias(name string, alias ...string) {
+	for _, a := range alias {
+		if d.aliases[a] == name {
+			delete(d.aliases, a)
+		}
+	}
+}
+
+func (d *fakeDNS) RemoveMapping(name string) (net.IP, error) {
+	ip, ok := d.mappings[name]
+	if !ok {
+		return nil, fmt.Errorf("no mapping for %s", name)
+	}
+	delete(d.mappings, name)
+	for a, n := range d.aliases {
+		if n == name {
+			delete(d.aliases, a)
+		}
+	}
+	return ip, nil
+}
+
+// stubFRPC puts a frpc on PATH that waits until it is killed
+func stubFRPC(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "frpc"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func testService(name, alias string, port int) config.ServiceConfig {
+	return config.ServiceConfig{Name: name, Namespace: "default", Alias: alias,
+		Ports: []config.Port{{Name: "tcp", Port: port, TargetPort: port, Protocol: "TCP"}}}
+}
+
+func TestControllerUpdate(t *testing.T) {
+	stubFRPC(t)
+	dns := newFakeDNS()
+	cfg := &config.Config{Ports: config.PortsConfig{MaxRange: config.DefaultMaxPortRange}}
+	cfg.ExportedServices.Services = []config.ServiceConfig{testService("api", "", 9000)}
+	cfg.ImportedServices.Services = []config.ServiceConfig{testService("web", "www", 80), testService("db", "", 3306)}
+	ctrl, err := NewController(cfg, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Update(&config.Config{}) })
+
+	if len(dns.mappings) != 2 || dns.aliases["www"] != "web.default.svc" {
+		t.Fatalf("Unexpected DNS mappings %v, aliases %v", dns.mappings, dns.aliases)
+	}
+	api := ctrl.GetExportedEndpoint("api.default.svc:tcp").FRPClient
+	web := ctrl.GetImportedEndpoint("web.default.svc:tcp")
+
+	// db is removed and the alias of web changes
+	updated := &config.Config{Ports: cfg.Ports}
+	updated.ExportedServices.Services = cfg.ExportedServices.Services
+	updated.ImportedServices.Services = []config.ServiceConfig{testService("web", "web2", 80)}
+	if err := ctrl.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := dns.mappings["db.default.svc"]; ok {
+		t.Error("Mapping of the removed service db was kept")
+	}
+	if !dns.mappings["web.default.svc"].Equal(net.ParseIP(web.MappedIP)) {
+		t.Errorf("Mapping of web changed from %s to %s", web.MappedIP, dns.mappings["web.default.svc"])
+	}
+	if _, ok := dns.aliases["www"]; ok || dns.aliases["web2"] != "web.default.svc" {
+		t.Errorf("Unexpected aliases after the alias changed: %v", dns.aliases)
+	}
+	if len(ctrl.GetAllImportedEndpoints()) != 1 {
+		t.Errorf("Unexpected imported endpoints: %v", ctrl.GetAllImportedEndpoints())
+	}
+	// The unchanged exported endpoint keeps its frpc
+	if got := ctrl.GetExportedEndpoint("api.default.svc:tcp").FRPClient; got != api {
+		t.Error("FRP client of the unchanged service api was replaced")
+	}
+
+	if err := ctrl.Update(&config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(dns.mappings) != 0 || len(dns.aliases) != 0 || len(ctrl.GetAllExportedEndpoints()) != 0 {
+		t.Errorf("Services left after removing all: mappings %v, aliases %v", dns.mappings, dns.aliases)
+	}
+}
+
+func TestControllerUpdateMovesAlias(t *testing.T) {
+	stubFRPC(t)
+	dns := newFakeDNS()
+	cfg := &config.Config{Ports: config.PortsConfig{MaxRange: config.DefaultMaxPortRange}}
+	cfg.ImportedServices.Services = []config.ServiceConfig{testService("db-a", "db", 3306), testService("db-b", "", 3306)}
+	ctrl, err := NewController(cfg, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Update(&config.Config{}) })
+
+	// The alias moves from db-a to db-b, both stay imported
+	updated := &config.Config{Ports: cfg.Ports}
+	updated.ImportedServices.Services = []config.ServiceConfig{testService("db-a", "", 3306), testService("db-b", "db", 3306)}
+	if err := ctrl.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	if got := dns.aliases["db"]; got != "db-b.default.svc" {
+		t.Errorf("Alias db points to %q; want db-b.default.svc", got)
+	}
+}
+
+// pinnedService returns an imported service pinned to ip
+func pinnedService(name, ip string) config.ServiceConfig {
+	svc := testService(name, "", 80)
+	svc.MappedIP = ip
+	return svc
+}
+
+func TestControllerUpdateMappedIP(t *testing.T) {
+	stubFRPC(t)
+	srv, err := dns.NewServer("127.0.66.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Ports: config.PortsConfig{MaxRange: config.DefaultMaxPortRange}}
+	cfg.ImportedServices.Services = []config.ServiceConfig{testService("web", "", 80), pinnedService("db", "127.0.66.10")}
+	ctrl, err := NewController(cfg, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Update(&config.Config{}) })
+	web := ctrl.GetImportedEndpoint("web.default.svc:tcp").MappedIP
+
+	// db drops its mapped IP and keeps it until another service pins it
+	dropped := &config.Config{Ports: cfg.Ports}
+	dropped.ImportedServices.Services = []config.ServiceConfig{testService("web", "", 80), testService("db", "", 80)}
+	if err := ctrl.Update(dropped); err != nil {
+		t.Fatal(err)
+	}
+	if got := ctrl.GetImportedEndpoint("db.default.svc:tcp").MappedIP; got != "127.0.66.10" {
+		t.Errorf("db moved to %s after dropping its mapped IP", got)
+	}
+	moved := &config.Config{Ports: cfg.Ports}
+	moved.ImportedServices.Services = append(dropped.ImportedServices.Services, pinnedService("cache", "127.0.66.10"))
+	if err := ctrl.Update(moved); err != nil {
+		t.Fatalf("Pinning the IP released by db failed: %v", err)
+	}
+	if got := ctrl.GetImportedEndpoint("db.default.svc:tcp").MappedIP; got == "127.0.66.10" {
+		t.Error("db kept the IP pinned to cache")
+	}
+	// Pinned services swap their IPs
+	db := ctrl.GetImportedEndpoint("db.default.svc:tcp").MappedIP
+	swapped := &config.Config{Ports: cfg.Ports}
+	swapped.ImportedServices.Services = []config.ServiceConfig{pinnedService("web", db), pinnedService("db", web), pinnedService("cache", "127.0.66.10")}
+	if err := ctrl.Update(swapped); err != nil {
+		t.Fatalf("Swapping the IPs of web and db failed: %v", err)
+	}
+	if got := ctrl.GetImportedEndpoint("web.default.svc:tcp").MappedIP; got != db {
+		t.Errorf("web maps to %s after the swap; want %s", got, db)
+	}
+	if err := ctrl.Update(moved); err != nil {
+		t.Fatal(err)
+	}
+	web = ctrl.GetImportedEndpoint("web.default.svc:tcp").MappedIP
+
+	// A failed update moves web back to its IP and keeps the pin of cache
+	failed := &config.Config{Ports: cfg.Ports}
+	rtp := testService("rtp", "", 30000)
+	rtp.Ports[0].EndPort, rtp.Ports[0].TargetEndPort = 30000+cfg.Ports.MaxRange, 30000+cfg.Ports.MaxRange
+	failed.ImportedServices.Services = []config.ServiceConfig{pinnedService("web", "127.0.66.20"), pinnedService("db", web), rtp}
+	if err := ctrl.Update(failed); err == nil {
+		t.Fatal("Expected an error for a range exceeding maxRange")
+	}
+	for name, want := range map[string]string{
+		"web.default.svc":   web,
+		"db.default.svc":    ctrl.GetImportedEndpoint("db.default.svc:tcp").MappedIP,
+		"cache.default.svc": "127.0.66.10",
+	} {
+		if got, _ := srv.AddMapping(name); got.String() != want {
+			t.Errorf("%s maps to %s after the failed update; want %s", name, got, want)
+		}
+	}
+	if err := srv.AddStaticMapping("other.default.svc", net.ParseIP("127.0.66.10")); err == nil {
+		t.Error("cache lost its pin after the failed update")
+	}
+	if err := srv.AddStaticMapping("other.default.svc", net.ParseIP(web)); err != nil {
+		t.Errorf("web stayed pinned after the failed update: %v", err)
+	}
+}
+
+func TestExpandPorts(t *testing.T) {
+	ports, err := expandPorts([]config.Port{
+		{Name: "http", Port: 80, TargetPort: 8080, Protocol: "TCP"},
+		{Name: "rtp", Port: 30000, EndPort: 30002, TargetPort: 40000, TargetEndPort: 40002, Protocol: "UDP"},
+	}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []config.Port{
+		{Name: "http", Port: 80, TargetPort: 8080, Protocol: "TCP"},
+		{Name: "rtp-30000", Port: 30000, TargetPort: 40000, Protocol: "UDP"},
+		{Name: "rtp-30001", Port: 30001, TargetPort: 40001, Protocol: "UDP"},
+		{Name: "rtp-30002", Port: 30002, TargetPort: 40002, Protocol: "UDP"},
+	}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("expandPorts = %+v; want %+v", ports, want)
+	}
+
+	// Ranges longer than maxRange are refused
+	if _, err := expandPorts([]config.Port{{Name: "rtp", Port: 30000, EndPort: 30003, TargetPort: 40000, TargetEndPort: 40003}}, 3); err == nil {
+		t.Error("Expected an error for a range exceeding maxRange")
+	}
+	// Target ranges must be as long as the port range
+	if _, err := expandPorts([]config.Port{{Name: "rtp", Port: 30000, EndPort: 30002, TargetPort: 40000, TargetEndPort: 40001}}, 3); err == nil ||
+		!strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Expected an error for a mismatched target range, got %v", err)
+	}
+}
+
+func TestPlanTargetPort(t *testing.T) {
+	cfg := &config.Config{Ports: config.PortsConfig{MaxRange: config.DefaultMaxPortRange}}
+	cfg.ExportedServices.Services = []config.ServiceConfig{{Name: "rtp", Namespace: "default", Ports: []config.Port{
+		{Name: "rtp", Port: 30000, EndPort: 30001, TargetPort: 40000, TargetEndPort: 40001, Protocol: "UDP"},
+	}}}
+	cfg.ImportedServices.Services = cfg.ExportedServices.Services
+	ctrl, err := NewController(cfg, newFakeDNS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.Plan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Exported endpoints forward to the target port, imported ones bind the port
+	exported := ctrl.GetExportedEndpoint("rtp.default.svc:rtp-30001")
+	if exported == nil || !containsArgs(exported.FRPClient.Args, "--local-port", "40001") {
+		t.Errorf("Unexpected exported endpoint: %+v", exported)
+	}
+	imported := ctrl.GetImportedEndpoint("rtp.default.svc:rtp-30001")
+	if imported == nil || !containsArgs(imported.FRPClient.Args, "--bind-port", "30001") {
+		t.Errorf("Unexpected imported endpoint: %+v", imported)
+	}
+}
+
+// containsArgs reports whether args holds flag followed by value
+func containsArgs(args []string, flag, value string) bool {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag && args[i+1] == value {
+			return true
+		}
+	}
+	return false
+}
@@ -24,8 +24,15 @@ type EndpointInfo struct {
 	ServiceName string
 	// Service port
 	ServicePort string
+	// Port of the local service exported endpoints forward to, empty uses
+	// ServicePort
+	TargetPort string
 	// Service protocol
 	ServiceProtocol string
+	// PROXY protocol version sent to the local service, exported endpoints only
+	ProxyProtocol string
+	// Additional DNS name of an imported endpoint
+	Alias string
 	// Mapped IP address to be used for service mapping, needs to be restricted within range
 	MappedIP string
 	// Source FRP server address for relay mode
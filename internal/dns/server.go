@@ -20,6 +20,8 @@ type Server struct {
 	aliases  map[string]string
 	mappings map[string]net.IP
 	usedIPs  map[string]struct{}
+	// static holds the names pinned to their IP by AddStaticMapping
+	static   map[string]bool
 	searches []string
 }
 
@@ -41,13 +43,19 @@ func NewServer(ipRange string) (*Server, error) {
 		aliases:  make(map[string]string),
 		mappings: make(map[string]net.IP),
 		usedIPs:  make(map[string]struct{}),
+		static:   make(map[string]bool),
 	}, nil
 }
 
-// GetIP returns an IP address based on the index within the ipRange
+// GetIP returns an IP address based on the index within the ipRange, or an
+// empty string if idx lies outside of it
 func (s *Server) GetIP(idx int) string {
+	ones, bits := s.ipNet.Mask.Size()
+	if idx < 0 || idx > 255 || bits-ones < 8 && idx >= 1<<(bits-ones) {
+		return ""
+	}
 	ip := s.ipNet.IP.Mask(s.ipNet.Mask)
-	ip[3] = byte(idx)
+	ip[len(ip)-1] += byte(idx)
 	return ip.String()
 }
 
@@ -65,11 +73,14 @@ func (s *Server) getUnusedIP() net.IP {
 	return nil
 }
 
-// AddMapping registers a fixed IP for the given DNS query name.
+// AddMapping registers a fixed IP for the given DNS query name. A name
+// mapped before keeps its IP and stays pinned if it was.
 func (s *Server) AddMapping(name string) (net.IP, error) {
 	if !strings.HasSuffix(name, ".") {
 		name = name + "."
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if ip, ok := s.mappings[name]; ok {
 		return ip, nil
 	}
@@ -78,11 +89,58 @@ func (s *Server) AddMapping(name string) (net.IP, error) {
 		log.Printf("no unused IP found")
 		return nil, fmt.Errorf("no unused IP found")
 	}
+	s.usedIPs[ip.String()] = struct{}{}
+	s.mappings[name] = ip
+	return ip, nil
+}
+
+// AddStaticMapping pins the DNS query name to ip, which must lie within the
+// IP range. A name mapped by AddMapping to ip before is moved to another
+// IP, ip pinned to another name is an error.
+func (s *Server) AddStaticMapping(name string, ip net.IP) error {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	ip = ip.To4()
+	if ip == nil || !s.ipNet.Contains(ip) {
+		return fmt.Errorf("IP %s is not within %s", ip, s.ipRange)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+
+	for other, otherIP := range s.mappings {
+		if other == name || !otherIP.Equal(ip) {
+			continue
+		}
+		if s.static[other] {
+			return fmt.Errorf("IP %s is already pinned to %s", ip, other)
+		}
+		moved := s.getUnusedIP()
+		if moved == nil {
+			return fmt.Errorf("no unused IP found to move %s from %s", other, ip)
+		}
+		s.mappings[other] = moved
+		log.Printf("moved %s from %s to %s for %s", other, ip, moved, name)
+	}
+	if old, ok := s.mappings[name]; ok && !old.Equal(ip) {
+		delete(s.usedIPs, old.String())
+	}
 	s.usedIPs[ip.String()] = struct{}{}
 	s.mappings[name] = ip
-	return ip, nil
+	s.static[name] = true
+	return nil
+}
+
+// UnpinMapping releases the pin of a name added with AddStaticMapping. The
+// name keeps its IP, which AddStaticMapping may move it from like any IP
+// assigned by AddMapping.
+func (s *Server) UnpinMapping(name string) {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.static, name)
 }
 
 // AddMappingAlias registers a fixed IP for the given DNS query name.
@@ -90,6 +148,8 @@ func (s *Server) AddMappingAlias(name string, alias ...string) error {
 	if !strings.HasSuffix(name, ".") {
 		name = name + "."
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, a := range alias {
 		if !strings.HasSuffix(a, ".") {
 			a = a + "."
@@ -99,6 +159,24 @@ func (s *Server) AddMappingAlias(name string, alias ...string) error {
 	return nil
 }
 
+// RemoveMappingAlias removes aliases registered with AddMappingAlias for
+// name. Aliases registered for another name since are kept.
+func (s *Server) RemoveMappingAlias(name string, alias ...string) {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range alias {
+		if !strings.HasSuffix(a, ".") {
+			a = a + "."
+		}
+		if s.aliases[a] == name {
+			delete(s.aliases, a)
+		}
+	}
+}
+
 // RemoveMapping removes a mapping for the given DNS query name.
 func (s *Server) RemoveMapping(name string) (net.IP, error) {
 	if !strings.HasSuffix(name, ".") {
@@ -112,6 +190,7 @@ func (s *Server) RemoveMapping(name string) (net.IP, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.mappings, name)
+	delete(s.static, name)
 	delete(s.usedIPs, ip.String())
 	for k, v := range s.aliases {
 		if v == name {
@@ -296,12 +375,18 @@ func (s *Server) Stop() {
 // 	w.WriteMsg(msg)
 // }
 
+// JoinDomain appends the search domain to domain. Trailing labels of domain
+// that start the search domain are not repeated, e.g. test.default with
+// default.svc.cluster.local is test.default.svc.cluster.local.
 func JoinDomain(domain, search string) string {
-	if !strings.HasSuffix(domain, ".") {
-		domain = domain + "."
-	}
-	if !strings.HasSuffix(search, ".") {
-		search = search + "."
+	domain = strings.TrimSuffix(domain, ".")
+	search = strings.TrimSuffix(search, ".")
+	labels := strings.Split(domain, ".")
+	searchLabels := strings.Split(search, ".")
+	for n := min(len(labels), len(searchLabels)); n > 0; n-- {
+		if strings.Join(labels[len(labels)-n:], ".") == strings.Join(searchLabels[:n], ".") {
+			return strings.Join(append(labels[:len(labels)-n], searchLabels...), ".") + "."
+		}
 	}
-	return domain + search
+	return domain + "." + search + "."
 }
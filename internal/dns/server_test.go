@@ -145,6 +145,65 @@ func TestAddMapping(t *testing.T) {
 	}
 }
 
+func TestAddStaticMapping(t *testing.T) {
+	s, err := NewServer("127.0.66.0/24")
+	if err != nil {
+		t.Fatalf("NewServer() returned error: %v", err)
+	}
+	dynamic, err := s.AddMapping("web.ns.svc")
+	if err != nil {
+		t.Fatalf("AddMapping() returned error: %v", err)
+	}
+
+	// pinning the IP of a dynamic mapping moves the dynamic one
+	if err := s.AddStaticMapping("db.ns.svc", dynamic); err != nil {
+		t.Fatalf("AddStaticMapping() returned error: %v", err)
+	}
+	moved, _ := s.AddMapping("web.ns.svc")
+	if moved.Equal(dynamic) {
+		t.Errorf("web.ns.svc kept pinned IP %s", dynamic)
+	}
+	// dynamic assignments skip pinned IPs
+	for i := 0; i < 10; i++ {
+		ip, err := s.AddMapping(fmt.Sprintf("svc-%d.ns.svc", i))
+		if err != nil {
+			t.Fatalf("AddMapping() returned error: %v", err)
+		}
+		if ip.Equal(dynamic) || ip.Equal(moved) {
+			t.Errorf("svc-%d.ns.svc got used IP %s", i, ip)
+		}
+	}
+
+	// mapping a pinned name again keeps the pin
+	if ip, err := s.AddMapping("db.ns.svc"); err != nil || !ip.Equal(dynamic) {
+		t.Errorf("AddMapping() of pinned db.ns.svc = %s, %v; want %s", ip, err, dynamic)
+	}
+	if err := s.AddStaticMapping("cache.ns.svc", dynamic); err == nil {
+		t.Errorf("expected error pinning %s twice", dynamic)
+	}
+	if err := s.AddStaticMapping("cache.ns.svc", net.ParseIP("127.0.67.1")); err == nil {
+		t.Errorf("expected error pinning an IP outside the range")
+	}
+	// a removed mapping releases its pinned IP
+	if _, err := s.RemoveMapping("db.ns.svc"); err != nil {
+		t.Fatalf("RemoveMapping() returned error: %v", err)
+	}
+	if err := s.AddStaticMapping("cache.ns.svc", dynamic); err != nil {
+		t.Errorf("AddStaticMapping() returned error: %v", err)
+	}
+	// an unpinned mapping keeps its IP until another name pins it
+	s.UnpinMapping("cache.ns.svc")
+	if ip, _ := s.AddMapping("cache.ns.svc"); !ip.Equal(dynamic) {
+		t.Errorf("cache.ns.svc moved to %s when unpinned; want %s", ip, dynamic)
+	}
+	if err := s.AddStaticMapping("db.ns.svc", dynamic); err != nil {
+		t.Errorf("AddStaticMapping() returned error: %v", err)
+	}
+	if ip, _ := s.AddMapping("cache.ns.svc"); ip.Equal(dynamic) {
+		t.Errorf("cache.ns.svc kept IP %s pinned to db.ns.svc", dynamic)
+	}
+}
+
 // TestNoMapping verifies that queries without a mapping return NXDOMAIN.
 func TestNoMapping(t *testing.T) {
 	s, err := NewServer("127.0.66.0/24")
@@ -382,3 +441,38 @@ func TestSearchDomainsOrder(t *testing.T) {
 		t.Errorf("Got IP %s; want %s", aRec.A.String(), domains["test.default.svc.cluster-a.local."].String())
 	}
 }
+
+// TestMappingAlias verifies that aliases resolve to the mapped IP until the mapping is removed.
+func TestMappingAlias(t *testing.T) {
+	s, err := NewServer("127.0.66.0/24")
+	if err != nil {
+		t.Fatalf("NewServer() returned error: %v", err)
+	}
+	ip, err := s.AddMapping("backend.web.svc.cluster-a")
+	if err != nil {
+		t.Fatalf("AddMapping() returned error: %v", err)
+	}
+	if err := s.AddMappingAlias("backend.web.svc.cluster-a", "backend"); err != nil {
+		t.Fatalf("AddMappingAlias() returned error: %v", err)
+	}
+	if got, ok := s.resolveQuery("backend.", 1); !ok || !got.Equal(ip) {
+		t.Errorf("resolveQuery(backend.) = %v, %v; want %v", got, ok, ip)
+	}
+
+	// an alias moved to another name is only removed for its new name
+	other, err := s.AddMapping("backend.web.svc.cluster-b")
+	if err != nil {
+		t.Fatalf("AddMapping() returned error: %v", err)
+	}
+	s.AddMappingAlias("backend.web.svc.cluster-b", "backend")
+	s.RemoveMappingAlias("backend.web.svc.cluster-a", "backend")
+	if got, ok := s.resolveQuery("backend.", 2); !ok || !got.Equal(other) {
+		t.Errorf("resolveQuery(backend.) = %v, %v after moving the alias; want %v", got, ok, other)
+	}
+	s.AddMappingAlias("backend.web.svc.cluster-a", "backend")
+
+	s.RemoveMapping("backend.web.svc.cluster-a")
+	if got, ok := s.resolveQuery("backend.", 3); ok {
+		t.Errorf("resolveQuery(backend.) = %v after removal; want no mapping", got)
+	}
+}
@@ -0,0 +1,96 @@
+package router
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// AdminHandler serves the router admin API:
+//
+//	GET    /api/v1/proxies          registered proxies
+//	DELETE /api/v1/proxies/{name}   deregister a proxy
+//	GET    /api/v1/sessions         active visitor sessions, "proxy" query parameter filters by proxy
+//	DELETE /api/v1/sessions/{id}    disconnect a visitor session
+//	GET    /api/v1/traffic          traffic summary, see TrafficHandler
+func (r *STCPRouter) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/proxies", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, r.Proxies())
+	})
+	mux.HandleFunc("DELETE /api/v1/proxies/{name}", func(w http.ResponseWriter, req *http.Request) {
+		if !r.DeregisterProxy(req.PathValue("name")) {
+			http.Error(w, "proxy not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/v1/sessions", func(w http.ResponseWriter, req *http.Request) {
+		sessions := r.Sessions()
+		if name := req.URL.Query().Get("proxy"); name != "" {
+			filtered := make([]SessionInfo, 0, len(sessions))
+			for _, s := range sessions {
+				if s.ProxyName == name {
+					filtered = append(filtered, s)
+				}
+			}
+			sessions = filtered
+		}
+		writeJSON(w, sessions)
+	})
+	mux.HandleFunc("DELETE /api/v1/sessions/{id}", func(w http.ResponseWriter, req *http.Request) {
+		if !r.CloseSession(req.PathValue("id")) {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.Handle("GET /api/v1/traffic", r.TrafficHandler())
+	return mux
+}
+
+// BasicAuth protects h with HTTP basic authentication. Without user or
+// password every request is refused, the admin API is never served
+// unauthenticated.
+func BasicAuth(h http.Handler, user, password string) http.Handler {
+	if user == "" || password == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "admin API requires admin.user and admin.password", http.StatusForbidden)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="servicekeel-router"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// TrafficHandler serves the traffic summary of all proxies as JSON.
+// The optional "proxy" query parameter selects a single proxy.
+func (r *STCPRouter) TrafficHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if name := req.URL.Query().Get("proxy"); name != "" {
+			traffic, ok := r.ProxyTraffic(name)
+			if !ok {
+				http.Error(w, "proxy not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, traffic)
+			return
+		}
+		writeJSON(w, r.Traffic())
+	})
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,117 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// adminRequest performs a request against the admin API and decodes a JSON response into v
+func adminRequest(t *testing.T, h http.Handler, method, path string, v interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	if v != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("Failed to decode %s %s response: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminHandler(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+	admin := router.AdminHandler()
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		User:       "alice",
+		Namespace:  "default",
+		AllowUsers: []string{"*"},
+	}, startEchoServer(t))
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		User:       "bob",
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect visitor: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello, admin!"); err != nil {
+		t.Fatal(err)
+	}
+
+	var proxies []ProxyInfo
+	if code := adminRequest(t, admin, "GET", "/api/v1/proxies", &proxies); code != http.StatusOK {
+		t.Fatalf("Unexpected status listing proxies: %d", code)
+	}
+	if len(proxies) != 1 || proxies[0].Name != "echo" || proxies[0].Owner.User != "alice" ||
+		proxies[0].Owner.Namespace != "default" || proxies[0].StartTime.IsZero() || proxies[0].Sessions != 1 {
+		t.Fatalf("Unexpected proxies: %+v", proxies)
+	}
+
+	var sessions []SessionInfo
+	waitFor(t, "session traffic", func() bool {
+		adminRequest(t, admin, "GET", "/api/v1/sessions?proxy=echo", &sessions)
+		return len(sessions) == 1 && sessions[0].BytesIn == 13 && sessions[0].BytesOut == 13
+	})
+	if sessions[0].Visitor.User != "bob" {
+		t.Fatalf("Unexpected session visitor: %+v", sessions[0])
+	}
+
+	// Disconnect the session
+	if code := adminRequest(t, admin, "DELETE", "/api/v1/sessions/"+sessions[0].ID, nil); code != http.StatusNoContent {
+		t.Fatalf("Unexpected status closing session: %d", code)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected visitor connection to be closed")
+	}
+	waitFor(t, "session removal", func() bool {
+		return adminRequest(t, admin, "DELETE", "/api/v1/sessions/"+sessions[0].ID, nil) == http.StatusNotFound
+	})
+
+	// Deregister the proxy
+	if code := adminRequest(t, admin, "DELETE", "/api/v1/proxies/echo", nil); code != http.StatusNoContent {
+		t.Fatalf("Unexpected status deregistering proxy: %d", code)
+	}
+	if router.lookup("echo") != nil {
+		t.Fatal("Expected proxy to be deregistered")
+	}
+	if code := adminRequest(t, admin, "DELETE", "/api/v1/proxies/echo", nil); code != http.StatusNotFound {
+		t.Fatalf("Expected deregistered proxy to be gone, got status %d", code)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	h := BasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "admin", "secret")
+
+	req := httptest.NewRequest("GET", "/api/v1/proxies", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthenticated request to be rejected, got %d", rec.Code)
+	}
+
+	req.SetBasicAuth("admin", "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected authenticated request to succeed, got %d", rec.Code)
+	}
+
+	// Without credentials nothing is served
+	h = BasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "", "")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/v1/proxies/echo", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected request without configured credentials to be refused, got %d", rec.Code)
+	}
+}
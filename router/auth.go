@@ -0,0 +1,112 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxClockSkew is the accepted difference between login timestamps and local time
+const maxClockSkew = 15 * time.Minute
+
+// Identity describes who is behind a connection
+type Identity struct {
+	User      string `json:"user,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+}
+
+func (i Identity) String() string {
+	user := i.User
+	if user == "" {
+		user = "anonymous"
+	}
+	if i.Namespace == "" && i.Cluster == "" {
+		return user
+	}
+	return fmt.Sprintf("%s@%s/%s", user, i.Namespace, i.Cluster)
+}
+
+// Allowed reports whether the visitor identity matches one of the allow entries.
+// Supported entries are "*" (everyone), "namespace:<name>", "cluster:<name>"
+// and plain user names. An empty list only admits visitors that share the
+// user of the owner.
+//
+// Identities are the ones claimed in the login, any client holding the
+// secret key may claim any user, namespace or cluster. Only with mutual TLS
+// are they bound to the client certificate (see applyCertIdentity), so
+// AllowUsers is enforced against verified identities only when tls.caFile
+// is set.
+func Allowed(allowUsers []string, owner, visitor Identity) bool {
+	if len(allowUsers) == 0 {
+		return visitor.User == owner.User
+	}
+	for _, entry := range allowUsers {
+		switch {
+		case entry == "*":
+			return true
+		case strings.HasPrefix(entry, "namespace:"):
+			if visitor.Namespace != "" && visitor.Namespace == strings.TrimPrefix(entry, "namespace:") {
+				return true
+			}
+		case strings.HasPrefix(entry, "cluster:"):
+			if visitor.Cluster != "" && visitor.Cluster == strings.TrimPrefix(entry, "cluster:") {
+				return true
+			}
+		default:
+			if visitor.User == entry {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sign fills in the timestamp, nonce and signature of a login message
+func (m *Login) Sign(secretKey string) {
+	m.Timestamp = time.Now().Unix()
+	m.Nonce = generateConnID()
+	m.Signature = m.signature(secretKey)
+}
+
+// signature computes the HMAC of the login fields with the secret key
+func (m *Login) signature(secretKey string) string {
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	for _, field := range []string{m.Role, m.ProxyName, m.User, m.Namespace, m.Cluster, strings.Join(m.AllowUsers, ","), strconv.Itoa(m.PoolCount), m.RunID, m.Via, m.Addr, strconv.FormatInt(m.Timestamp, 10), m.Nonce} {
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAuth verifies the signature and freshness of a login message and
+// rejects signatures that have already been used
+func (r *STCPRouter) verifyAuth(m *Login) error {
+	now := time.Now()
+	ts := time.Unix(m.Timestamp, 0)
+	if ts.Before(now.Add(-maxClockSkew)) || ts.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("login timestamp out of range")
+	}
+	if !hmac.Equal([]byte(m.Signature), []byte(m.signature(r.config.SecretKey))) {
+		return fmt.Errorf("invalid signature")
+	}
+	if _, replayed := r.authCache.LoadOrStore(m.Signature, ts); replayed {
+		return fmt.Errorf("login replayed")
+	}
+	r.pruneAuthCache(now)
+	return nil
+}
+
+// pruneAuthCache drops signatures that are too old to be replayed
+func (r *STCPRouter) pruneAuthCache(now time.Time) {
+	r.authCache.Range(func(key, value interface{}) bool {
+		if value.(time.Time).Before(now.Add(-maxClockSkew)) {
+			r.authCache.Delete(key)
+		}
+		return true
+	})
+}
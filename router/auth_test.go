@@ -0,0 +1,67 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowed(t *testing.T) {
+	owner := Identity{User: "backend", Namespace: "default", Cluster: "cluster-a"}
+
+	tests := []struct {
+		name       string
+		allowUsers []string
+		visitor    Identity
+		want       bool
+	}{
+		{"empty list same user", nil, Identity{User: "backend"}, true},
+		{"empty list other user", nil, Identity{User: "frontend"}, false},
+		{"wildcard", []string{"*"}, Identity{User: "anyone"}, true},
+		{"user", []string{"alice", "bob"}, Identity{User: "bob"}, true},
+		{"user mismatch", []string{"alice"}, Identity{User: "bob"}, false},
+		{"namespace", []string{"namespace:web"}, Identity{User: "frontend", Namespace: "web"}, true},
+		{"namespace mismatch", []string{"namespace:web"}, Identity{User: "frontend", Namespace: "default"}, false},
+		{"cluster", []string{"cluster:cluster-b"}, Identity{Cluster: "cluster-b"}, true},
+		{"empty namespace", []string{"namespace:"}, Identity{User: "frontend"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Allowed(tt.allowUsers, owner, tt.visitor); got != tt.want {
+				t.Errorf("Allowed(%v, %v) = %v; want %v", tt.allowUsers, tt.visitor, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyAuth(t *testing.T) {
+	router := NewSTCPRouter(&STCPConfig{SecretKey: "test-secret-key"})
+
+	login := &Login{Role: RoleVisitor, ProxyName: "echo", User: "alice"}
+	login.Sign("test-secret-key")
+	if err := router.verifyAuth(login); err != nil {
+		t.Fatalf("verifyAuth() returned error: %v", err)
+	}
+
+	// Replayed login
+	if err := router.verifyAuth(login); err == nil {
+		t.Error("Expected replayed login to be rejected")
+	}
+
+	// Tampered identity
+	tampered := &Login{Role: RoleVisitor, ProxyName: "echo", User: "alice"}
+	tampered.Sign("test-secret-key")
+	tampered.User = "mallory"
+	if err := router.verifyAuth(tampered); err == nil {
+		t.Error("Expected tampered login to be rejected")
+	}
+
+	// Expired timestamp
+	expired := &Login{Role: RoleVisitor, ProxyName: "echo"}
+	expired.Sign("test-secret-key")
+	expired.Timestamp = time.Now().Add(-time.Hour).Unix()
+	expired.Signature = expired.signature("test-secret-key")
+	if err := router.verifyAuth(expired); err == nil {
+		t.Error("Expected expired login to be rejected")
+	}
+}
@@ -0,0 +1,123 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+)
+
+// Load balancing strategies choosing among the servers registered under one proxy name
+const (
+	// LoadBalanceRoundRobin rotates through the servers
+	LoadBalanceRoundRobin = "round_robin"
+	// LoadBalanceLeastConn picks the server with the fewest active sessions
+	LoadBalanceLeastConn = "least_conn"
+	// LoadBalanceConsistentHash pins a visitor to a server by hashing its
+	// identity, only visitors of a removed server move elsewhere
+	LoadBalanceConsistentHash = "consistent_hash"
+)
+
+// ValidLoadBalance reports whether s names a load balancing strategy, empty
+// selects round robin
+func ValidLoadBalance(s string) bool {
+	switch s {
+	case "", LoadBalanceRoundRobin, LoadBalanceLeastConn, LoadBalanceConsistentHash:
+		return true
+	}
+	return false
+}
+
+// proxyGroup is the set of servers registered under one proxy name
+type proxyGroup struct {
+	name string
+	// members are ordered by registration, guarded by STCPRouter.proxiesMu
+	members []*proxy
+	next    uint64
+}
+
+// add registers a server in the group. All servers of a proxy must be owned
+// by the same user. A server registering again with the run ID of an existing
+// member, e.g. after a reconnect the router has not noticed yet, replaces it;
+// the replaced member is returned.
+func (g *proxyGroup) add(p *proxy) (*proxy, error) {
+	if len(g.members) > 0 && g.members[0].owner.User != p.owner.User {
+		return nil, fmt.Errorf("proxy %s is already registered by %s", p.name, g.members[0].owner)
+	}
+	for i, m := range g.members {
+		if m.runID == p.runID {
+			g.members[i] = p
+			return m, nil
+		}
+	}
+	g.members = append(g.members, p)
+	return nil, nil
+}
+
+// remove drops a member, it reports false if p is not a member
+func (g *proxyGroup) remove(p *proxy) bool {
+	for i, m := range g.members {
+		if m == p {
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// member returns the member with the given run ID
+func (g *proxyGroup) member(runID string) *proxy {
+	for _, m := range g.members {
+		if m.runID == runID {
+			return m
+		}
+	}
+	return nil
+}
+
+// pick chooses one of the candidates for a visitor using the strategy
+func (g *proxyGroup) pick(strategy string, candidates []*proxy, key string) *proxy {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	switch strategy {
+	case LoadBalanceLeastConn:
+		best := candidates[0]
+		for _, m := range candidates[1:] {
+			if atomic.LoadInt64(&m.sessions) < atomic.LoadInt64(&best.sessions) {
+				best = m
+			}
+		}
+		return best
+	case LoadBalanceConsistentHash:
+		// rendezvous hashing: the member with the highest score for the key wins
+		var best *proxy
+		var bestScore uint64
+		for _, m := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(m.runID))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = m, score
+			}
+		}
+		return best
+	default:
+		n := atomic.AddUint64(&g.next, 1)
+		return candidates[(n-1)%uint64(len(candidates))]
+	}
+}
+
+// balanceKey identifies a visitor for consistent hashing, anonymous visitors
+// are identified by their remote host
+func balanceKey(visitor Identity, conn net.Conn) string {
+	if visitor.User != "" {
+		return visitor.String()
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,173 @@
+package router
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startNamedServer starts a TCP server that greets every connection with its name
+func startNamedServer(t *testing.T, name string) string {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.Write([]byte(name))
+				io.Copy(io.Discard, conn)
+			}(conn)
+		}
+	}()
+	return server.Addr().String()
+}
+
+// startBalancedServers registers one server per name under the proxy "backend"
+func startBalancedServers(t *testing.T, router *STCPRouter, names ...string) map[string]*ServerClient {
+	clients := make(map[string]*ServerClient)
+	for _, name := range names {
+		clients[name] = startTestServerClient(t, &ClientConfig{
+			RouterAddr: router.serverListener.Addr().String(),
+			SecretKey:  "test-secret-key",
+			ProxyName:  "backend",
+			AllowUsers: []string{"*"},
+		}, startNamedServer(t, name))
+	}
+	waitFor(t, "servers to register", func() bool {
+		return len(router.lookupAll("backend")) == len(names)
+	})
+	return clients
+}
+
+// visitBackend opens a stream to "backend" as user and returns the server
+// that answered, the stream is left open
+func visitBackend(t *testing.T, router *STCPRouter, user string) (string, net.Conn) {
+	t.Helper()
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "backend",
+		User:       user,
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit backend: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read server name: %v", err)
+	}
+	return string(buf), conn
+}
+
+func TestLoadBalanceRoundRobin(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+	startBalancedServers(t, router, "server-a", "server-b")
+
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		name, conn := visitBackend(t, router, "alice")
+		conn.Close()
+		counts[name]++
+	}
+	if counts["server-a"] != 3 || counts["server-b"] != 3 {
+		t.Fatalf("Unexpected distribution: %v", counts)
+	}
+}
+
+func TestLoadBalanceLeastConn(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", LoadBalance: LoadBalanceLeastConn})
+	startBalancedServers(t, router, "server-a", "server-b")
+
+	// Sessions stay open, each visitor lands on the idle server
+	first, _ := visitBackend(t, router, "alice")
+	second, _ := visitBackend(t, router, "alice")
+	if first == second {
+		t.Fatalf("Expected open sessions to be spread, both went to %s", first)
+	}
+}
+
+func TestLoadBalanceConsistentHash(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", LoadBalance: LoadBalanceConsistentHash})
+	clients := startBalancedServers(t, router, "server-a", "server-b", "server-c")
+
+	pinned, conn := visitBackend(t, router, "alice")
+	conn.Close()
+	for i := 0; i < 5; i++ {
+		name, conn := visitBackend(t, router, "alice")
+		conn.Close()
+		if name != pinned {
+			t.Fatalf("Visitor moved from %s to %s", pinned, name)
+		}
+	}
+
+	// Removing the pinned server moves the visitor to a remaining one
+	clients[pinned].Close()
+	waitFor(t, "server removal", func() bool {
+		return len(router.lookupAll("backend")) == 2
+	})
+	name, _ := visitBackend(t, router, "alice")
+	if name == pinned {
+		t.Fatalf("Visitor still routed to removed server %s", pinned)
+	}
+}
+
+func TestLoadBalanceRemovesMembers(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+	clients := startBalancedServers(t, router, "server-a", "server-b")
+
+	clients["server-a"].Close()
+	waitFor(t, "server removal", func() bool {
+		return len(router.lookupAll("backend")) == 1
+	})
+	for i := 0; i < 3; i++ {
+		if name, conn := visitBackend(t, router, "alice"); name != "server-b" {
+			t.Fatalf("Visitor routed to %s after it deregistered", name)
+		} else {
+			conn.Close()
+		}
+	}
+
+	clients["server-b"].Close()
+	waitFor(t, "proxy removal", func() bool {
+		return router.lookup("backend") == nil
+	})
+}
+
+func TestRegisterReplacesSameRunID(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+	cfg := &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}
+
+	old, err := dialRouter(cfg, RoleServer, "run-1")
+	if err != nil {
+		t.Fatalf("Failed to register proxy: %v", err)
+	}
+	defer old.Close()
+	conn, err := dialRouter(cfg, RoleServer, "run-1")
+	if err != nil {
+		t.Fatalf("Failed to register proxy again: %v", err)
+	}
+	defer conn.Close()
+
+	if members := router.lookupAll("echo"); len(members) != 1 || members[0].ctlConn.RemoteAddr().String() != conn.LocalAddr().String() {
+		t.Fatalf("Expected the new control connection to replace the old one, got %d servers", len(members))
+	}
+	old.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ReadMsg(old); err == nil {
+		t.Fatal("Expected the replaced control connection to be closed")
+	}
+}
@@ -0,0 +1,364 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// defaultDialTimeout bounds the time spent connecting to the router or a local service
+	defaultDialTimeout = 10 * time.Second
+	// minReconnectBackoff is the first delay before re-registering a lost proxy
+	minReconnectBackoff = time.Second
+	// maxReconnectBackoff caps the delay between registration attempts
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// ClientConfig configures a tunnel client connecting to an STCP router
+type ClientConfig struct {
+	// RouterAddr is the router address, a TCP address or Unix socket path (see ParseAddr)
+	RouterAddr string
+	// SecretKey is used for authentication and encryption, it must match the router
+	SecretKey string
+	// ProxyName is the name of the exported proxy to register or visit
+	ProxyName string
+	// User, Namespace and Cluster identify this client for access control
+	User      string
+	Namespace string
+	Cluster   string
+	// AllowUsers lists the visitors allowed to reach the proxy, server side only
+	AllowUsers []string
+	// PoolCount is the number of idle work connections kept open at the
+	// router so that visitors are attached without a round trip, server side only
+	PoolCount int
+	// ProxyProtocol prepends a PROXY protocol header, ProxyProtocolV1 or
+	// ProxyProtocolV2, to the connections opened to the local service so that
+	// it sees the visitor address and identity, server side only
+	ProxyProtocol string
+	// UseEncryption controls whether to encrypt the traffic, it must match the router
+	UseEncryption bool
+	// TLS enables TLS 1.3 to the router, a certificate is presented when
+	// CertFile is set. The same value should be reused across dials so that
+	// the files are loaded once and reloaded on rotation.
+	TLS *TLSConfig
+	// DialTimeout bounds connection setup, zero means the default of 10s
+	DialTimeout time.Duration
+	// HeartbeatInterval is the time between pings on the control connection, zero means 10s
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is the time without a pong after which the control
+	// connection is considered dead and the proxy re-registered, zero means 30s
+	HeartbeatTimeout time.Duration
+}
+
+func (c *ClientConfig) dialTimeout() time.Duration {
+	if c.DialTimeout > 0 {
+		return c.DialTimeout
+	}
+	return defaultDialTimeout
+}
+
+// dialRouter connects to the router and completes the login handshake for
+// the given role, runID identifies the server for server and work roles
+func dialRouter(cfg *ClientConfig, role, runID string) (net.Conn, error) {
+	return dialRouterLogin(cfg, &Login{Role: role, RunID: runID})
+}
+
+// dialRouterLogin connects to the router and logs in with the identity of
+// cfg and the role specific fields of login
+func dialRouterLogin(cfg *ClientConfig, login *Login) (net.Conn, error) {
+	var l *tlsReloader
+	if cfg.TLS != nil {
+		var err error
+		if l, err = clientTLSReloader(cfg.TLS); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := dialTLS(cfg.RouterAddr, cfg.dialTimeout(), l, quicConfig(cfg.HeartbeatInterval, cfg.HeartbeatTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to router %s: %w", cfg.RouterAddr, err)
+	}
+
+	login.ProxyName = cfg.ProxyName
+	login.User = cfg.User
+	login.Namespace = cfg.Namespace
+	login.Cluster = cfg.Cluster
+	login.AllowUsers = cfg.AllowUsers
+	login.PoolCount = cfg.PoolCount
+	login.Sign(cfg.SecretKey)
+
+	conn.SetDeadline(time.Now().Add(cfg.dialTimeout() + workConnTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := WriteMsg(conn, TypeLogin, login); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send login: %w", err)
+	}
+	var resp LoginResp
+	if err := ReadMsgInto(conn, TypeLoginResp, &resp); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read login response: %w", err)
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, fmt.Errorf("router rejected %s login for proxy %s: %s", login.Role, cfg.ProxyName, resp.Error)
+	}
+	return conn, nil
+}
+
+// wrapStream applies the configured stream encryption to a data connection
+func wrapStream(cfg *ClientConfig, conn net.Conn) (net.Conn, error) {
+	if !cfg.UseEncryption {
+		return conn, nil
+	}
+	stream, err := newEncryptedStream(conn, []byte(cfg.SecretKey))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// DialVisitor opens a stream to the proxy named in cfg through the router
+func DialVisitor(cfg *ClientConfig) (net.Conn, error) {
+	return dialVisitor(cfg, "")
+}
+
+// dialVisitor opens a visitor stream on behalf of the client at addr, which
+// the router passes on for the PROXY protocol header
+func dialVisitor(cfg *ClientConfig, addr string) (net.Conn, error) {
+	conn, err := dialRouterLogin(cfg, &Login{Role: RoleVisitor, Addr: addr})
+	if err != nil {
+		return nil, err
+	}
+	return wrapStream(cfg, conn)
+}
+
+// ServerClient registers an exported proxy at the router and forwards
+// visitor streams to a local service. The proxy is registered again when
+// the control connection is lost. Several server clients may register the
+// same proxy name, the router balances visitors between them.
+type ServerClient struct {
+	config    *ClientConfig
+	localAddr string
+	runID     string
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu      sync.Mutex
+	ctlConn net.Conn
+}
+
+// NewServerClient creates a server client forwarding to localAddr
+func NewServerClient(config *ClientConfig, localAddr string) *ServerClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ServerClient{
+		config:    config,
+		localAddr: localAddr,
+		runID:     generateConnID(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Start registers the proxy and serves work connection requests in the background
+func (c *ServerClient) Start() error {
+	conn, err := dialRouter(c.config, RoleServer, c.runID)
+	if err != nil {
+		return err
+	}
+	c.setCtlConn(conn)
+	go c.run(conn)
+	return nil
+}
+
+// Close deregisters the proxy by closing the control connection
+func (c *ServerClient) Close() {
+	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctlConn != nil {
+		c.ctlConn.Close()
+	}
+}
+
+// setCtlConn replaces the control connection, it is closed right away if
+// the client was closed meanwhile
+func (c *ServerClient) setCtlConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctlConn = conn
+	if c.ctx.Err() != nil {
+		conn.Close()
+	}
+}
+
+// run serves the control connection and re-registers the proxy with
+// backoff whenever it is lost, until the client is closed
+func (c *ServerClient) run(conn net.Conn) {
+	for {
+		c.serve(conn)
+
+		backoff := minReconnectBackoff
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			var err error
+			if conn, err = dialRouter(c.config, RoleServer, c.runID); err == nil {
+				break
+			}
+			klog.Warningf("Failed to re-register proxy %s, retrying in %v: %v", c.config.ProxyName, backoff, err)
+			backoff *= 2
+			if backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
+			}
+		}
+		klog.Infof("Proxy %s re-registered at %s", c.config.ProxyName, c.config.RouterAddr)
+		c.setCtlConn(conn)
+	}
+}
+
+// serve sends heartbeats and reads control messages until the control
+// connection is closed or the router stops answering
+func (c *ServerClient) serve(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	go sendHeartbeats(ctx, heartbeatInterval(c.config.HeartbeatInterval), func() error {
+		return WriteMsg(conn, TypePing, &Ping{})
+	})
+
+	timeout := heartbeatTimeout(c.config.HeartbeatTimeout)
+	for {
+		typ, _, err := readMsgWithTimeout(conn, timeout)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			if isHeartbeatTimeout(err) {
+				klog.Warningf("Router %s sent no heartbeat for %v, re-registering proxy %s", c.config.RouterAddr, timeout, c.config.ProxyName)
+			} else {
+				klog.Warningf("Control connection of proxy %s closed: %v", c.config.ProxyName, err)
+			}
+			return
+		}
+		switch typ {
+		case TypeNewWorkConn:
+			go c.handleWorkConn()
+		case TypePong:
+		default:
+			klog.Warningf("Unexpected control message %q for proxy %s", typ, c.config.ProxyName)
+		}
+	}
+}
+
+// handleWorkConn opens a work connection and joins it with the local service
+// once the router attaches a visitor
+func (c *ServerClient) handleWorkConn() {
+	conn, err := dialRouter(c.config, RoleWork, c.runID)
+	if err != nil {
+		klog.Warningf("Failed to open work connection for proxy %s: %v", c.config.ProxyName, err)
+		return
+	}
+
+	var start StartWorkConn
+	if err := ReadMsgInto(conn, TypeStartWorkConn, &start); err != nil {
+		conn.Close()
+		return
+	}
+
+	local, err := net.DialTimeout("tcp", c.localAddr, c.config.dialTimeout())
+	if err != nil {
+		klog.Warningf("Failed to connect to local service %s of proxy %s: %v", c.localAddr, c.config.ProxyName, err)
+		conn.Close()
+		return
+	}
+	if c.config.ProxyProtocol != "" {
+		header, err := proxyProtocolHeader(c.config.ProxyProtocol, start.SrcAddr, local.RemoteAddr(), start.Visitor)
+		if err == nil {
+			_, err = local.Write(header)
+		}
+		if err != nil {
+			klog.Warningf("Failed to send PROXY protocol header to %s of proxy %s: %v", c.localAddr, c.config.ProxyName, err)
+			local.Close()
+			conn.Close()
+			return
+		}
+	}
+
+	stream, err := wrapStream(c.config, conn)
+	if err != nil {
+		local.Close()
+		return
+	}
+	join(stream, local)
+}
+
+// VisitorClient listens on a local address and forwards every accepted
+// connection to a proxy through the router
+type VisitorClient struct {
+	config   *ClientConfig
+	bindAddr string
+	listener net.Listener
+}
+
+// NewVisitorClient creates a visitor client listening on bindAddr
+func NewVisitorClient(config *ClientConfig, bindAddr string) *VisitorClient {
+	return &VisitorClient{
+		config:   config,
+		bindAddr: bindAddr,
+	}
+}
+
+// Start binds the local address and forwards connections in the background
+func (c *VisitorClient) Start() error {
+	ln, err := net.Listen("tcp", c.bindAddr)
+	if err != nil {
+		return err
+	}
+	c.listener = ln
+	go c.run()
+	return nil
+}
+
+// Addr returns the bound local address
+func (c *VisitorClient) Addr() net.Addr {
+	return c.listener.Addr()
+}
+
+// Close stops accepting local connections
+func (c *VisitorClient) Close() {
+	if c.listener != nil {
+		c.listener.Close()
+	}
+}
+
+// run accepts local connections until the listener is closed
+func (c *VisitorClient) run() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleConn(conn)
+	}
+}
+
+// handleConn forwards a local connection through the router
+func (c *VisitorClient) handleConn(conn net.Conn) {
+	remote, err := dialVisitor(c.config, conn.RemoteAddr().String())
+	if err != nil {
+		klog.Warningf("Failed to visit proxy %s: %v", c.config.ProxyName, err)
+		conn.Close()
+		return
+	}
+	join(conn, remote)
+}
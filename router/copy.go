@@ -0,0 +1,142 @@
+package router
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// copyBufferSize is the size of the pooled buffers used when data has
+	// to pass through user space, e.g. for encryption
+	copyBufferSize = 32 * 1024
+	// copyChunkSize bounds the bytes moved by one zero-copy call, traffic
+	// counters are updated after every chunk of a bulk transfer
+	copyChunkSize = 1024 * 1024
+)
+
+// errNoHalfClose is returned by CloseWrite of streams over connections that
+// cannot be half-closed
+var errNoHalfClose = errors.New("connection does not support half-close")
+
+// copyBuffers pools the buffers of copyBuffer
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// closeWriter is implemented by connections that can shut down their write
+// side while still reading, e.g. *net.TCPConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// copyBuffer copies src to dst with a pooled buffer. Connections that can
+// move data in the kernel, e.g. TCP connections on Linux using splice, are
+// copied without the buffer.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// copyCounting copies src to dst, calling count with the bytes written.
+// Data passes through a pooled buffer and is counted read by read. Once a
+// read fills the buffer, i.e. a bulk transfer is in progress, and both sides
+// are plain TCP or Unix connections, the next copyChunkSize bytes are moved
+// in one call, which uses splice on Linux.
+func copyCounting(dst io.Writer, src io.Reader, count func(int64)) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	zeroCopy := canSplice(dst, src)
+
+	var total int64
+	for {
+		n, err := src.Read(*buf)
+		if n > 0 {
+			m, werr := dst.Write((*buf)[:n])
+			count(int64(m))
+			total += int64(m)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+
+		if zeroCopy && n == len(*buf) {
+			m, err := dst.(io.ReaderFrom).ReadFrom(&io.LimitedReader{R: src, N: copyChunkSize})
+			count(m)
+			total += m
+			if err != nil {
+				return total, err
+			}
+			if m < copyChunkSize {
+				return total, nil
+			}
+		}
+	}
+}
+
+// canSplice reports whether data can be moved from src to dst without
+// passing through user space
+func canSplice(dst io.Writer, src io.Reader) bool {
+	if _, ok := dst.(*net.TCPConn); !ok {
+		return false
+	}
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// join copies data in both directions. When one side finishes sending, only
+// the write side of the other is shut down, so protocols relying on TCP
+// half-close keep receiving the response. Both sides are closed once both
+// directions are done, or as soon as one fails or cannot be half-closed.
+func join(c1, c2 io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			c1.Close()
+			c2.Close()
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pipe(c2, c1, closeBoth)
+	}()
+	pipe(c1, c2, closeBoth)
+	<-done
+	closeBoth()
+}
+
+// pipe copies src to dst and half-closes dst at the end of src, abort is
+// called if the copy fails or dst cannot be half-closed. Counting streams
+// copy themselves so that the connections they wrap are used for zero-copy.
+func pipe(dst, src io.ReadWriteCloser, abort func()) {
+	var err error
+	if s, ok := src.(*countingStream); ok {
+		_, err = s.WriteTo(dst)
+	} else if s, ok := dst.(*countingStream); ok {
+		_, err = s.ReadFrom(src)
+	} else {
+		_, err = copyBuffer(dst, src)
+	}
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			return
+		}
+	}
+	abort()
+}
@@ -0,0 +1,182 @@
+package router
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("Failed to accept loopback connection")
+	}
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+// startHalfCloseServer starts a service that reads its request until EOF
+// and only then answers with the number of bytes received
+func startHalfCloseServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start local service: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				n, err := io.Copy(io.Discard, conn)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "received %d bytes", n)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// sendHalfClosed sends a request, shuts down the write side and returns the
+// complete response
+func sendHalfClosed(conn net.Conn, request []byte) (string, error) {
+	if _, err := conn.Write(request); err != nil {
+		return "", err
+	}
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		return "", fmt.Errorf("%T does not support half-close", conn)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(conn)
+	return string(resp), err
+}
+
+func TestJoinHalfClose(t *testing.T) {
+	client, routerSide := tcpPair(t)
+	serviceSide, service := tcpPair(t)
+	go join(routerSide, serviceSide)
+
+	go func() {
+		defer service.Close()
+		n, _ := io.Copy(io.Discard, service)
+		fmt.Fprintf(service, "received %d bytes", n)
+	}()
+
+	resp, err := sendHalfClosed(client, make([]byte, 100000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "received 100000 bytes" {
+		t.Fatalf("Unexpected response %q", resp)
+	}
+}
+
+func TestSTCPRouterHalfClose(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encryption=%v", encrypted), func(t *testing.T) {
+			router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", UseEncryption: encrypted})
+			startTestServerClient(t, &ClientConfig{
+				RouterAddr:    router.serverListener.Addr().String(),
+				SecretKey:     "test-secret-key",
+				ProxyName:     "half-close",
+				UseEncryption: encrypted,
+			}, startHalfCloseServer(t))
+
+			visitor := NewVisitorClient(&ClientConfig{
+				RouterAddr:    router.visitorListener.Addr().String(),
+				SecretKey:     "test-secret-key",
+				ProxyName:     "half-close",
+				UseEncryption: encrypted,
+			}, "127.0.0.1:0")
+			if err := visitor.Start(); err != nil {
+				t.Fatalf("Failed to start visitor: %v", err)
+			}
+			defer visitor.Close()
+
+			conn, err := net.Dial("tcp", visitor.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// The response is only sent after the request was half-closed
+			resp, err := sendHalfClosed(conn, make([]byte, 1<<20))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != fmt.Sprintf("received %d bytes", 1<<20) {
+				t.Fatalf("Unexpected response %q", resp)
+			}
+		})
+	}
+}
+
+// benchmarkJoin measures the throughput of a joined visitor stream, wrap
+// adapts the counted visitor side
+func benchmarkJoin(b *testing.B, wrap func(*countingStream) io.ReadWriteCloser) {
+	const size = 64 << 20
+	r := NewSTCPRouter(&STCPConfig{})
+	s := &session{proxyName: "bench"}
+	payload := make([]byte, 1<<20)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		source, visitor := tcpPair(b)
+		work, sink := tcpPair(b)
+		go join(wrap(r.newCountingStream(s, visitor, nil)), work)
+
+		go func() {
+			for sent := 0; sent < size; sent += len(payload) {
+				if _, err := source.Write(payload); err != nil {
+					break
+				}
+			}
+			source.CloseWrite()
+		}()
+		if n, err := io.Copy(io.Discard, sink); err != nil || n != size {
+			b.Fatalf("Copied %d bytes: %v", n, err)
+		}
+		source.Close()
+		sink.Close()
+	}
+}
+
+// BenchmarkJoin compares copying through user space, as join did before
+// with io.Copy over the counting wrapper, with the zero-copy path
+func BenchmarkJoin(b *testing.B) {
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkJoin(b, func(s *countingStream) io.ReadWriteCloser {
+			// hide WriteTo and ReadFrom so that every byte is read into a buffer
+			return struct{ io.ReadWriteCloser }{s}
+		})
+	})
+	b.Run("zerocopy", func(b *testing.B) {
+		benchmarkJoin(b, func(s *countingStream) io.ReadWriteCloser { return s })
+	})
+}
@@ -54,15 +54,25 @@ func Example() {
 		}
 	}()
 
-	// Connect to STCP server
-	serverConn, err := net.Dial("tcp", "127.0.0.1:7000")
-	if err != nil {
-		log.Fatalf("Failed to connect to STCP server: %v", err)
+	// Register the echo server at the STCP router
+	serverClient := NewServerClient(&ClientConfig{
+		RouterAddr:    "127.0.0.1:7000",
+		SecretKey:     "your-secret-key",
+		ProxyName:     "echo",
+		UseEncryption: true,
+	}, "127.0.0.1:8000")
+	if err := serverClient.Start(); err != nil {
+		log.Fatalf("Failed to register echo server: %v", err)
 	}
-	defer serverConn.Close()
-
-	// Connect to STCP visitor
-	visitorConn, err := net.Dial("tcp", "127.0.0.1:7001")
+	defer serverClient.Close()
+
+	// Connect to the echo server through the STCP router
+	visitorConn, err := DialVisitor(&ClientConfig{
+		RouterAddr:    "127.0.0.1:7001",
+		SecretKey:     "your-secret-key",
+		ProxyName:     "echo",
+		UseEncryption: true,
+	})
 	if err != nil {
 		log.Fatalf("Failed to connect to STCP visitor: %v", err)
 	}
@@ -70,7 +80,7 @@ func Example() {
 
 	// Test data transfer
 	testData := []byte("Hello, STCP!")
-	_, err = serverConn.Write(testData)
+	_, err = visitorConn.Write(testData)
 	if err != nil {
 		log.Fatalf("Failed to write test data: %v", err)
 	}
@@ -134,25 +144,40 @@ func ExampleConcurrent() {
 		}
 	}()
 
+	// Register the echo server at the STCP router
+	serverClient := NewServerClient(&ClientConfig{
+		RouterAddr:    "127.0.0.1:7000",
+		SecretKey:     "your-secret-key",
+		ProxyName:     "echo",
+		UseEncryption: true,
+	}, "127.0.0.1:8000")
+	if err := serverClient.Start(); err != nil {
+		log.Fatalf("Failed to register echo server: %v", err)
+	}
+	defer serverClient.Close()
+
+	// Expose the echo server locally through a visitor client
+	visitorClient := NewVisitorClient(&ClientConfig{
+		RouterAddr:    "127.0.0.1:7001",
+		SecretKey:     "your-secret-key",
+		ProxyName:     "echo",
+		UseEncryption: true,
+	}, "127.0.0.1:8001")
+	if err := visitorClient.Start(); err != nil {
+		log.Fatalf("Failed to start visitor client: %v", err)
+	}
+	defer visitorClient.Close()
+
 	// Test concurrent connections
 	const numConnections = 10
 	done := make(chan bool)
 
 	for i := 0; i < numConnections; i++ {
 		go func(id int) {
-			// Connect to STCP server
-			serverConn, err := net.Dial("tcp", "127.0.0.1:7000")
-			if err != nil {
-				log.Printf("Failed to connect to STCP server: %v", err)
-				done <- true
-				return
-			}
-			defer serverConn.Close()
-
-			// Connect to STCP visitor
-			visitorConn, err := net.Dial("tcp", "127.0.0.1:7001")
+			// Connect to the local visitor client
+			visitorConn, err := net.Dial("tcp", "127.0.0.1:8001")
 			if err != nil {
-				log.Printf("Failed to connect to STCP visitor: %v", err)
+				log.Printf("Failed to connect to visitor client: %v", err)
 				done <- true
 				return
 			}
@@ -160,7 +185,7 @@ func ExampleConcurrent() {
 
 			// Test data transfer
 			testData := []byte(fmt.Sprintf("Hello, STCP! Connection %d", id))
-			_, err = serverConn.Write(testData)
+			_, err = visitorConn.Write(testData)
 			if err != nil {
 				log.Printf("Failed to write test data: %v", err)
 				done <- true
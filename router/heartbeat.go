@@ -0,0 +1,60 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// defaultHeartbeatInterval is the default time between two pings
+	defaultHeartbeatInterval = 10 * time.Second
+	// defaultHeartbeatTimeout is the default time without any message after
+	// which a control connection or peer link is considered dead
+	defaultHeartbeatTimeout = 30 * time.Second
+)
+
+// heartbeatInterval returns the configured ping interval or the default
+func heartbeatInterval(interval time.Duration) time.Duration {
+	if interval > 0 {
+		return interval
+	}
+	return defaultHeartbeatInterval
+}
+
+// heartbeatTimeout returns the configured heartbeat timeout or the default
+func heartbeatTimeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return defaultHeartbeatTimeout
+}
+
+// sendHeartbeats calls ping every interval until ctx is done or ping fails
+func sendHeartbeats(ctx context.Context, interval time.Duration, ping func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readMsgWithTimeout reads the next message, failing if none arrives within timeout
+func readMsgWithTimeout(conn net.Conn, timeout time.Duration) (byte, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	return ReadMsg(conn)
+}
+
+// isHeartbeatTimeout reports whether a read failed because the deadline passed
+func isHeartbeatTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,128 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestControlConnectionHeartbeatTimeout(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", HeartbeatTimeout: 200 * time.Millisecond})
+
+	// A server that registers but never sends heartbeats
+	conn, err := dialRouter(&ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, RoleServer, generateConnID())
+	if err != nil {
+		t.Fatalf("Failed to register proxy: %v", err)
+	}
+	defer conn.Close()
+	if router.lookup("echo") == nil {
+		t.Fatal("Expected proxy to be registered")
+	}
+
+	waitFor(t, "dead control connection to be closed", func() bool {
+		return router.lookup("echo") == nil
+	})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ReadMsg(conn); err == nil {
+		t.Fatal("Expected control connection to be closed by the router")
+	}
+}
+
+func TestServerClientHeartbeat(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", HeartbeatTimeout: 300 * time.Millisecond})
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr:        router.serverListener.Addr().String(),
+		SecretKey:         "test-secret-key",
+		ProxyName:         "echo",
+		HeartbeatInterval: 50 * time.Millisecond,
+		HeartbeatTimeout:  300 * time.Millisecond,
+	}, startEchoServer(t))
+
+	// The registration outlives several heartbeat timeouts
+	p := router.lookup("echo")
+	time.Sleep(time.Second)
+	if router.lookup("echo") != p {
+		t.Fatal("Expected proxy to stay registered while heartbeats are sent")
+	}
+}
+
+func TestServerClientReregisters(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+
+	// Drop the control connection from the router side
+	old := router.lookup("echo")
+	if !router.DeregisterProxy("echo") {
+		t.Fatal("Expected proxy to be registered")
+	}
+	waitFor(t, "re-registration", func() bool {
+		p := router.lookup("echo")
+		return p != nil && p != old
+	})
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit re-registered proxy: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello again!"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerHeartbeatTimeout(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{
+		SecretKey:         "test-secret-key",
+		Name:              "router-a",
+		HeartbeatInterval: 50 * time.Millisecond,
+		HeartbeatTimeout:  300 * time.Millisecond,
+		Peers:             []PeerConfig{{Name: "router-x", Addr: "127.0.0.1:1"}},
+	})
+
+	// A peer that links but never answers
+	conn, err := Dial(router.serverListener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to router: %v", err)
+	}
+	defer conn.Close()
+	login := &Login{Role: RolePeer, User: "router-x"}
+	login.Sign("test-secret-key")
+	if err := WriteMsg(conn, TypeLogin, login); err != nil {
+		t.Fatalf("Failed to send login: %v", err)
+	}
+	var resp LoginResp
+	if err := ReadMsgInto(conn, TypeLoginResp, &resp); err != nil || resp.Error != "" {
+		t.Fatalf("Failed to link peer: %v %s", err, resp.Error)
+	}
+	waitFor(t, "peer link", func() bool { return router.isPeer("router-x") })
+
+	// The router pings the silent peer and drops the link once it times out
+	sawPing := false
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		typ, _, err := ReadMsg(conn)
+		if err != nil {
+			break
+		}
+		if typ == TypePing {
+			sawPing = true
+		}
+	}
+	if !sawPing {
+		t.Fatal("Expected router to ping the peer")
+	}
+	waitFor(t, "dead peer to be removed", func() bool { return !router.isPeer("router-x") })
+}
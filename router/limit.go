@@ -0,0 +1,309 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog"
+)
+
+// quotaSaveInterval is the time between saves of the quota usage
+const quotaSaveInterval = time.Minute
+
+// TrafficLimit limits the bandwidth and traffic volume of a proxy. Zero
+// values are unlimited.
+type TrafficLimit struct {
+	// Proxy is the proxy name the limit applies to, "*" applies to proxies
+	// without a limit of their own
+	Proxy string
+	// Bandwidth is the bytes per second all visitors of the proxy share in
+	// each direction
+	Bandwidth int64
+	// VisitorBandwidth is the bytes per second a single visitor identity may
+	// use in each direction, summed over its sessions
+	VisitorBandwidth int64
+	// DailyQuota and MonthlyQuota are the bytes, received and sent, the proxy
+	// may carry per local calendar day and month. New visitor streams are
+	// rejected once a quota is exhausted, streams in progress continue. The
+	// usage survives restarts only with STCPConfig.QuotaFile.
+	DailyQuota   int64
+	MonthlyQuota int64
+}
+
+// Quota periods
+const (
+	quotaDaily   = "daily"
+	quotaMonthly = "monthly"
+)
+
+// trafficLimit returns the limit of a proxy, or nil if it is unlimited
+func (r *STCPRouter) trafficLimit(proxyName string) *TrafficLimit {
+	var fallback *TrafficLimit
+	for i := range r.config.Limits {
+		l := &r.config.Limits[i]
+		switch l.Proxy {
+		case proxyName:
+			return l
+		case "*":
+			fallback = l
+		}
+	}
+	return fallback
+}
+
+// checkQuota returns an error if a quota of the proxy is exhausted
+func (r *STCPRouter) checkQuota(proxyName string) error {
+	l := r.trafficLimit(proxyName)
+	if l == nil || l.DailyQuota <= 0 && l.MonthlyQuota <= 0 {
+		return nil
+	}
+	day, month := r.trafficStats(proxyName).usage(time.Now())
+	quotaLimit.WithLabelValues(proxyName, quotaDaily).Set(float64(l.DailyQuota))
+	quotaLimit.WithLabelValues(proxyName, quotaMonthly).Set(float64(l.MonthlyQuota))
+	quotaUsed.WithLabelValues(proxyName, quotaDaily).Set(float64(day))
+	quotaUsed.WithLabelValues(proxyName, quotaMonthly).Set(float64(month))
+	if l.DailyQuota > 0 && day >= l.DailyQuota {
+		quotaRejections.WithLabelValues(proxyName, quotaDaily).Inc()
+		return fmt.Errorf("daily traffic quota of proxy %s exhausted", proxyName)
+	}
+	if l.MonthlyQuota > 0 && month >= l.MonthlyQuota {
+		quotaRejections.WithLabelValues(proxyName, quotaMonthly).Inc()
+		return fmt.Errorf("monthly traffic quota of proxy %s exhausted", proxyName)
+	}
+	return nil
+}
+
+// bandwidthLimiter is a token bucket per direction
+type bandwidthLimiter struct {
+	in, out *rate.Limiter
+	// refs counts the sessions using a visitor limiter
+	refs int
+}
+
+// newBandwidthLimiter allows bytesPerSecond in each direction with bursts
+// of one second, and at least of one copy buffer
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	burst := int(bytesPerSecond)
+	if burst < copyBufferSize {
+		burst = copyBufferSize
+	}
+	return &bandwidthLimiter{
+		in:  rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+		out: rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+	}
+}
+
+// limiters holds the bandwidth limiters of the proxies and visitors
+type limiters struct {
+	mu       sync.Mutex
+	proxies  map[string]*bandwidthLimiter
+	visitors map[string]*bandwidthLimiter
+}
+
+// sessionLimiters returns the limiters a session is throttled by and a
+// function releasing them when the session ends
+func (r *STCPRouter) sessionLimiters(s *session) ([]*bandwidthLimiter, func()) {
+	l := r.trafficLimit(s.proxyName)
+	if l == nil || l.Bandwidth <= 0 && l.VisitorBandwidth <= 0 {
+		return nil, func() {}
+	}
+
+	r.limiters.mu.Lock()
+	defer r.limiters.mu.Unlock()
+	var result []*bandwidthLimiter
+	if l.Bandwidth > 0 {
+		if r.limiters.proxies == nil {
+			r.limiters.proxies = make(map[string]*bandwidthLimiter)
+		}
+		p := r.limiters.proxies[s.proxyName]
+		if p == nil {
+			p = newBandwidthLimiter(l.Bandwidth)
+			r.limiters.proxies[s.proxyName] = p
+			bandwidthLimit.WithLabelValues(s.proxyName, "proxy").Set(float64(l.Bandwidth))
+		}
+		result = append(result, p)
+	}
+	if l.VisitorBandwidth <= 0 {
+		return result, func() {}
+	}
+
+	key := s.proxyName + "|" + s.visitor.String()
+	if r.limiters.visitors == nil {
+		r.limiters.visitors = make(map[string]*bandwidthLimiter)
+	}
+	v := r.limiters.visitors[key]
+	if v == nil {
+		v = newBandwidthLimiter(l.VisitorBandwidth)
+		r.limiters.visitors[key] = v
+		bandwidthLimit.WithLabelValues(s.proxyName, "visitor").Set(float64(l.VisitorBandwidth))
+	}
+	v.refs++
+	return append(result, v), func() {
+		r.limiters.mu.Lock()
+		defer r.limiters.mu.Unlock()
+		if v.refs--; v.refs == 0 {
+			delete(r.limiters.visitors, key)
+		}
+	}
+}
+
+// throttle waits until n bytes may pass in a direction, in reports whether
+// the bytes were received from the visitor
+func throttle(ctx context.Context, proxyName string, bucket []*bandwidthLimiter, in bool, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	start := time.Now()
+	for _, b := range bucket {
+		l := b.out
+		if in {
+			l = b.in
+		}
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		throttledSeconds.WithLabelValues(proxyName).Add(waited.Seconds())
+	}
+	return nil
+}
+
+// throttledReader waits for its limiters after every read. Reads are capped
+// at a copy buffer so that they never exceed the bursts.
+type throttledReader struct {
+	r       io.Reader
+	ctx     context.Context
+	proxy   string
+	buckets []*bandwidthLimiter
+	in      bool
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > copyBufferSize {
+		p = p[:copyBufferSize]
+	}
+	n, err := t.r.Read(p)
+	if werr := throttle(t.ctx, t.proxy, t.buckets, t.in, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// quotaUsage is the traffic of a proxy in the current day and month as kept
+// in the quota file
+type quotaUsage struct {
+	Date     string `json:"date"`
+	DayIn    int64  `json:"dayIn"`
+	DayOut   int64  `json:"dayOut"`
+	Month    string `json:"month"`
+	MonthIn  int64  `json:"monthIn"`
+	MonthOut int64  `json:"monthOut"`
+}
+
+// periodUsage returns the traffic of the most recent day and month
+func (s *trafficStats) periodUsage() quotaUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := quotaUsage{Month: s.month, MonthIn: s.monthIn, MonthOut: s.monthOut}
+	if len(s.days) > 0 {
+		u.Date, u.DayIn, u.DayOut = s.days[0].Date, s.days[0].In, s.days[0].Out
+	}
+	return u
+}
+
+// restoreUsage adds the saved traffic of a day and month to the accounting,
+// usage of past periods is ignored by usage
+func (s *trafficStats) restoreUsage(u quotaUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u.Date != "" && len(s.days) == 0 {
+		s.days = []DailyTraffic{{Date: u.Date, In: u.DayIn, Out: u.DayOut}}
+	}
+	if u.Month != "" && s.month == "" {
+		s.month, s.monthIn, s.monthOut = u.Month, u.MonthIn, u.MonthOut
+	}
+}
+
+// StartQuotaUsage restores the traffic saved in the quota file and saves it
+// every minute and when the router is closed, so that a restart does not
+// reset the quotas
+func (r *STCPRouter) StartQuotaUsage() error {
+	if r.config.QuotaFile == "" {
+		return nil
+	}
+	err := r.loadQuotaUsage()
+	go func() {
+		ticker := time.NewTicker(quotaSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.saveQuotaUsage(); err != nil {
+					klog.Warningf("Failed to save quota usage: %v", err)
+				}
+			}
+		}
+	}()
+	return err
+}
+
+// loadQuotaUsage restores the traffic of the quota file, a missing file is
+// not an error
+func (r *STCPRouter) loadQuotaUsage() error {
+	data, err := os.ReadFile(r.config.QuotaFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read quota usage: %v", err)
+	}
+	var saved map[string]quotaUsage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid quota usage %s: %v", r.config.QuotaFile, err)
+	}
+	for proxyName, u := range saved {
+		r.trafficStats(proxyName).restoreUsage(u)
+	}
+	return nil
+}
+
+// saveQuotaUsage replaces the quota file by the current traffic
+func (r *STCPRouter) saveQuotaUsage() error {
+	usage := make(map[string]quotaUsage)
+	r.traffic.Range(func(key, value interface{}) bool {
+		usage[key.(string)] = value.(*trafficStats).periodUsage()
+		return true
+	})
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(r.config.QuotaFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// replace the file at once, a crash never leaves half of it
+	tmp, err := os.CreateTemp(dir, filepath.Base(r.config.QuotaFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.config.QuotaFile)
+}
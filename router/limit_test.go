@@ -0,0 +1,182 @@
+package router
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrafficLimitFallback(t *testing.T) {
+	r := NewSTCPRouter(&STCPConfig{Limits: []TrafficLimit{
+		{Proxy: "*", Bandwidth: 1},
+		{Proxy: "echo", Bandwidth: 2},
+	}})
+	if l := r.trafficLimit("echo"); l == nil || l.Bandwidth != 2 {
+		t.Errorf("Limit of echo = %+v; want bandwidth 2", l)
+	}
+	if l := r.trafficLimit("other"); l == nil || l.Bandwidth != 1 {
+		t.Errorf("Limit of other = %+v; want bandwidth 1", l)
+	}
+	if l := NewSTCPRouter(&STCPConfig{}).trafficLimit("echo"); l != nil {
+		t.Errorf("Limit without limits = %+v; want nil", l)
+	}
+}
+
+func TestTrafficStatsUsage(t *testing.T) {
+	stats := &trafficStats{}
+	day := time.Date(2025, 5, 31, 12, 0, 0, 0, time.Local)
+	stats.add(day.Add(-24*time.Hour), 100, 10)
+	stats.add(day, 7, 3)
+
+	if d, m := stats.usage(day); d != 10 || m != 120 {
+		t.Errorf("Usage = %d/%d; want 10/120", d, m)
+	}
+	// A new month starts from zero
+	if d, m := stats.usage(day.Add(24 * time.Hour)); d != 0 || m != 0 {
+		t.Errorf("Usage next month = %d/%d; want 0/0", d, m)
+	}
+	stats.add(day.Add(24*time.Hour), 1, 1)
+	if _, m := stats.usage(day.Add(24 * time.Hour)); m != 2 {
+		t.Errorf("Monthly usage = %d; want 2", m)
+	}
+}
+
+func TestCountingStreamThrottledRead(t *testing.T) {
+	r := NewSTCPRouter(&STCPConfig{})
+	s := &session{proxyName: "counted"}
+	source, visitor := tcpPair(t)
+	defer source.Close()
+	stream := r.newCountingStream(s, visitor, []*bandwidthLimiter{newBandwidthLimiter(1 << 20)})
+	defer stream.Close()
+
+	if _, err := source.Write([]byte("Hello, limiter!")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := io.ReadAtLeast(stream, buf, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Throttled reads count toward the traffic and the quotas as well
+	if in := atomic.LoadInt64(&s.bytesIn); in != int64(n) {
+		t.Errorf("Session bytes in = %d; want %d", in, n)
+	}
+	if daily, _ := r.trafficStats("counted").usage(time.Now()); daily != int64(n) {
+		t.Errorf("Daily usage = %d; want %d", daily, n)
+	}
+}
+
+func TestSTCPRouterBandwidthLimit(t *testing.T) {
+	const bandwidth = 32 * 1024
+	router := startTestRouter(t, &STCPConfig{
+		SecretKey: "test-secret-key",
+		Limits:    []TrafficLimit{{Proxy: "limited", VisitorBandwidth: bandwidth}},
+	})
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "limited",
+		AllowUsers: []string{"*"},
+	}, startEchoServer(t))
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "limited",
+		User:       "alice",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy: %v", err)
+	}
+
+	// One burst passes at once, the remaining two take about two seconds
+	start := time.Now()
+	if err := echo(conn, strings.Repeat("x", 3*bandwidth)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("Transfer took %v; want about 2s", elapsed)
+	}
+
+	// The visitor limiter is released with its last session
+	conn.Close()
+	waitFor(t, "visitor limiter release", func() bool {
+		router.limiters.mu.Lock()
+		defer router.limiters.mu.Unlock()
+		return len(router.limiters.visitors) == 0
+	})
+}
+
+func TestSTCPRouterQuota(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{
+		SecretKey: "test-secret-key",
+		Limits:    []TrafficLimit{{Proxy: "quota-echo", DailyQuota: 20}},
+	})
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "quota-echo",
+		AllowUsers: []string{"*"},
+	}, startEchoServer(t))
+	visitor := &ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "quota-echo",
+		User:       "alice",
+	}
+
+	conn, err := DialVisitor(visitor)
+	if err != nil {
+		t.Fatalf("Failed to visit proxy: %v", err)
+	}
+	// 15 bytes in and out exhaust the quota, the stream itself continues
+	if err := echo(conn, "Hello, quota!!!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(conn, "still open"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	rejections := counterValue(quotaRejections.WithLabelValues("quota-echo", quotaDaily))
+	failures := counterValue(handshakeFailures.WithLabelValues("quota-echo", failureQuota))
+	if _, err := DialVisitor(visitor); err == nil {
+		t.Fatal("Expected visitor to be rejected after the quota was exhausted")
+	}
+	if got := counterValue(quotaRejections.WithLabelValues("quota-echo", quotaDaily)) - rejections; got != 1 {
+		t.Errorf("Quota rejections = %v; want 1", got)
+	}
+	if got := counterValue(handshakeFailures.WithLabelValues("quota-echo", failureQuota)) - failures; got != 1 {
+		t.Errorf("Handshake failures = %v; want 1", got)
+	}
+}
+
+func TestQuotaUsageRestart(t *testing.T) {
+	config := &STCPConfig{
+		Limits:    []TrafficLimit{{Proxy: "echo", DailyQuota: 100, MonthlyQuota: 1000}},
+		QuotaFile: filepath.Join(t.TempDir(), "state", "router-quota.json"),
+	}
+	r := NewSTCPRouter(config)
+	if err := r.StartQuotaUsage(); err != nil {
+		t.Fatalf("Failed to start without a quota file: %v", err)
+	}
+	now := time.Now()
+	r.trafficStats("echo").add(now, 60, 40)
+	r.Close()
+
+	// A restarted router continues with the saved usage
+	restarted := NewSTCPRouter(config)
+	if err := restarted.StartQuotaUsage(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if day, month := restarted.trafficStats("echo").usage(now); day != 100 || month != 100 {
+		t.Errorf("Usage after restart = %d, %d; want 100, 100", day, month)
+	}
+	if err := restarted.checkQuota("echo"); err == nil || !strings.Contains(err.Error(), "daily traffic quota") {
+		t.Errorf("Expected the daily quota to stay exhausted after a restart, got %v", err)
+	}
+}
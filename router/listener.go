@@ -0,0 +1,142 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// UnixSocketOptions controls how Unix domain socket listeners are created
+type UnixSocketOptions struct {
+	// Mode is the file mode applied to the socket file, 0 keeps the umask default
+	Mode os.FileMode
+	// UID is the owner applied to the socket file, -1 keeps the current owner
+	UID int
+	// GID is the group applied to the socket file, -1 keeps the current group
+	GID int
+}
+
+// DefaultUnixSocketOptions returns options that keep the socket file as created
+func DefaultUnixSocketOptions() UnixSocketOptions {
+	return UnixSocketOptions{UID: -1, GID: -1}
+}
+
+// ParseAddr splits a listen address into network and address.
+// Supported forms are "unix:///tmp/router.sock", "unix:/tmp/router.sock",
+// an absolute path such as "/tmp/router.sock", "tcp://host:port", "host:port"
+// and "quic://host:port" for QUIC over UDP.
+func ParseAddr(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "/"):
+		return "unix", addr
+	case strings.HasPrefix(addr, "quic://"):
+		return "quic", strings.TrimPrefix(addr, "quic://")
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", strings.TrimPrefix(addr, "tcp://")
+	default:
+		return "tcp", addr
+	}
+}
+
+// Listen creates a listener for the given address, see ParseAddr for the
+// supported forms. Unix sockets get the file mode and ownership from opts,
+// and a stale socket file left behind by a dead process is removed first.
+// QUIC listeners accept every stream as a connection, present a
+// self-signed certificate and use the default heartbeat settings.
+func Listen(addr string, opts *UnixSocketOptions) (net.Listener, error) {
+	network, address := ParseAddr(addr)
+	switch network {
+	case "unix":
+		return listenUnix(address, opts)
+	case "quic":
+		return listenQUIC(address, nil, quicConfig(0, 0))
+	default:
+		return net.Listen(network, address)
+	}
+}
+
+// Dial connects to the given address, see ParseAddr for the supported forms.
+// Connections dialed to the same QUIC address are streams of one QUIC
+// connection, the router certificate is not verified.
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return dial(addr, timeout, quicConfig(0, 0))
+}
+
+// dial is Dial with the QUIC settings of the caller
+func dial(addr string, timeout time.Duration, quicConf *quic.Config) (net.Conn, error) {
+	network, address := ParseAddr(addr)
+	if network == "quic" {
+		return dialQUIC(address, address, insecureQUICConfig(), quicConf, timeout)
+	}
+	return net.DialTimeout(network, address, timeout)
+}
+
+// listenUnix listens on a Unix domain socket and applies the socket options
+func listenUnix(path string, opts *UnixSocketOptions) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("unix socket path is empty")
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts != nil {
+		if opts.Mode != 0 {
+			if err := os.Chmod(path, opts.Mode); err != nil {
+				ln.Close()
+				return nil, fmt.Errorf("failed to chmod unix socket %s: %w", path, err)
+			}
+		}
+		if opts.UID >= 0 || opts.GID >= 0 {
+			if err := os.Chown(path, opts.UID, opts.GID); err != nil {
+				ln.Close()
+				return nil, fmt.Errorf("failed to chown unix socket %s: %w", path, err)
+			}
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes a socket file nobody is listening on anymore.
+// It refuses to remove regular files and sockets that still accept connections.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat unix socket %s: %w", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s is already in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to probe unix socket %s: %w", path, err)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale unix socket %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package router
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+	}{
+		{"unix:///tmp/router.sock", "unix", "/tmp/router.sock"},
+		{"unix:/tmp/router.sock", "unix", "/tmp/router.sock"},
+		{"/tmp/router.sock", "unix", "/tmp/router.sock"},
+		{"tcp://127.0.0.1:7000", "tcp", "127.0.0.1:7000"},
+		{"127.0.0.1:7000", "tcp", "127.0.0.1:7000"},
+		{"quic://127.0.0.1:7000", "quic", "127.0.0.1:7000"},
+		{":7000", "tcp", ":7000"},
+	}
+
+	for _, tt := range tests {
+		network, address := ParseAddr(tt.addr)
+		if network != tt.network || address != tt.address {
+			t.Errorf("ParseAddr(%q) = %s, %s; want %s, %s", tt.addr, network, address, tt.network, tt.address)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+	opts := DefaultUnixSocketOptions()
+	opts.Mode = 0600
+
+	ln, err := Listen("unix://"+path, &opts)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket: %v", err)
+	}
+	defer ln.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat unix socket: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Socket mode = %v; want %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("ok"))
+		conn.Close()
+	}()
+
+	conn, err := Dial(path, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial unix socket: %v", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("Failed to read from unix socket: %v", err)
+	}
+	if string(buf) != "ok" {
+		t.Errorf("Data mismatch: got %s, want ok", string(buf))
+	}
+}
+
+func TestListenRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+
+	// Leave a socket file behind as a crashed process would
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Stale socket file missing: %v", err)
+	}
+
+	ln, err := Listen(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to listen over stale socket: %v", err)
+	}
+	ln.Close()
+}
+
+func TestListenRefusesActiveSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+
+	ln, err := Listen(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket: %v", err)
+	}
+	defer ln.Close()
+
+	if ln2, err := Listen(path, nil); err == nil {
+		ln2.Close()
+		t.Fatal("Expected error when socket is in use")
+	}
+}
+
+func TestListenRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if ln, err := Listen(path, nil); err == nil {
+		ln.Close()
+		t.Fatal("Expected error when path is a regular file")
+	}
+}
+
+func TestSTCPRouterServeListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+	router := NewSTCPRouter(&STCPConfig{SecretKey: "test-secret-key"})
+
+	if err := router.StartServer("unix://" + path); err != nil {
+		t.Fatalf("Failed to start server on unix socket: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	router.ServeVisitor(ln)
+
+	if router.serverListener.Addr().Network() != "unix" {
+		t.Errorf("Server listener network = %s; want unix", router.serverListener.Addr().Network())
+	}
+	if router.visitorListener != ln {
+		t.Error("Visitor listener was not taken over")
+	}
+
+	router.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Socket file not removed on close: %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package router
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// trafficHistoryDays is the number of days of traffic kept per proxy
+const trafficHistoryDays = 7
+
+var (
+	proxyBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicekeel_router_proxy_bytes_total",
+		Help: "Bytes transferred per proxy, direction in is received from visitors and out is sent to visitors",
+	}, []string{"proxy", "direction"})
+	proxyStreams = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicekeel_router_proxy_streams_total",
+		Help: "Number of visitor streams attached per proxy",
+	}, []string{"proxy"})
+	proxyActiveStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "servicekeel_router_proxy_active_streams",
+		Help: "Number of visitor streams currently open per proxy",
+	}, []string{"proxy"})
+	proxyPairingSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "servicekeel_router_proxy_pairing_seconds",
+		Help:    "Time from visitor login until a work connection is attached",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"proxy"})
+	handshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicekeel_router_handshake_failures_total",
+		Help: "Number of failed logins by proxy and reason, proxy is empty when the login was not authenticated",
+	}, []string{"proxy", "reason"})
+	proxyMembers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "servicekeel_router_proxy_servers",
+		Help: "Number of servers registered per proxy and balanced between",
+	}, []string{"proxy"})
+	proxyPoolSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "servicekeel_router_proxy_pool_size",
+		Help: "Number of idle work connections the router keeps per proxy, summed over its servers",
+	}, []string{"proxy"})
+	proxyPoolIdle = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "servicekeel_router_proxy_pool_idle",
+		Help: "Number of idle work connections currently queued per proxy",
+	}, []string{"proxy"})
+	proxyPoolRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicekeel_router_proxy_pool_requests_total",
+		Help: "Number of work connections taken per proxy, result is hit when an idle connection was ready and miss when the visitor waited for the server",
+	}, []string{"proxy", "result"})
+	heartbeatTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicekeel_router_heartbeat_timeouts_total",
+		Help: "Number of control connections and peer links closed for missing heartbeats, by role",
+	}, []string{"role"})
+	bandwidthLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "servicekeel_router_bandwidth_limit_bytes",
+		Help: "Bandwidth limit in bytes per second and direction per proxy, scope is proxy for all visitors and visitor for each visitor",
+	}, []string{"proxy", "scope"})
+	throttledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicekeel_router_throttled_seconds_total",
+		Help: "Time visitor streams waited for bandwidth limits per proxy",
+	}, []string{"proxy"})
+	quotaLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "servicekeel_router_quota_limit_bytes",
+		Help: "Traffic quota per proxy and period, daily or monthly",
+	}, []string{"proxy", "period"})
+	quotaUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "servicekeel_router_quota_used_bytes",
+		Help: "Traffic counted against the quota per proxy and period, updated when a visitor stream starts",
+	}, []string{"proxy", "period"})
+	quotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servicekeel_router_quota_rejections_total",
+		Help: "Number of visitor streams rejected for an exhausted quota per proxy and period",
+	}, []string{"proxy", "period"})
+)
+
+func init() {
+	prometheus.MustRegister(proxyBytes, proxyStreams, proxyActiveStreams, proxyPairingSeconds, handshakeFailures,
+		proxyMembers, proxyPoolSize, proxyPoolIdle, proxyPoolRequests, heartbeatTimeouts,
+		bandwidthLimit, throttledSeconds, quotaLimit, quotaUsed, quotaRejections)
+}
+
+// Handshake failure reasons
+const (
+	failureAuth     = "auth"
+	failureRole     = "role"
+	failureNotFound = "not_found"
+	failureDenied   = "denied"
+	failureRegister = "register"
+	failureWorkConn = "work_conn"
+	failureForward  = "forward"
+	failureQuota    = "quota"
+)
+
+// DailyTraffic is the traffic of a proxy during a single day
+type DailyTraffic struct {
+	// Date is the local date formatted as YYYY-MM-DD
+	Date string `json:"date"`
+	In   int64  `json:"trafficIn"`
+	Out  int64  `json:"trafficOut"`
+}
+
+// ProxyTraffic summarizes the traffic of a proxy
+type ProxyTraffic struct {
+	Name               string         `json:"proxyName"`
+	BytesIn            int64          `json:"bytesIn"`
+	BytesOut           int64          `json:"bytesOut"`
+	TodayTrafficIn     int64          `json:"todayTrafficIn"`
+	TodayTrafficOut    int64          `json:"todayTrafficOut"`
+	MonthTrafficIn     int64          `json:"monthTrafficIn"`
+	MonthTrafficOut    int64          `json:"monthTrafficOut"`
+	CurrentConnections int64          `json:"currentConnections"`
+	Days               []DailyTraffic `json:"days"`
+}
+
+// trafficStats accounts the traffic of a single proxy
+type trafficStats struct {
+	active int64
+
+	mu       sync.Mutex
+	totalIn  int64
+	totalOut int64
+	// days holds the most recent days first
+	days []DailyTraffic
+	// month is the current month formatted as YYYY-MM and its traffic
+	month    string
+	monthIn  int64
+	monthOut int64
+}
+
+// add accounts bytes to the day of now, rolling over to a new day if needed
+func (s *trafficStats) add(now time.Time, in, out int64) {
+	date := now.Format("2006-01-02")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totalIn += in
+	s.totalOut += out
+	if len(s.days) == 0 || s.days[0].Date != date {
+		s.days = append([]DailyTraffic{{Date: date}}, s.days...)
+		if len(s.days) > trafficHistoryDays {
+			s.days = s.days[:trafficHistoryDays]
+		}
+	}
+	s.days[0].In += in
+	s.days[0].Out += out
+	if month := date[:7]; s.month != month {
+		s.month, s.monthIn, s.monthOut = month, 0, 0
+	}
+	s.monthIn += in
+	s.monthOut += out
+}
+
+// usage returns the bytes received and sent today and this month as of now
+func (s *trafficStats) usage(now time.Time) (day, month int64) {
+	date := now.Format("2006-01-02")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.days) > 0 && s.days[0].Date == date {
+		day = s.days[0].In + s.days[0].Out
+	}
+	if s.month == date[:7] {
+		month = s.monthIn + s.monthOut
+	}
+	return day, month
+}
+
+// snapshot returns the traffic summary as of now
+func (s *trafficStats) snapshot(name string, now time.Time) ProxyTraffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := ProxyTraffic{
+		Name:               name,
+		BytesIn:            s.totalIn,
+		BytesOut:           s.totalOut,
+		CurrentConnections: atomic.LoadInt64(&s.active),
+		Days:               append([]DailyTraffic(nil), s.days...),
+	}
+	if len(s.days) > 0 && s.days[0].Date == now.Format("2006-01-02") {
+		t.TodayTrafficIn = s.days[0].In
+		t.TodayTrafficOut = s.days[0].Out
+	}
+	if s.month == now.Format("2006-01") {
+		t.MonthTrafficIn = s.monthIn
+		t.MonthTrafficOut = s.monthOut
+	}
+	return t
+}
+
+// trafficStats returns the traffic accounting of a proxy, creating it if needed
+func (r *STCPRouter) trafficStats(proxyName string) *trafficStats {
+	value, _ := r.traffic.LoadOrStore(proxyName, &trafficStats{})
+	return value.(*trafficStats)
+}
+
+// Traffic returns the traffic summary of every proxy that carried a stream
+func (r *STCPRouter) Traffic() []ProxyTraffic {
+	now := time.Now()
+	var result []ProxyTraffic
+	r.traffic.Range(func(key, value interface{}) bool {
+		result = append(result, value.(*trafficStats).snapshot(key.(string), now))
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// ProxyTraffic returns the traffic summary of a single proxy
+func (r *STCPRouter) ProxyTraffic(proxyName string) (ProxyTraffic, bool) {
+	value, ok := r.traffic.Load(proxyName)
+	if !ok {
+		return ProxyTraffic{}, false
+	}
+	return value.(*trafficStats).snapshot(proxyName, time.Now()), true
+}
+
+// recordHandshakeFailure counts a failed login
+func recordHandshakeFailure(proxyName, reason string) {
+	handshakeFailures.WithLabelValues(proxyName, reason).Inc()
+}
+
+// countingStream accounts the bytes of a visitor stream to its session and proxy
+// and throttles it by the bandwidth limiters of the session
+type countingStream struct {
+	io.ReadWriteCloser
+	session *session
+	stats   *trafficStats
+	in      prometheus.Counter
+	out     prometheus.Counter
+	ctx     context.Context
+	buckets []*bandwidthLimiter
+}
+
+// newCountingStream wraps the visitor side of a session, buckets may be nil
+func (r *STCPRouter) newCountingStream(s *session, visitor io.ReadWriteCloser, buckets []*bandwidthLimiter) *countingStream {
+	return &countingStream{
+		ReadWriteCloser: visitor,
+		session:         s,
+		stats:           r.trafficStats(s.proxyName),
+		in:              proxyBytes.WithLabelValues(s.proxyName, "in"),
+		out:             proxyBytes.WithLabelValues(s.proxyName, "out"),
+		ctx:             r.ctx,
+		buckets:         buckets,
+	}
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	var src io.Reader = s.ReadWriteCloser
+	if len(s.buckets) > 0 {
+		src = s.throttled(src, true)
+	}
+	n, err := src.Read(p)
+	s.countIn(n)
+	return n, err
+}
+
+func (s *countingStream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(s.buckets) > 0 && len(chunk) > copyBufferSize {
+			chunk = chunk[:copyBufferSize]
+		}
+		if err := throttle(s.ctx, s.session.proxyName, s.buckets, false, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := s.ReadWriteCloser.Write(chunk)
+		s.countOut(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// WriteTo copies the visitor stream to w, handing the wrapped connection to
+// copyCounting so that it can be moved without copying unless throttled
+func (s *countingStream) WriteTo(w io.Writer) (int64, error) {
+	var src io.Reader = s.ReadWriteCloser
+	if len(s.buckets) > 0 {
+		src = s.throttled(src, true)
+	}
+	return copyCounting(w, src, func(n int64) { s.countIn(int(n)) })
+}
+
+// ReadFrom copies r to the visitor stream, see WriteTo
+func (s *countingStream) ReadFrom(r io.Reader) (int64, error) {
+	if len(s.buckets) > 0 {
+		r = s.throttled(r, false)
+	}
+	return copyCounting(s.ReadWriteCloser, r, func(n int64) { s.countOut(int(n)) })
+}
+
+// throttled wraps a reader of one direction of the stream with the limiters
+func (s *countingStream) throttled(r io.Reader, in bool) io.Reader {
+	return &throttledReader{r: r, ctx: s.ctx, proxy: s.session.proxyName, buckets: s.buckets, in: in}
+}
+
+// CloseWrite shuts down the write side of the visitor stream if supported
+func (s *countingStream) CloseWrite() error {
+	if cw, ok := s.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+// countIn accounts bytes received from the visitor
+func (s *countingStream) countIn(n int) {
+	if n > 0 {
+		s.in.Add(float64(n))
+		atomic.AddInt64(&s.session.bytesIn, int64(n))
+		s.stats.add(time.Now(), int64(n), 0)
+	}
+}
+
+// countOut accounts bytes sent to the visitor
+func (s *countingStream) countOut(n int) {
+	if n > 0 {
+		s.out.Add(float64(n))
+		atomic.AddInt64(&s.session.bytesOut, int64(n))
+		s.stats.add(time.Now(), 0, int64(n))
+	}
+}
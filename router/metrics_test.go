@@ -0,0 +1,127 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue reads a counter, tests compare it before and after an action
+// as the counters are global and keep counting across test runs
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func TestTrafficStatsDailyRollup(t *testing.T) {
+	stats := &trafficStats{}
+	day := time.Date(2025, 5, 4, 23, 0, 0, 0, time.Local)
+
+	stats.add(day, 100, 10)
+	stats.add(day.Add(30*time.Minute), 50, 5)
+	stats.add(day.Add(2*time.Hour), 7, 3)
+
+	got := stats.snapshot("echo", day.Add(2*time.Hour))
+	if got.BytesIn != 157 || got.BytesOut != 18 {
+		t.Errorf("Totals = %d/%d; want 157/18", got.BytesIn, got.BytesOut)
+	}
+	if got.TodayTrafficIn != 7 || got.TodayTrafficOut != 3 {
+		t.Errorf("Today = %d/%d; want 7/3", got.TodayTrafficIn, got.TodayTrafficOut)
+	}
+	if len(got.Days) != 2 || got.Days[1].Date != "2025-05-04" || got.Days[1].In != 150 {
+		t.Errorf("Unexpected days: %+v", got.Days)
+	}
+
+	// Nothing today yet
+	got = stats.snapshot("echo", day.Add(48*time.Hour))
+	if got.TodayTrafficIn != 0 || got.TodayTrafficOut != 0 {
+		t.Errorf("Today = %d/%d; want 0/0", got.TodayTrafficIn, got.TodayTrafficOut)
+	}
+
+	// History is capped
+	for i := 0; i < 2*trafficHistoryDays; i++ {
+		stats.add(day.Add(time.Duration(i+3)*24*time.Hour), 1, 1)
+	}
+	if len(stats.days) != trafficHistoryDays {
+		t.Errorf("Kept %d days; want %d", len(stats.days), trafficHistoryDays)
+	}
+}
+
+func TestSTCPRouterTraffic(t *testing.T) {
+	config := &STCPConfig{SecretKey: "test-secret-key"}
+	router := startTestRouter(t, config)
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  config.SecretKey,
+		ProxyName:  "traffic-echo",
+		User:       "backend",
+		AllowUsers: []string{"alice"},
+	}, startEchoServer(t))
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  config.SecretKey,
+		ProxyName:  "traffic-echo",
+		User:       "alice",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy: %v", err)
+	}
+	if err := echo(conn, "Hello, traffic!"); err != nil {
+		t.Fatal(err)
+	}
+
+	traffic, ok := router.ProxyTraffic("traffic-echo")
+	if !ok {
+		t.Fatal("No traffic recorded")
+	}
+	if traffic.BytesIn != 15 || traffic.BytesOut != 15 || traffic.TodayTrafficIn != 15 {
+		t.Errorf("Unexpected traffic: %+v", traffic)
+	}
+	if traffic.CurrentConnections != 1 {
+		t.Errorf("CurrentConnections = %d; want 1", traffic.CurrentConnections)
+	}
+
+	conn.Close()
+	waitFor(t, "stream close", func() bool {
+		traffic, _ := router.ProxyTraffic("traffic-echo")
+		return traffic.CurrentConnections == 0
+	})
+
+	// Denied visitors are counted as handshake failures
+	failures := counterValue(handshakeFailures.WithLabelValues("traffic-echo", failureDenied))
+	if _, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  config.SecretKey,
+		ProxyName:  "traffic-echo",
+		User:       "bob",
+	}); err == nil {
+		t.Fatal("Expected visitor to be rejected")
+	}
+	if got := counterValue(handshakeFailures.WithLabelValues("traffic-echo", failureDenied)) - failures; got != 1 {
+		t.Errorf("Handshake failures = %v; want 1", got)
+	}
+
+	// Traffic API
+	rec := httptest.NewRecorder()
+	router.TrafficHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/traffic?proxy=traffic-echo", nil))
+	var got ProxyTraffic
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode traffic: %v", err)
+	}
+	if got.Name != "traffic-echo" || got.BytesIn != 15 {
+		t.Errorf("Unexpected traffic response: %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	router.TrafficHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/traffic?proxy=missing", nil))
+	if rec.Code != 404 {
+		t.Errorf("Status = %d; want 404", rec.Code)
+	}
+}
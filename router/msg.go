@@ -0,0 +1,150 @@
+package router
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Message types exchanged between the router and its clients
+const (
+	TypeLogin         byte = 'o'
+	TypeLoginResp     byte = '1'
+	TypeNewWorkConn   byte = 'w'
+	TypeStartWorkConn byte = 's'
+	TypeProxyList     byte = 'l'
+	TypeGoAway        byte = 'g'
+	TypePing          byte = 'h'
+	TypePong          byte = '4'
+)
+
+// Connection roles announced in the login message
+const (
+	// RoleServer registers an exported proxy and keeps a control connection open
+	RoleServer = "server"
+	// RoleWork carries a single visitor stream for a registered proxy
+	RoleWork = "work"
+	// RoleVisitor requests a stream to a registered proxy
+	RoleVisitor = "visitor"
+	// RolePeer links two routers so they can forward visitors to each other
+	RolePeer = "peer"
+)
+
+// maxMsgLength limits the size of a single protocol message
+const maxMsgLength = 64 * 1024
+
+// Login is the first message sent on every connection to the router
+type Login struct {
+	Role      string `json:"role"`
+	ProxyName string `json:"proxyName"`
+	// User, Namespace and Cluster identify the peer for access control
+	User      string `json:"user,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+	// AllowUsers lists the visitors allowed to reach the proxy, server role only
+	AllowUsers []string `json:"allowUsers,omitempty"`
+	// PoolCount is the number of idle work connections the router should keep, server role only
+	PoolCount int `json:"poolCount,omitempty"`
+	// RunID identifies a server across reconnects and ties its work
+	// connections to its control connection, server and work roles only
+	RunID string `json:"runId,omitempty"`
+	// Via names the router that forwarded a visitor, visitor role only
+	Via string `json:"via,omitempty"`
+	// Addr is the address of the client the visitor connects for, reported
+	// by visitor clients and forwarding routers, visitor role only
+	Addr      string `json:"addr,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+// LoginResp answers a login, an empty Error means success
+type LoginResp struct {
+	Error string `json:"error,omitempty"`
+}
+
+// NewWorkConn asks a server client to open a new work connection
+type NewWorkConn struct {
+	ProxyName string `json:"proxyName"`
+}
+
+// StartWorkConn tells a work connection that a visitor has been attached
+type StartWorkConn struct {
+	ProxyName string `json:"proxyName"`
+	// SrcAddr is the address of the visitor, used for the PROXY protocol header
+	SrcAddr string `json:"srcAddr,omitempty"`
+	// Visitor is the identity of the visitor
+	Visitor Identity `json:"visitor"`
+}
+
+// ProxyList announces the proxies registered at a router to its peers
+type ProxyList struct {
+	Proxies []string `json:"proxies"`
+}
+
+// GoAway tells a peer that the router is shutting down, the peer stops
+// forwarding new visitors over the link
+type GoAway struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Ping is sent periodically on control connections and peer links
+type Ping struct{}
+
+// Pong answers a Ping
+type Pong struct{}
+
+// Identity returns the identity announced in the login message
+func (m *Login) Identity() Identity {
+	return Identity{User: m.User, Namespace: m.Namespace, Cluster: m.Cluster}
+}
+
+// WriteMsg writes a single framed message: type, big endian length, JSON body
+func WriteMsg(w io.Writer, typ byte, msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxMsgLength {
+		return fmt.Errorf("message too large: %d bytes", len(body))
+	}
+
+	buf := make([]byte, 5+len(body))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(body)))
+	copy(buf[5:], body)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadMsg reads a single framed message and returns its type and JSON body.
+// It never reads past the end of the message, so the reader can be handed
+// over to the data path afterwards.
+func ReadMsg(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > maxMsgLength {
+		return 0, nil, fmt.Errorf("message too large: %d bytes", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// ReadMsgInto reads a single message of the expected type and decodes it into msg
+func ReadMsgInto(r io.Reader, typ byte, msg interface{}) error {
+	t, body, err := ReadMsg(r)
+	if err != nil {
+		return err
+	}
+	if t != typ {
+		return fmt.Errorf("unexpected message type %q, want %q", t, typ)
+	}
+	return json.Unmarshal(body, msg)
+}
@@ -0,0 +1,351 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// minPeerBackoff is the first delay before redialing a lost peer
+	minPeerBackoff = time.Second
+	// maxPeerBackoff caps the delay between peer redials
+	maxPeerBackoff = 30 * time.Second
+)
+
+// PeerConfig describes another router this router links to
+type PeerConfig struct {
+	// Name is the router name the peer logs in with
+	Name string
+	// Addr is the server listener address of the peer, visitors are
+	// forwarded to it
+	Addr string
+}
+
+// peerLink is an established link to another router
+type peerLink struct {
+	id   string
+	name string
+	// addr is where visitors are forwarded to
+	addr string
+
+	conn net.Conn
+	mu   sync.Mutex // serializes writes on conn
+
+	proxiesMu sync.RWMutex
+	proxies   map[string]struct{}
+}
+
+// StartPeers links the router with the configured peers. Links are redialed
+// with backoff until the router is closed.
+func (r *STCPRouter) StartPeers() {
+	for _, pc := range r.config.Peers {
+		go r.maintainPeer(pc)
+	}
+}
+
+// maintainPeer keeps a link to a single peer open
+func (r *STCPRouter) maintainPeer(pc PeerConfig) {
+	backoff := minPeerBackoff
+	for {
+		conn, err := r.dialPeer(pc)
+		if err != nil {
+			klog.Warningf("Failed to link peer %s at %s: %v", pc.Name, pc.Addr, err)
+		} else {
+			backoff = minPeerBackoff
+			r.servePeer(&peerLink{
+				id:      generateConnID(),
+				name:    pc.Name,
+				addr:    pc.Addr,
+				conn:    conn,
+				proxies: make(map[string]struct{}),
+			})
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.draining:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxPeerBackoff {
+			backoff = maxPeerBackoff
+		}
+	}
+}
+
+// dialPeer connects to a peer and logs in as a router
+func (r *STCPRouter) dialPeer(pc PeerConfig) (net.Conn, error) {
+	conn, err := r.dial(pc.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	login := &Login{
+		Role: RolePeer,
+		User: r.config.Name,
+	}
+	login.Sign(r.config.SecretKey)
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := WriteMsg(conn, TypeLogin, login); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var resp LoginResp
+	if err := ReadMsgInto(conn, TypeLoginResp, &resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, fmt.Errorf("peer rejected login: %s", resp.Error)
+	}
+	return conn, nil
+}
+
+// handlePeerConnection accepts a link from another router. Only configured
+// peers may link, every client holds the secret key; visitors are forwarded
+// to the configured address of the peer.
+func (r *STCPRouter) handlePeerConnection(conn net.Conn, login *Login) {
+	pc, ok := r.peerConfig(login.User)
+	if !ok || login.User == r.config.Name {
+		r.reject(conn, "", failureRole, fmt.Errorf("unknown peer %q", login.User))
+		conn.Close()
+		return
+	}
+	if err := WriteMsg(conn, TypeLoginResp, &LoginResp{}); err != nil {
+		conn.Close()
+		return
+	}
+	r.servePeer(&peerLink{
+		id:      generateConnID(),
+		name:    pc.Name,
+		addr:    pc.Addr,
+		conn:    conn,
+		proxies: make(map[string]struct{}),
+	})
+}
+
+// peerConfig returns the configured peer with the given name
+func (r *STCPRouter) peerConfig(name string) (PeerConfig, bool) {
+	for _, pc := range r.config.Peers {
+		if pc.Name == name && name != "" {
+			return pc, true
+		}
+	}
+	return PeerConfig{}, false
+}
+
+// servePeer exchanges proxy lists with a peer until the link is closed
+func (r *STCPRouter) servePeer(link *peerLink) {
+	defer link.conn.Close()
+
+	// Store the link and send the initial list under announceMu so that
+	// later announcements cannot be overtaken by a stale list
+	r.announceMu.Lock()
+	r.peers.Store(link.id, link)
+	err := link.send(TypeProxyList, &ProxyList{Proxies: r.localProxyNames()})
+	r.announceMu.Unlock()
+	defer r.peers.Delete(link.id)
+	if err != nil {
+		return
+	}
+	klog.Infof("Linked peer router %s from %s", link.name, link.conn.RemoteAddr())
+
+	// Both ends ping so that either can detect a half-dead link
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	go sendHeartbeats(ctx, heartbeatInterval(r.config.HeartbeatInterval), func() error {
+		return link.send(TypePing, &Ping{})
+	})
+
+	timeout := heartbeatTimeout(r.config.HeartbeatTimeout)
+	for {
+		typ, body, err := readMsgWithTimeout(link.conn, timeout)
+		if err != nil {
+			if isHeartbeatTimeout(err) {
+				klog.Warningf("Peer router %s sent no heartbeat for %v, closing link", link.name, timeout)
+				heartbeatTimeouts.WithLabelValues(RolePeer).Inc()
+			} else {
+				klog.Infof("Peer router %s link closed: %v", link.name, err)
+			}
+			return
+		}
+		switch typ {
+		case TypePing:
+			if err := link.send(TypePong, &Pong{}); err != nil {
+				return
+			}
+		case TypePong:
+		case TypeProxyList:
+			var list ProxyList
+			if err := json.Unmarshal(body, &list); err != nil {
+				klog.Warningf("Invalid proxy list from peer %s: %v", link.name, err)
+				return
+			}
+			link.setProxies(list.Proxies)
+		case TypeGoAway:
+			var goAway GoAway
+			json.Unmarshal(body, &goAway)
+			klog.Infof("Peer router %s is going away: %s", link.name, goAway.Reason)
+			link.setProxies(nil)
+		default:
+			klog.Warningf("Unexpected message %q from peer %s", typ, link.name)
+		}
+	}
+}
+
+// send writes a message on the peer link
+func (l *peerLink) send(typ byte, msg interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return WriteMsg(l.conn, typ, msg)
+}
+
+// setProxies replaces the proxies known to be registered at the peer
+func (l *peerLink) setProxies(names []string) {
+	proxies := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		proxies[name] = struct{}{}
+	}
+	l.proxiesMu.Lock()
+	l.proxies = proxies
+	l.proxiesMu.Unlock()
+}
+
+// hasProxy reports whether the peer announced the proxy
+func (l *peerLink) hasProxy(name string) bool {
+	l.proxiesMu.RLock()
+	defer l.proxiesMu.RUnlock()
+	_, ok := l.proxies[name]
+	return ok
+}
+
+// localProxyNames returns the sorted names of the locally registered proxies
+func (r *STCPRouter) localProxyNames() []string {
+	r.proxiesMu.RLock()
+	names := make([]string, 0, len(r.proxies))
+	for name := range r.proxies {
+		names = append(names, name)
+	}
+	r.proxiesMu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// announceProxies sends the local proxy list to all peers, nothing is
+// announced once the router sent GOAWAY
+func (r *STCPRouter) announceProxies() {
+	r.announceMu.Lock()
+	defer r.announceMu.Unlock()
+	if r.isDraining() {
+		return
+	}
+	list := &ProxyList{Proxies: r.localProxyNames()}
+	r.peers.Range(func(key, value interface{}) bool {
+		link := value.(*peerLink)
+		if err := link.send(TypeProxyList, list); err != nil {
+			klog.Warningf("Failed to announce proxies to peer %s: %v", link.name, err)
+		}
+		return true
+	})
+}
+
+// goAway tells all peers that the router is shutting down
+func (r *STCPRouter) goAway(reason string) {
+	r.announceMu.Lock()
+	defer r.announceMu.Unlock()
+	r.peers.Range(func(key, value interface{}) bool {
+		link := value.(*peerLink)
+		if err := link.send(TypeGoAway, &GoAway{Reason: reason}); err != nil {
+			klog.Warningf("Failed to send GOAWAY to peer %s: %v", link.name, err)
+		}
+		return true
+	})
+}
+
+// lookupPeer returns a linked peer that can be reached for visitors of the proxy
+func (r *STCPRouter) lookupPeer(proxyName string) *peerLink {
+	var found *peerLink
+	r.peers.Range(func(key, value interface{}) bool {
+		link := value.(*peerLink)
+		if link.hasProxy(proxyName) {
+			found = link
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// isPeer reports whether a router with the given name is linked
+func (r *STCPRouter) isPeer(name string) bool {
+	found := false
+	r.peers.Range(func(key, value interface{}) bool {
+		if value.(*peerLink).name == name {
+			found = true
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// forwardVisitor forwards a visitor to the peer holding the proxy. The peer
+// enforces its own access control on the original visitor identity.
+func (r *STCPRouter) forwardVisitor(conn net.Conn, login *Login, link *peerLink) {
+	remote, err := r.dial(link.addr)
+	if err != nil {
+		r.reject(conn, login.ProxyName, failureForward, fmt.Errorf("failed to reach peer %s: %v", link.name, err))
+		return
+	}
+	defer remote.Close()
+
+	forward := &Login{
+		Role:      RoleVisitor,
+		ProxyName: login.ProxyName,
+		User:      login.User,
+		Namespace: login.Namespace,
+		Cluster:   login.Cluster,
+		Via:       r.config.Name,
+		Addr:      visitorAddr(conn, login),
+	}
+	forward.Sign(r.config.SecretKey)
+
+	remote.SetDeadline(time.Now().Add(handshakeTimeout + workConnTimeout))
+	if err := WriteMsg(remote, TypeLogin, forward); err != nil {
+		r.reject(conn, login.ProxyName, failureForward, fmt.Errorf("failed to forward visitor to peer %s: %v", link.name, err))
+		return
+	}
+	var resp LoginResp
+	if err := ReadMsgInto(remote, TypeLoginResp, &resp); err != nil {
+		r.reject(conn, login.ProxyName, failureForward, fmt.Errorf("failed to forward visitor to peer %s: %v", link.name, err))
+		return
+	}
+	remote.SetDeadline(time.Time{})
+	if resp.Error != "" {
+		r.reject(conn, login.ProxyName, failureForward, fmt.Errorf("peer %s: %s", link.name, resp.Error))
+		return
+	}
+
+	s := r.newSession(conn, login.ProxyName, login.Identity(), link.name)
+	defer r.endSession(s)
+
+	if err := WriteMsg(conn, TypeLoginResp, &LoginResp{}); err != nil {
+		return
+	}
+	klog.Infof("audit: visitor %s from %s forwarded to proxy %s at peer %s", login.Identity(), conn.RemoteAddr(), login.ProxyName, link.name)
+
+	r.handleConnection(s, remote)
+}
@@ -0,0 +1,228 @@
+package router
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startPeeredRouters starts router-a and router-b, with router-b linking to router-a
+func startPeeredRouters(t *testing.T) (*STCPRouter, *STCPRouter) {
+	routerA := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", Name: "router-a"})
+	routerB := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", Name: "router-b"})
+	routerA.config.Peers = []PeerConfig{{Name: "router-b", Addr: routerB.serverListener.Addr().String()}}
+	routerB.config.Peers = []PeerConfig{{Name: "router-a", Addr: routerA.serverListener.Addr().String()}}
+	routerB.StartPeers()
+
+	waitFor(t, "peer link", func() bool {
+		return routerA.isPeer("router-b") && routerB.isPeer("router-a")
+	})
+	return routerA, routerB
+}
+
+func TestPeerForwardsVisitor(t *testing.T) {
+	routerA, routerB := startPeeredRouters(t)
+
+	// Export on router-a, visit through router-b
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: routerA.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "backend.default.svc.cluster-a:http",
+		AllowUsers: []string{"*"},
+	}, startEchoServer(t))
+	waitFor(t, "proxy announcement", func() bool {
+		return routerB.lookupPeer("backend.default.svc.cluster-a:http") != nil
+	})
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: routerB.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "backend.default.svc.cluster-a:http",
+		Cluster:    "cluster-b",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy through peer: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello from cluster-b!"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Export on router-b, visit through router-a over the inbound link
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: routerB.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "frontend.web.svc.cluster-b:http",
+		AllowUsers: []string{"*"},
+	}, startEchoServer(t))
+	waitFor(t, "proxy announcement", func() bool {
+		return routerA.lookupPeer("frontend.web.svc.cluster-b:http") != nil
+	})
+
+	conn2, err := DialVisitor(&ClientConfig{
+		RouterAddr: routerA.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "frontend.web.svc.cluster-b:http",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy through peer: %v", err)
+	}
+	defer conn2.Close()
+	if err := echo(conn2, "Hello from cluster-a!"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerEnforcesAllowUsers(t *testing.T) {
+	routerA, routerB := startPeeredRouters(t)
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: routerA.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		AllowUsers: []string{"alice"},
+	}, startEchoServer(t))
+	waitFor(t, "proxy announcement", func() bool {
+		return routerB.lookupPeer("echo") != nil
+	})
+
+	_, err := DialVisitor(&ClientConfig{
+		RouterAddr: routerB.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		User:       "bob",
+	})
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("Expected visitor to be rejected by the peer, got %v", err)
+	}
+}
+
+func TestPeerWithdrawsProxy(t *testing.T) {
+	routerA, routerB := startPeeredRouters(t)
+
+	client := startTestServerClient(t, &ClientConfig{
+		RouterAddr: routerA.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+	waitFor(t, "proxy announcement", func() bool {
+		return routerB.lookupPeer("echo") != nil
+	})
+
+	client.Close()
+	waitFor(t, "proxy withdrawal", func() bool {
+		return routerB.lookupPeer("echo") == nil
+	})
+}
+
+func TestPeerRejectsUnlinkedForwarding(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", Name: "router-a"})
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+
+	// A visitor pretending to be forwarded by an unknown router
+	conn, err := Dial(router.serverListener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to router: %v", err)
+	}
+	defer conn.Close()
+	login := &Login{Role: RoleVisitor, ProxyName: "echo", Via: "router-x"}
+	login.Sign("test-secret-key")
+	if err := WriteMsg(conn, TypeLogin, login); err != nil {
+		t.Fatalf("Failed to send login: %v", err)
+	}
+	var resp LoginResp
+	if err := ReadMsgInto(conn, TypeLoginResp, &resp); err != nil {
+		t.Fatalf("Failed to read login response: %v", err)
+	}
+	if resp.Error == "" {
+		t.Fatal("Expected forwarded visitor from unknown router to be rejected")
+	}
+}
+
+func TestPeerGoAway(t *testing.T) {
+	routerA, routerB := startPeeredRouters(t)
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: routerA.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+	waitFor(t, "proxy announcement", func() bool {
+		return routerB.lookupPeer("echo") != nil
+	})
+
+	// Keep router-a draining with an active session
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: routerA.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect visitor: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go routerA.Shutdown(ctx)
+
+	waitFor(t, "GOAWAY", func() bool {
+		return routerB.lookupPeer("echo") == nil
+	})
+	if !routerB.isPeer("router-a") {
+		t.Fatal("Expected link to stay open while router-a drains")
+	}
+}
+
+func TestPeerRejectsUnknownRouter(t *testing.T) {
+	routerA, _ := startPeeredRouters(t)
+
+	// Every client holds the secret key, only configured peers may link
+	for _, name := range []string{"router-x", "router-a", ""} {
+		conn, err := Dial(routerA.serverListener.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("Failed to connect to router: %v", err)
+		}
+		login := &Login{Role: RolePeer, User: name, Addr: "127.0.0.1:1"}
+		login.Sign("test-secret-key")
+		if err := WriteMsg(conn, TypeLogin, login); err != nil {
+			t.Fatalf("Failed to send login: %v", err)
+		}
+		var resp LoginResp
+		if err := ReadMsgInto(conn, TypeLoginResp, &resp); err != nil || !strings.Contains(resp.Error, "unknown peer") {
+			t.Errorf("Expected peer %q to be rejected, got %v %q", name, err, resp.Error)
+		}
+		conn.Close()
+	}
+	if routerA.isPeer("router-x") {
+		t.Error("Unknown router linked as peer")
+	}
+
+	// Visitors are forwarded to the configured address, not the one a peer
+	// reports at login
+	waitFor(t, "peer link", func() bool { return routerA.isPeer("router-b") })
+	routerA.peers.Range(func(key, value interface{}) bool {
+		if link := value.(*peerLink); link.addr != routerA.config.Peers[0].Addr {
+			t.Errorf("Peer %s forwarded to %s; want %s", link.name, link.addr, routerA.config.Peers[0].Addr)
+		}
+		return true
+	})
+}
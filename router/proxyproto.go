@@ -0,0 +1,114 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// PROXY protocol versions a server client may prepend to the connections it
+// opens to its local service
+const (
+	// ProxyProtocolV1 sends the human readable header, it carries the visitor
+	// address only
+	ProxyProtocolV1 = "v1"
+	// ProxyProtocolV2 sends the binary header, the visitor identity is added
+	// as a PP2TypeIdentity TLV
+	ProxyProtocolV2 = "v2"
+)
+
+// PP2TypeIdentity is the PROXY protocol v2 TLV type carrying the visitor
+// identity as "user@namespace/cluster", taken from the custom type range
+const PP2TypeIdentity = 0xE0
+
+// proxyProtocolV2Sig starts every PROXY protocol v2 header
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ValidProxyProtocol reports whether s names a PROXY protocol version, empty
+// disables the header
+func ValidProxyProtocol(s string) bool {
+	switch s {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+		return true
+	}
+	return false
+}
+
+// proxyProtocolHeader builds the PROXY protocol header for a visitor
+// connecting from src to the local service at dst. Sources that are not IP
+// addresses, e.g. Unix sockets, are sent as unknown.
+func proxyProtocolHeader(version, src string, dst net.Addr, visitor Identity) ([]byte, error) {
+	srcIP, srcPort, srcOK := splitIPPort(src)
+	dstIP, dstPort, dstOK := splitIPPort(dst.String())
+	known := srcOK && dstOK
+	ipv4 := known && srcIP.To4() != nil && dstIP.To4() != nil
+	if known && !ipv4 {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcPort, dstPort)), nil
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcIP), ipv6String(dstIP), srcPort, dstPort)), nil
+	case ProxyProtocolV2:
+		var addrs []byte
+		family := byte(0x00) // AF_UNSPEC
+		switch {
+		case ipv4:
+			family = 0x11 // TCP over IPv4
+			addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+		case known:
+			family = 0x21 // TCP over IPv6
+			addrs = append(append(addrs, srcIP...), dstIP...)
+		}
+		if known {
+			addrs = binary.BigEndian.AppendUint16(addrs, srcPort)
+			addrs = binary.BigEndian.AppendUint16(addrs, dstPort)
+		}
+		if visitor != (Identity{}) {
+			id := visitor.String()
+			addrs = append(addrs, PP2TypeIdentity)
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(len(id)))
+			addrs = append(addrs, id...)
+		}
+
+		var buf bytes.Buffer
+		buf.Write(proxyProtocolV2Sig)
+		buf.WriteByte(0x21) // version 2, PROXY command
+		buf.WriteByte(family)
+		binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+		buf.Write(addrs)
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %q", version)
+	}
+}
+
+// ipv6String formats ip in IPv6 notation, IPv4 addresses are mapped
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// splitIPPort parses an "ip:port" address
+func splitIPPort(addr string) (net.IP, uint16, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, false
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, 0, false
+	}
+	return ip, uint16(n), true
+}
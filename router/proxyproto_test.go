@@ -0,0 +1,209 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolHeaderV1(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"10.0.0.1:40000", "PROXY TCP4 10.0.0.1 127.0.0.1 40000 8080\r\n"},
+		{"[fd00::1]:40000", "PROXY TCP6 fd00::1 ::ffff:127.0.0.1 40000 8080\r\n"},
+		{"@", "PROXY UNKNOWN\r\n"},
+		{"", "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		header, err := proxyProtocolHeader(ProxyProtocolV1, tt.src, dst, Identity{User: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(header) != tt.want {
+			t.Errorf("v1 header for %q = %q; want %q", tt.src, header, tt.want)
+		}
+	}
+}
+
+func TestProxyProtocolHeaderV2(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	visitor := Identity{User: "frontend", Namespace: "default", Cluster: "cluster-a"}
+	header, err := proxyProtocolHeader(ProxyProtocolV2, "10.0.0.1:40000", dst, visitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]byte{}, proxyProtocolV2Sig...)
+	want = append(want, 0x21, 0x11)
+	id := visitor.String()
+	want = binary.BigEndian.AppendUint16(want, uint16(12+3+len(id)))
+	want = append(want, 10, 0, 0, 1, 127, 0, 0, 1)
+	want = binary.BigEndian.AppendUint16(want, 40000)
+	want = binary.BigEndian.AppendUint16(want, 8080)
+	want = append(want, PP2TypeIdentity)
+	want = binary.BigEndian.AppendUint16(want, uint16(len(id)))
+	want = append(want, id...)
+	if !bytes.Equal(header, want) {
+		t.Fatalf("v2 header = %x; want %x", header, want)
+	}
+
+	// Unknown sources keep the identity
+	header, err = proxyProtocolHeader(ProxyProtocolV2, "@", dst, visitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[13] != 0x00 || int(binary.BigEndian.Uint16(header[14:16])) != 3+len(id) {
+		t.Fatalf("Unexpected v2 header for unknown source: %x", header)
+	}
+
+	if _, err := proxyProtocolHeader("v3", "10.0.0.1:40000", dst, visitor); err == nil {
+		t.Fatal("Expected unsupported version to be rejected")
+	}
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header
+func readProxyHeader(r *bufio.Reader) ([]byte, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sig, proxyProtocolV2Sig) {
+		return r.ReadBytes('\n')
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	rest := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	return append(header, rest...), nil
+}
+
+// startProxyProtocolServer starts an echo server expecting a PROXY protocol
+// header, the headers received are sent to the returned channel
+func startProxyProtocolServer(t *testing.T) (string, <-chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start local service: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	headers := make(chan []byte, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				header, err := readProxyHeader(r)
+				if err != nil {
+					return
+				}
+				headers <- header
+				io.Copy(conn, r)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), headers
+}
+
+// receiveHeader waits for the next PROXY protocol header
+func receiveHeader(t *testing.T, headers <-chan []byte) []byte {
+	select {
+	case header := <-headers:
+		return header
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for PROXY protocol header")
+		return nil
+	}
+}
+
+func TestServerClientProxyProtocol(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+	localAddr, headers := startProxyProtocolServer(t)
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr:    router.serverListener.Addr().String(),
+		SecretKey:     "test-secret-key",
+		ProxyName:     "echo",
+		AllowUsers:    []string{"*"},
+		ProxyProtocol: ProxyProtocolV1,
+	}, localAddr)
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		User:       "alice",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello with PROXY protocol!"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The local service sees the visitor address instead of the server client
+	visitor := conn.LocalAddr().(*net.TCPAddr)
+	service, _ := net.ResolveTCPAddr("tcp", localAddr)
+	want := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", visitor.IP, service.IP, visitor.Port, service.Port)
+	if header := receiveHeader(t, headers); string(header) != want {
+		t.Fatalf("PROXY header = %q; want %q", header, want)
+	}
+}
+
+func TestPeerProxyProtocol(t *testing.T) {
+	routerA, routerB := startPeeredRouters(t)
+	localAddr, headers := startProxyProtocolServer(t)
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr:    routerA.serverListener.Addr().String(),
+		SecretKey:     "test-secret-key",
+		ProxyName:     "echo",
+		AllowUsers:    []string{"*"},
+		ProxyProtocol: ProxyProtocolV2,
+	}, localAddr)
+	waitFor(t, "proxy announcement", func() bool {
+		return routerB.lookupPeer("echo") != nil
+	})
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: routerB.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		User:       "frontend",
+		Namespace:  "default",
+		Cluster:    "cluster-b",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy through peer: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello across peers with PROXY protocol!"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The visitor address seen by router-b and the visitor identity are kept
+	// across the peer link
+	service, _ := net.ResolveTCPAddr("tcp", localAddr)
+	want, err := proxyProtocolHeader(ProxyProtocolV2, conn.LocalAddr().String(), service,
+		Identity{User: "frontend", Namespace: "default", Cluster: "cluster-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := receiveHeader(t, headers); !bytes.Equal(header, want) {
+		t.Fatalf("PROXY header = %x; want %x", header, want)
+	}
+}
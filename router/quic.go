@@ -0,0 +1,371 @@
+package router
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"k8s.io/klog"
+)
+
+// quicALPN is the application protocol negotiated on QUIC connections
+const quicALPN = "servicekeel-router"
+
+// quicConfig keeps idle QUIC connections alive with the heartbeat interval,
+// closes them after the heartbeat timeout and lets a single connection carry
+// the control, work and visitor streams of a busy client. Zero durations
+// use the heartbeat defaults.
+func quicConfig(interval, timeout time.Duration) *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:        heartbeatTimeout(timeout),
+		KeepAlivePeriod:       heartbeatInterval(interval),
+		MaxIncomingStreams:    1 << 16,
+		MaxIncomingUniStreams: -1,
+	}
+}
+
+// quicListener accepts the streams of QUIC connections as router connections.
+// Every stream carries one connection with the same login and framing as a
+// TCP connection, QUIC only replaces the multiplexing and transport.
+type quicListener struct {
+	tr    *quic.Transport
+	ln    *quic.Listener
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// active counts the open streams per QUIC connection, connections are
+	// closed once the listener is closed and their last stream is done
+	mu     sync.Mutex
+	active map[quic.Connection]int
+}
+
+// listenQUIC listens for QUIC connections on a UDP address. Without a TLS
+// configuration a self-signed certificate is used: QUIC always encrypts, and
+// clients are authenticated by their login as on TCP.
+func listenQUIC(address string, tlsConf *tls.Config, quicConf *quic.Config) (net.Listener, error) {
+	if tlsConf == nil {
+		var err error
+		if tlsConf, err = selfSignedTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return serveQUIC(udpConn, tlsConf, quicConf)
+}
+
+// serveQUIC accepts QUIC connections on a packet connection, the listener
+// takes ownership of it
+func serveQUIC(pconn net.PacketConn, tlsConf *tls.Config, quicConf *quic.Config) (net.Listener, error) {
+	tr := &quic.Transport{Conn: pconn}
+	ln, err := tr.Listen(withALPN(tlsConf), quicConf)
+	if err != nil {
+		tr.Close()
+		pconn.Close()
+		return nil, err
+	}
+	l := &quicListener{
+		tr:     tr,
+		ln:     ln,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		active: make(map[quic.Connection]int),
+	}
+	go l.acceptConns()
+	return l, nil
+}
+
+// acceptConns accepts QUIC connections until the listener is closed
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		l.active[conn] = 0
+		if l.isClosed() {
+			l.closeConn(conn)
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+		go l.acceptStreams(conn)
+	}
+}
+
+// acceptStreams hands the streams of a QUIC connection to Accept. Streams
+// opened after the listener is closed are reset, so that clients fail fast
+// instead of waiting for a login response.
+func (l *quicListener) acceptStreams(conn quic.Connection) {
+	defer l.forget(conn)
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		if !l.track(conn) {
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			continue
+		}
+		c := &streamConn{Stream: stream, conn: conn, release: func() { l.release(conn) }}
+		select {
+		case l.conns <- c:
+		case <-l.closed:
+			c.Close()
+		}
+	}
+}
+
+// track counts a new stream of conn, it reports false once the listener is closed
+func (l *quicListener) track(conn quic.Connection) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed() {
+		return false
+	}
+	l.active[conn]++
+	return true
+}
+
+// release uncounts a finished stream of conn
+func (l *quicListener) release(conn quic.Connection) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.active[conn]; !ok {
+		return
+	}
+	l.active[conn]--
+	if l.isClosed() && l.active[conn] <= 0 {
+		l.closeConn(conn)
+	}
+}
+
+// forget drops a connection closed by the client
+func (l *quicListener) forget(conn quic.Connection) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.active[conn]; ok && l.isClosed() {
+		l.closeConn(conn)
+		return
+	}
+	delete(l.active, conn)
+}
+
+// closeConn closes conn and, after the last connection, the UDP socket.
+// l.mu must be held.
+func (l *quicListener) closeConn(conn quic.Connection) {
+	delete(l.active, conn)
+	conn.CloseWithError(0, "router closed")
+	if len(l.active) == 0 {
+		l.tr.Close()
+	}
+}
+
+// isClosed reports whether Close was called
+func (l *quicListener) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Accept waits for the next stream
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting streams. Streams already accepted keep working,
+// their QUIC connection is closed after the last one finishes.
+func (l *quicListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		close(l.closed)
+		l.ln.Close()
+		for conn, n := range l.active {
+			if n <= 0 {
+				delete(l.active, conn)
+				conn.CloseWithError(0, "router closed")
+			}
+		}
+		if len(l.active) == 0 {
+			l.tr.Close()
+		}
+	})
+	return nil
+}
+
+// Addr returns the UDP address of the listener
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// streamConn is a QUIC stream used as a router connection
+type streamConn struct {
+	quic.Stream
+	conn    quic.Connection
+	once    sync.Once
+	release func()
+}
+
+// Close closes both directions of the stream, the QUIC connection is shared
+// and stays open
+func (c *streamConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.Stream.CancelRead(0)
+		err = c.Stream.Close()
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return err
+}
+
+// CloseWrite closes the send direction of the stream, the peer reads EOF
+func (c *streamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// LocalAddr returns the local address of the QUIC connection
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the QUIC connection
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ConnectionState returns the TLS state of the QUIC connection, so that
+// client certificates bind logins as on TLS over TCP
+func (c *streamConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// quicDialer shares one QUIC connection between the streams dialed to an
+// address with the same TLS configuration
+type quicDialer struct {
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+// quicDialers caches the dialers by TLS configuration and address
+var quicDialers sync.Map // map[string]*quicDialer
+
+// dialQUIC opens a stream to address, dialing a QUIC connection first if
+// there is no live one for key and the heartbeat settings of quicConf
+func dialQUIC(key, address string, tlsConf *tls.Config, quicConf *quic.Config, timeout time.Duration) (net.Conn, error) {
+	key = fmt.Sprintf("%s|%v|%v", key, quicConf.KeepAlivePeriod, quicConf.MaxIdleTimeout)
+	value, _ := quicDialers.LoadOrStore(key, &quicDialer{})
+	d := value.(*quicDialer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := d.connect(ctx, address, tlsConf, quicConf)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open QUIC stream to %s: %w", address, err)
+	}
+	return &streamConn{Stream: stream, conn: conn}, nil
+}
+
+// connect returns the live QUIC connection of the dialer, dialing a new one
+// if the previous connection was closed
+func (d *quicDialer) connect(ctx context.Context, address string, tlsConf *tls.Config, quicConf *quic.Config) (quic.Connection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		return d.conn, nil
+	}
+	conn, err := quic.DialAddr(ctx, address, withALPN(tlsConf), quicConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial QUIC %s: %w", address, err)
+	}
+	klog.V(4).Infof("QUIC connection to %s established", address)
+	d.conn = conn
+	return conn, nil
+}
+
+// withALPN returns a copy of a TLS configuration negotiating the router
+// protocol, including the configurations returned by GetConfigForClient
+func withALPN(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.NextProtos = []string{quicALPN}
+	if get := config.GetConfigForClient; get != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if c != nil {
+				c = c.Clone()
+				c.NextProtos = []string{quicALPN}
+			}
+			return c, err
+		}
+	}
+	return config
+}
+
+// insecureQUICConfig is used to dial QUIC without a TLS configuration, the
+// router presents a self-signed certificate then
+func insecureQUICConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS13, InsecureSkipVerify: true}
+}
+
+// selfSignedTLSConfig creates a throwaway certificate for QUIC listeners
+// without a TLS configuration
+func selfSignedTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "servicekeel-router"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create QUIC certificate: %v", err)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, nil
+}
@@ -0,0 +1,296 @@
+package router
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops a fraction of the packets sent and received
+type lossyPacketConn struct {
+	net.PacketConn
+	loss float64
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	dropped int64
+}
+
+func newLossyPacketConn(t *testing.T, loss float64) *lossyPacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyPacketConn{PacketConn: conn, loss: loss, rand: rand.New(rand.NewSource(1))}
+}
+
+func (c *lossyPacketConn) drop() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rand.Float64() >= c.loss {
+		return false
+	}
+	atomic.AddInt64(&c.dropped, 1)
+	return true
+}
+
+func (c *lossyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || !c.drop() {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.drop() {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// startQUICRouter starts a router whose server and visitor sides listen on QUIC
+func startQUICRouter(t *testing.T, config *STCPConfig) (*STCPRouter, string, string) {
+	router := NewSTCPRouter(config)
+	if err := router.StartServer("quic://127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	if err := router.StartVisitor("quic://127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start visitor: %v", err)
+	}
+	t.Cleanup(router.Close)
+	return router, "quic://" + router.serverListener.Addr().String(), "quic://" + router.visitorListener.Addr().String()
+}
+
+func TestQUICConfigHeartbeat(t *testing.T) {
+	r := NewSTCPRouter(&STCPConfig{HeartbeatInterval: 2 * time.Second, HeartbeatTimeout: 6 * time.Second})
+	if c := r.quicConfig(); c.KeepAlivePeriod != 2*time.Second || c.MaxIdleTimeout != 6*time.Second {
+		t.Errorf("Keep-alive/idle timeout = %v/%v; want 2s/6s", c.KeepAlivePeriod, c.MaxIdleTimeout)
+	}
+	if c := quicConfig(0, 0); c.KeepAlivePeriod != defaultHeartbeatInterval || c.MaxIdleTimeout != defaultHeartbeatTimeout {
+		t.Errorf("Default keep-alive/idle timeout = %v/%v", c.KeepAlivePeriod, c.MaxIdleTimeout)
+	}
+}
+
+func TestQUICTransport(t *testing.T) {
+	router, serverAddr, visitorAddr := startQUICRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: serverAddr,
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		AllowUsers: []string{"alice"},
+		PoolCount:  2,
+	}, startEchoServer(t))
+
+	// Concurrent visitors are streams of one QUIC connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := DialVisitor(&ClientConfig{
+				RouterAddr: visitorAddr,
+				SecretKey:  "test-secret-key",
+				ProxyName:  "echo",
+				User:       "alice",
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			errs <- echo(conn, "Hello over QUIC!")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Authentication is the same as on TCP
+	_, err := DialVisitor(&ClientConfig{
+		RouterAddr: visitorAddr,
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		User:       "bob",
+	})
+	if err == nil {
+		t.Fatal("Expected visitor not in allowUsers to be rejected")
+	}
+	_, err = DialVisitor(&ClientConfig{
+		RouterAddr: visitorAddr,
+		SecretKey:  "wrong-secret-key",
+		ProxyName:  "echo",
+		User:       "alice",
+	})
+	if err == nil {
+		t.Fatal("Expected visitor with wrong secret key to be rejected")
+	}
+
+	ln := router.visitorListener.(*quicListener)
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if len(ln.active) != 1 {
+		t.Fatalf("Expected visitors to share one QUIC connection, got %d", len(ln.active))
+	}
+}
+
+func TestQUICPacketLoss(t *testing.T) {
+	router := NewSTCPRouter(&STCPConfig{SecretKey: "test-secret-key"})
+	t.Cleanup(router.Close)
+
+	// Both sides of the router drop 10% of the packets in each direction
+	lossy := map[string]*lossyPacketConn{}
+	for _, side := range []string{"server", "visitor"} {
+		pconn := newLossyPacketConn(t, 0.1)
+		tlsConf, err := selfSignedTLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := serveQUIC(pconn, tlsConf, quicConfig(0, 0))
+		if err != nil {
+			t.Fatalf("Failed to listen on QUIC: %v", err)
+		}
+		if side == "server" {
+			router.ServeServer(ln)
+		} else {
+			router.ServeVisitor(ln)
+		}
+		lossy[side] = pconn
+	}
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: "quic://" + router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: "quic://" + router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy over lossy QUIC: %v", err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("Failed to read echoed data: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Echoed data does not match")
+	}
+	for side, pconn := range lossy {
+		if atomic.LoadInt64(&pconn.dropped) == 0 {
+			t.Fatalf("Expected packets to be dropped on the %s side", side)
+		}
+	}
+}
+
+func TestQUICPeer(t *testing.T) {
+	routerA := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", Name: "router-a"})
+	if err := routerA.StartServer("quic://127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start QUIC server: %v", err)
+	}
+	routerA.listenersMu.Lock()
+	quicAddr := "quic://" + routerA.listeners[len(routerA.listeners)-1].Addr().String()
+	routerA.listenersMu.Unlock()
+
+	// router-b links to router-a over QUIC while its clients use TCP
+	routerB := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", Name: "router-b"})
+	routerA.config.Peers = []PeerConfig{{Name: "router-b", Addr: routerB.serverListener.Addr().String()}}
+	routerB.config.Peers = []PeerConfig{{Name: "router-a", Addr: quicAddr}}
+	routerB.StartPeers()
+	waitFor(t, "peer link", func() bool {
+		return routerA.isPeer("router-b") && routerB.isPeer("router-a")
+	})
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: routerA.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+	waitFor(t, "proxy announcement", func() bool {
+		return routerB.lookupPeer("echo") != nil
+	})
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: routerB.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy through QUIC peer: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello across QUIC peers!"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQUICMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	certFile, keyFile := ca.issue(t, dir, "router", pkix.Name{CommonName: "router-a"})
+	_, serverAddr, visitorAddr := startQUICRouter(t, &STCPConfig{
+		SecretKey: "test-secret-key",
+		TLS:       &TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+	})
+
+	serverCert, serverKey := ca.issue(t, dir, "backend", pkix.Name{CommonName: "backend"})
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: serverAddr,
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		AllowUsers: []string{"alice"},
+		TLS:        &TLSConfig{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile},
+	}, startEchoServer(t))
+
+	// The visitor identity comes from the certificate of the QUIC connection
+	aliceCert, aliceKey := ca.issue(t, dir, "alice", pkix.Name{CommonName: "alice"})
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: visitorAddr,
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		TLS:        &TLSConfig{CertFile: aliceCert, KeyFile: aliceKey, CAFile: caFile},
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy over QUIC with mutual TLS: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello over QUIC and TLS!"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a client certificate the QUIC handshake fails
+	_, err = DialVisitor(&ClientConfig{
+		RouterAddr: visitorAddr,
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		TLS:        &TLSConfig{CAFile: caFile},
+	})
+	if err == nil {
+		t.Fatal("Expected visitor without client certificate to be rejected")
+	}
+}
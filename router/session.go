@@ -0,0 +1,160 @@
+package router
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyInfo describes a registered proxy
+type ProxyInfo struct {
+	Name string `json:"proxyName"`
+	// RunID identifies the server, a proxy has one entry per registered server
+	RunID      string    `json:"runId"`
+	Owner      Identity  `json:"owner"`
+	AllowUsers []string  `json:"allowUsers"`
+	RemoteAddr string    `json:"remoteAddr"`
+	StartTime  time.Time `json:"startTime"`
+	// Sessions is the number of visitor sessions currently attached
+	Sessions int `json:"sessions"`
+	// PoolSize is the number of idle work connections kept for the proxy
+	PoolSize int `json:"poolSize"`
+	// IdleWorkConns is the number of idle work connections currently queued
+	IdleWorkConns int `json:"idleWorkConns"`
+}
+
+// SessionInfo describes an active visitor session
+type SessionInfo struct {
+	ID         string   `json:"id"`
+	ProxyName  string   `json:"proxyName"`
+	Visitor    Identity `json:"visitor"`
+	RemoteAddr string   `json:"remoteAddr"`
+	// Via is the peer router the visitor was forwarded by or to
+	Via       string    `json:"via,omitempty"`
+	StartTime time.Time `json:"startTime"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+}
+
+// session is a visitor stream attached to a proxy
+type session struct {
+	id        string
+	proxyName string
+	visitor   Identity
+	via       string
+	startTime time.Time
+	conn      net.Conn
+	bytesIn   int64
+	bytesOut  int64
+}
+
+// newSession tracks a visitor connection until endSession is called
+func (r *STCPRouter) newSession(conn net.Conn, proxyName string, visitor Identity, via string) *session {
+	s := &session{
+		id:        generateConnID(),
+		proxyName: proxyName,
+		visitor:   visitor,
+		via:       via,
+		startTime: time.Now(),
+		conn:      conn,
+	}
+	r.visitorConns.Store(s.id, s)
+	// Close may have run while the visitor was logging in
+	if r.ctx.Err() != nil {
+		conn.Close()
+	}
+	return s
+}
+
+// endSession stops tracking a visitor session
+func (r *STCPRouter) endSession(s *session) {
+	r.visitorConns.Delete(s.id)
+}
+
+// info returns the current state of the session
+func (s *session) info() SessionInfo {
+	return SessionInfo{
+		ID:         s.id,
+		ProxyName:  s.proxyName,
+		Visitor:    s.visitor,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		Via:        s.via,
+		StartTime:  s.startTime,
+		BytesIn:    atomic.LoadInt64(&s.bytesIn),
+		BytesOut:   atomic.LoadInt64(&s.bytesOut),
+	}
+}
+
+// Sessions returns the active visitor sessions, oldest first
+func (r *STCPRouter) Sessions() []SessionInfo {
+	var result []SessionInfo
+	r.visitorConns.Range(func(key, value interface{}) bool {
+		result = append(result, value.(*session).info())
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].StartTime.Before(result[j].StartTime) })
+	return result
+}
+
+// CloseSession disconnects a visitor session, it reports false if no
+// session with the given ID is active
+func (r *STCPRouter) CloseSession(id string) bool {
+	value, ok := r.visitorConns.Load(id)
+	if !ok {
+		return false
+	}
+	value.(*session).conn.Close()
+	return true
+}
+
+// Proxies returns the servers of the locally registered proxies sorted by
+// name and registration
+func (r *STCPRouter) Proxies() []ProxyInfo {
+	r.proxiesMu.RLock()
+	var result []ProxyInfo
+	for _, g := range r.proxies {
+		for _, p := range g.members {
+			result = append(result, ProxyInfo{
+				Name:          p.name,
+				RunID:         p.runID,
+				Owner:         p.owner,
+				AllowUsers:    p.allowUsers,
+				RemoteAddr:    p.ctlConn.RemoteAddr().String(),
+				StartTime:     p.startTime,
+				Sessions:      int(atomic.LoadInt64(&p.sessions)),
+				PoolSize:      p.poolCount,
+				IdleWorkConns: len(p.workConns),
+			})
+		}
+	}
+	r.proxiesMu.RUnlock()
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].StartTime.Before(result[j].StartTime)
+	})
+	return result
+}
+
+// DeregisterProxy removes all servers of a proxy, closing their control
+// connections and the visitor sessions attached to the proxy. It reports
+// false if the proxy is not registered. Servers are free to register again.
+func (r *STCPRouter) DeregisterProxy(name string) bool {
+	members := r.lookupAll(name)
+	if len(members) == 0 {
+		return false
+	}
+	for _, p := range members {
+		p.ctlConn.Close()
+		r.deregister(p)
+	}
+	r.visitorConns.Range(func(key, value interface{}) bool {
+		if s := value.(*session); s.proxyName == name {
+			s.conn.Close()
+		}
+		return true
+	})
+	return true
+}
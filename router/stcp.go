@@ -5,21 +5,76 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"k8s.io/klog"
+)
+
+const (
+	// handshakeTimeout bounds the time a new connection may take to log in
+	handshakeTimeout = 10 * time.Second
+	// workConnTimeout bounds the time a visitor waits for a work connection
+	workConnTimeout = 10 * time.Second
+	// workConnQueueSize is the number of idle work connections kept per proxy
+	workConnQueueSize = 64
+	// defaultMaxPoolCount caps the work connection pool requested by a server
+	defaultMaxPoolCount = 16
+	// minAcceptBackoff and maxAcceptBackoff bound the delay after a failed accept
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+	// shutdownPollInterval is how often Shutdown checks for remaining sessions
+	shutdownPollInterval = 50 * time.Millisecond
 )
 
 // STCPConfig represents the configuration for STCP router
 type STCPConfig struct {
 	// SecretKey is used for authentication and encryption
 	SecretKey string
-	// AllowUsers specifies which users are allowed to connect
+	// AllowUsers specifies which users are allowed to visit proxies that do
+	// not declare their own allow list, see Allowed for the entry format.
+	// Without mutual TLS visitors may claim any identity.
 	AllowUsers []string
 	// UseEncryption controls whether to encrypt the traffic
 	UseEncryption bool
 	// UseCompression controls whether to compress the traffic
 	UseCompression bool
+	// UnixSocket controls mode and ownership of Unix domain socket listeners
+	UnixSocket *UnixSocketOptions
+	// TLS enables TLS 1.3 on the listeners and peer connections, with mutual
+	// TLS the client certificate identity is used for access control
+	TLS *TLSConfig
+	// Name identifies this router to its peers
+	Name string
+	// Peers lists the routers this router links to and accepts links from,
+	// see StartPeers
+	Peers []PeerConfig
+	// LoadBalance chooses among the servers registered under the same proxy
+	// name: round_robin (default), least_conn or consistent_hash
+	LoadBalance string
+	// MaxPoolCount caps the number of idle work connections a server may ask
+	// the router to keep, zero means 16
+	MaxPoolCount int
+	// HeartbeatInterval is the time between pings on peer links, zero means 10s
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is the time without any message after which a control
+	// connection or peer link is closed as dead, zero means 30s
+	HeartbeatTimeout time.Duration
+	// Limits holds the bandwidth limits and traffic quotas of proxies
+	Limits []TrafficLimit
+	// QuotaFile keeps the traffic of the current day and month of every
+	// proxy across restarts, see StartQuotaUsage. Empty keeps it in memory
+	// only and a restart resets the quotas.
+	QuotaFile string
 }
 
 // STCPRouter implements the STCP protocol for secure TCP tunneling
@@ -28,167 +83,773 @@ type STCPRouter struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	// server side
+	// tls is loaded on first use when TLS is configured
+	tlsOnce sync.Once
+	tls     *tlsReloader
+	tlsErr  error
+
+	// draining is closed once the router stops accepting connections
+	draining  chan struct{}
+	drainOnce sync.Once
+
+	// listeners holds every listener of the router, e.g. TCP and QUIC
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+
+	// server side, serverListener is the first server listener
 	serverListener net.Listener
-	serverConns    sync.Map // map[string]net.Conn
+	serverConns    sync.Map // map[string]net.Conn, control connections by connection ID
 
-	// visitor side
+	// visitor side, visitorListener is the first visitor listener
 	visitorListener net.Listener
-	visitorConns    sync.Map // map[string]net.Conn
+	visitorConns    sync.Map // map[string]*session, visitor sessions by session ID
+
+	// registered proxies by name
+	proxiesMu sync.RWMutex
+	proxies   map[string]*proxyGroup
+
+	// peer routers
+	peers      sync.Map // map[string]*peerLink, peer links by link ID
+	announceMu sync.Mutex
+
+	// traffic accounting
+	traffic sync.Map // map[string]*trafficStats, traffic by proxy name
+
+	// bandwidth limiters of proxies and visitors
+	limiters limiters
 
 	// auth cache
 	authCache sync.Map // map[string]time.Time
 }
 
+// proxy is a server of an exported service registered through a control connection
+type proxy struct {
+	name string
+	// runID identifies the server across reconnects
+	runID      string
+	owner      Identity
+	allowUsers []string
+	startTime  time.Time
+	// poolCount is the number of idle work connections kept for the proxy
+	poolCount int
+	// sessions is the number of visitor sessions attached, for least_conn balancing
+	sessions int64
+
+	// ctlConn is the control connection of the server, writes are serialized by ctlMu
+	ctlConn net.Conn
+	ctlMu   sync.Mutex
+
+	// workConns holds idle work connections opened by the server
+	mu        sync.Mutex
+	closed    bool
+	workConns chan net.Conn
+	done      chan struct{}
+}
+
 // NewSTCPRouter creates a new STCP router instance
 func NewSTCPRouter(config *STCPConfig) *STCPRouter {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &STCPRouter{
-		config: config,
-		ctx:    ctx,
-		cancel: cancel,
+		config:   config,
+		ctx:      ctx,
+		cancel:   cancel,
+		draining: make(chan struct{}),
+		proxies:  make(map[string]*proxyGroup),
 	}
 }
 
-// StartServer starts the STCP server side
+// StartServer starts the STCP server side, addr is a TCP or QUIC address or
+// a Unix domain socket path (see ParseAddr). It may be called several times
+// to accept servers on more than one transport.
 func (r *STCPRouter) StartServer(addr string) error {
-	var err error
-	r.serverListener, err = net.Listen("tcp", addr)
+	ln, err := r.listen(addr)
 	if err != nil {
 		return err
 	}
-
-	go r.acceptServerConnections()
+	r.ServeServer(ln)
 	return nil
 }
 
-// StartVisitor starts the STCP visitor side
+// StartVisitor starts the STCP visitor side, addr is a TCP or QUIC address or
+// a Unix domain socket path (see ParseAddr). It may be called several times
+// to accept visitors on more than one transport.
 func (r *STCPRouter) StartVisitor(addr string) error {
-	var err error
-	r.visitorListener, err = net.Listen("tcp", addr)
+	ln, err := r.listen(addr)
 	if err != nil {
 		return err
 	}
-
-	go r.acceptVisitorConnections()
+	r.ServeVisitor(ln)
 	return nil
 }
 
-// Close stops the router and closes all connections
-func (r *STCPRouter) Close() {
-	r.cancel()
-	if r.serverListener != nil {
-		r.serverListener.Close()
+// listen creates a listener for addr, wrapped in TLS when configured. QUIC
+// listeners use the TLS configuration for the QUIC handshake.
+func (r *STCPRouter) listen(addr string) (net.Listener, error) {
+	l, err := r.loadTLS()
+	if err != nil {
+		return nil, err
+	}
+	if network, address := ParseAddr(addr); network == "quic" {
+		if l == nil {
+			return listenQUIC(address, nil, r.quicConfig())
+		}
+		if l.config.CertFile == "" {
+			return nil, fmt.Errorf("TLS certificate file is required to listen on %s", addr)
+		}
+		return listenQUIC(address, l.serverConfig(), r.quicConfig())
+	}
+	ln, err := Listen(addr, r.config.UnixSocket)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		if l.config.CertFile == "" {
+			ln.Close()
+			return nil, fmt.Errorf("TLS certificate file is required to listen on %s", addr)
+		}
+		ln = tls.NewListener(ln, l.serverConfig())
+	}
+	return ln, nil
+}
+
+// dial connects to another router, using TLS when configured
+func (r *STCPRouter) dial(addr string) (net.Conn, error) {
+	l, err := r.loadTLS()
+	if err != nil {
+		return nil, err
 	}
-	if r.visitorListener != nil {
-		r.visitorListener.Close()
+	return dialTLS(addr, defaultDialTimeout, l, r.quicConfig())
+}
+
+// quicConfig returns the QUIC settings matching the heartbeat configuration
+func (r *STCPRouter) quicConfig() *quic.Config {
+	return quicConfig(r.config.HeartbeatInterval, r.config.HeartbeatTimeout)
+}
+
+// loadTLS loads the TLS files once, it returns nil if TLS is not configured
+func (r *STCPRouter) loadTLS() (*tlsReloader, error) {
+	r.tlsOnce.Do(func() {
+		if r.config.TLS != nil {
+			r.tls, r.tlsErr = newTLSReloader(r.config.TLS)
+		}
+	})
+	return r.tls, r.tlsErr
+}
+
+// ServeServer accepts server connections on an externally supplied listener.
+// The router takes ownership of the listener and closes it on Close. The
+// listener is used as is, TLS is only applied by StartServer.
+func (r *STCPRouter) ServeServer(ln net.Listener) {
+	r.addListener(ln, &r.serverListener)
+	go r.acceptConnections(ln, r.handleServerConnection)
+}
+
+// ServeVisitor accepts visitor connections on an externally supplied listener.
+// The router takes ownership of the listener and closes it on Close. The
+// listener is used as is, TLS is only applied by StartVisitor.
+func (r *STCPRouter) ServeVisitor(ln net.Listener) {
+	r.addListener(ln, &r.visitorListener)
+	go r.acceptConnections(ln, r.handleVisitorConnection)
+}
+
+// addListener records a listener to close on shutdown, first is set if it
+// is the first listener of its side
+func (r *STCPRouter) addListener(ln net.Listener, first *net.Listener) {
+	r.listenersMu.Lock()
+	defer r.listenersMu.Unlock()
+	if *first == nil {
+		*first = ln
+	}
+	r.listeners = append(r.listeners, ln)
+	if r.isDraining() {
+		ln.Close()
 	}
 }
 
-// acceptServerConnections accepts incoming connections on the server side
-func (r *STCPRouter) acceptServerConnections() {
+// Shutdown gracefully stops the router. It stops accepting connections,
+// sends GOAWAY to the linked peers and waits for the active visitor sessions
+// to finish. When ctx is done first the remaining sessions are closed and
+// the context error is returned. Connections are closed in either case.
+func (r *STCPRouter) Shutdown(ctx context.Context) error {
+	r.stopAccepting()
+	r.goAway("router shutting down")
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
 	for {
+		n := r.activeSessions()
+		if n == 0 {
+			r.Close()
+			return nil
+		}
 		select {
-		case <-r.ctx.Done():
-			return
-		default:
-			conn, err := r.serverListener.Accept()
-			if err != nil {
-				continue
-			}
-			go r.handleServerConnection(conn)
+		case <-ctx.Done():
+			klog.Warningf("Shutdown deadline exceeded, closing %d active sessions", n)
+			r.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the router immediately and closes all connections
+func (r *STCPRouter) Close() {
+	r.stopAccepting()
+	r.cancel()
+	if r.config.QuotaFile != "" {
+		if err := r.saveQuotaUsage(); err != nil {
+			klog.Warningf("Failed to save quota usage: %v", err)
+		}
+	}
+
+	r.visitorConns.Range(func(key, value interface{}) bool {
+		value.(*session).conn.Close()
+		return true
+	})
+	r.serverConns.Range(func(key, value interface{}) bool {
+		value.(net.Conn).Close()
+		return true
+	})
+	r.peers.Range(func(key, value interface{}) bool {
+		value.(*peerLink).conn.Close()
+		return true
+	})
+}
+
+// stopAccepting closes the listeners, connections already accepted are kept
+func (r *STCPRouter) stopAccepting() {
+	r.drainOnce.Do(func() {
+		close(r.draining)
+		r.listenersMu.Lock()
+		defer r.listenersMu.Unlock()
+		for _, ln := range r.listeners {
+			ln.Close()
 		}
+	})
+}
+
+// isDraining reports whether the router stopped accepting connections
+func (r *STCPRouter) isDraining() bool {
+	select {
+	case <-r.draining:
+		return true
+	default:
+		return false
 	}
 }
 
-// acceptVisitorConnections accepts incoming connections on the visitor side
-func (r *STCPRouter) acceptVisitorConnections() {
+// activeSessions returns the number of visitor sessions in progress
+func (r *STCPRouter) activeSessions() int {
+	n := 0
+	r.visitorConns.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// acceptConnections accepts connections until the listener is closed.
+// Failed accepts are retried with backoff instead of spinning.
+func (r *STCPRouter) acceptConnections(ln net.Listener, handle func(net.Conn)) {
+	var backoff time.Duration
 	for {
-		select {
-		case <-r.ctx.Done():
-			return
-		default:
-			conn, err := r.visitorListener.Accept()
-			if err != nil {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || r.isDraining() {
+				return
+			}
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else if backoff *= 2; backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			klog.Warningf("Failed to accept connection on %s, retrying in %v: %v", ln.Addr(), backoff, err)
+			select {
+			case <-time.After(backoff):
 				continue
+			case <-r.draining:
+				return
 			}
-			go r.handleVisitorConnection(conn)
 		}
+		backoff = 0
+		go handle(conn)
 	}
 }
 
+// readLogin reads and verifies the login message of a new connection.
+// Failed logins are answered with an error response.
+func (r *STCPRouter) readLogin(conn net.Conn) (*Login, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var login Login
+	if err := ReadMsgInto(conn, TypeLogin, &login); err != nil {
+		return nil, err
+	}
+	if err := r.verifyAuth(&login); err != nil {
+		klog.Warningf("Rejected %s login from %s: %v", login.Role, conn.RemoteAddr(), err)
+		r.reject(conn, "", failureAuth, err)
+		return nil, err
+	}
+	if err := applyCertIdentity(conn, &login); err != nil {
+		klog.Warningf("Rejected %s login from %s: %v", login.Role, conn.RemoteAddr(), err)
+		r.reject(conn, "", failureAuth, err)
+		return nil, err
+	}
+	return &login, nil
+}
+
+// reject answers a login with the given error and counts the failure
+func (r *STCPRouter) reject(conn net.Conn, proxyName, reason string, err error) {
+	recordHandshakeFailure(proxyName, reason)
+	WriteMsg(conn, TypeLoginResp, &LoginResp{Error: err.Error()})
+}
+
 // handleServerConnection handles a new server connection
 func (r *STCPRouter) handleServerConnection(conn net.Conn) {
-	defer conn.Close()
-
-	// Read authentication message
-	authMsg := make([]byte, 32)
-	if _, err := io.ReadFull(conn, authMsg); err != nil {
+	login, err := r.readLogin(conn)
+	if err != nil {
+		conn.Close()
 		return
 	}
 
-	// Verify authentication
-	if !r.verifyAuth(authMsg) {
+	switch login.Role {
+	case RoleServer:
+		r.handleControlConnection(conn, login)
+	case RoleWork:
+		r.handleWorkConnection(conn, login)
+	case RolePeer:
+		r.handlePeerConnection(conn, login)
+	case RoleVisitor:
+		// visitors forwarded by a linked peer router
+		defer conn.Close()
+		if login.Via == "" || !r.isPeer(login.Via) {
+			r.reject(conn, login.ProxyName, failureRole, fmt.Errorf("visitor not forwarded by a linked peer"))
+			return
+		}
+		r.serveVisitor(conn, login)
+	default:
+		r.reject(conn, login.ProxyName, failureRole, fmt.Errorf("unexpected role %q on server listener", login.Role))
+		conn.Close()
+	}
+}
+
+// handleControlConnection registers the proxy of a server and keeps it
+// registered for as long as the control connection stays open
+func (r *STCPRouter) handleControlConnection(conn net.Conn, login *Login) {
+	defer conn.Close()
+
+	allowUsers := login.AllowUsers
+	if len(allowUsers) == 0 {
+		allowUsers = r.config.AllowUsers
+	}
+	p := &proxy{
+		name:       login.ProxyName,
+		runID:      login.RunID,
+		owner:      login.Identity(),
+		allowUsers: allowUsers,
+		startTime:  time.Now(),
+		poolCount:  r.poolCount(login.PoolCount),
+		ctlConn:    conn,
+		workConns:  make(chan net.Conn, workConnQueueSize),
+		done:       make(chan struct{}),
+	}
+	// Hold the control connection until the login response is written so
+	// that work connection requests cannot overtake it
+	p.ctlMu.Lock()
+	replaced, err := r.register(p)
+	if err != nil {
+		p.ctlMu.Unlock()
+		klog.Warningf("Rejected registration of proxy %s by %s: %v", login.ProxyName, p.owner, err)
+		r.reject(conn, login.ProxyName, failureRegister, err)
 		return
 	}
+	defer r.deregister(p)
+	proxyPoolSize.WithLabelValues(p.name).Add(float64(p.poolCount))
+	if replaced != nil {
+		klog.Infof("Proxy %s server %s reconnected, closing previous control connection from %s", p.name, p.runID, replaced.ctlConn.RemoteAddr())
+		replaced.ctlConn.Close()
+		replaced.close()
+	}
 
 	// Generate a unique ID for this connection
 	connID := generateConnID()
 	r.serverConns.Store(connID, conn)
 	defer r.serverConns.Delete(connID)
 
-	// Handle the connection
-	r.handleConnection(conn, connID, true)
+	err = WriteMsg(conn, TypeLoginResp, &LoginResp{})
+	p.ctlMu.Unlock()
+	if err != nil {
+		return
+	}
+	klog.Infof("Proxy %s server %s registered by %s from %s", p.name, p.runID, p.owner, conn.RemoteAddr())
+	r.announceProxies()
+
+	// Fill the work connection pool
+	for i := 0; i < p.poolCount; i++ {
+		if err := r.requestWorkConn(p); err != nil {
+			return
+		}
+	}
+
+	// The control connection only carries heartbeats, wait until it is closed
+	// or the server stops sending them
+	timeout := heartbeatTimeout(r.config.HeartbeatTimeout)
+	for {
+		typ, _, err := readMsgWithTimeout(conn, timeout)
+		if err != nil {
+			if isHeartbeatTimeout(err) {
+				klog.Warningf("Proxy %s sent no heartbeat for %v, closing control connection from %s", p.name, timeout, conn.RemoteAddr())
+				heartbeatTimeouts.WithLabelValues(RoleServer).Inc()
+			} else {
+				klog.Infof("Proxy %s control connection closed: %v", p.name, err)
+			}
+			return
+		}
+		if typ == TypePing {
+			p.ctlMu.Lock()
+			err = WriteMsg(conn, TypePong, &Pong{})
+			p.ctlMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleWorkConnection queues a work connection for the server with the same run ID
+func (r *STCPRouter) handleWorkConnection(conn net.Conn, login *Login) {
+	p := r.lookupMember(login.ProxyName, login.RunID)
+	if p == nil {
+		r.reject(conn, login.ProxyName, failureNotFound, fmt.Errorf("proxy %s server %s not found", login.ProxyName, login.RunID))
+		conn.Close()
+		return
+	}
+	// the claimed user is only verified with mutual TLS
+	if login.User != p.owner.User {
+		r.reject(conn, p.name, failureDenied, fmt.Errorf("proxy %s is not owned by %s", p.name, login.Identity()))
+		conn.Close()
+		return
+	}
+	if err := WriteMsg(conn, TypeLoginResp, &LoginResp{}); err != nil {
+		conn.Close()
+		return
+	}
+	if !p.putWorkConn(conn) {
+		conn.Close()
+	}
 }
 
 // handleVisitorConnection handles a new visitor connection
 func (r *STCPRouter) handleVisitorConnection(conn net.Conn) {
 	defer conn.Close()
 
-	// Read authentication message
-	authMsg := make([]byte, 32)
-	if _, err := io.ReadFull(conn, authMsg); err != nil {
+	login, err := r.readLogin(conn)
+	if err != nil {
+		return
+	}
+	if login.Role != RoleVisitor || login.Via != "" {
+		r.reject(conn, login.ProxyName, failureRole, fmt.Errorf("unexpected role %q on visitor listener", login.Role))
 		return
 	}
+	r.serveVisitor(conn, login)
+}
 
-	// Verify authentication
-	if !r.verifyAuth(authMsg) {
+// serveVisitor attaches a visitor to a work connection of one of the servers
+// of the proxy, or forwards it to the peer router that holds the proxy
+func (r *STCPRouter) serveVisitor(conn net.Conn, login *Login) {
+	visitor := login.Identity()
+	candidates := r.lookupAll(login.ProxyName)
+	if len(candidates) == 0 {
+		// Visitors are forwarded at most once, peers only announce local proxies
+		if login.Via == "" {
+			if link := r.lookupPeer(login.ProxyName); link != nil {
+				r.forwardVisitor(conn, login, link)
+				return
+			}
+		}
+		r.reject(conn, login.ProxyName, failureNotFound, fmt.Errorf("proxy %s not found", login.ProxyName))
 		return
 	}
 
-	// Generate a unique ID for this connection
-	connID := generateConnID()
-	r.visitorConns.Store(connID, conn)
-	defer r.visitorConns.Delete(connID)
+	// Every server enforces its own allow list
+	allowed := candidates[:0]
+	for _, m := range candidates {
+		if Allowed(m.allowUsers, m.owner, visitor) {
+			allowed = append(allowed, m)
+		}
+	}
+	if len(allowed) == 0 {
+		klog.Warningf("audit: denied visitor %s from %s%s access to proxy %s", visitor, conn.RemoteAddr(), via(login), login.ProxyName)
+		r.reject(conn, login.ProxyName, failureDenied, fmt.Errorf("visitor %s is not allowed to visit proxy %s", visitor, login.ProxyName))
+		return
+	}
+	if err := r.checkQuota(login.ProxyName); err != nil {
+		klog.Warningf("Rejected visitor %s from %s%s: %v", visitor, conn.RemoteAddr(), via(login), err)
+		r.reject(conn, login.ProxyName, failureQuota, err)
+		return
+	}
+	p := r.pick(login.ProxyName, allowed, balanceKey(visitor, conn))
+
+	start := time.Now()
+	workConn, err := r.getWorkConn(p, &StartWorkConn{
+		ProxyName: p.name,
+		SrcAddr:   visitorAddr(conn, login),
+		Visitor:   visitor,
+	})
+	if err != nil {
+		klog.Warningf("Failed to get work connection for proxy %s: %v", p.name, err)
+		r.reject(conn, p.name, failureWorkConn, err)
+		return
+	}
+	proxyPairingSeconds.WithLabelValues(p.name).Observe(time.Since(start).Seconds())
+	defer workConn.Close()
+
+	atomic.AddInt64(&p.sessions, 1)
+	defer atomic.AddInt64(&p.sessions, -1)
+
+	// Track the session before answering so that it is visible once the visitor is attached
+	s := r.newSession(conn, p.name, visitor, login.Via)
+	defer r.endSession(s)
+
+	if err := WriteMsg(conn, TypeLoginResp, &LoginResp{}); err != nil {
+		return
+	}
+	klog.Infof("audit: visitor %s from %s%s connected to proxy %s server %s", visitor, conn.RemoteAddr(), via(login), p.name, p.runID)
 
 	// Handle the connection
-	r.handleConnection(conn, connID, false)
+	r.handleConnection(s, workConn)
 }
 
-// handleConnection handles the data transfer between server and visitor
-func (r *STCPRouter) handleConnection(conn net.Conn, connID string, isServer bool) {
-	var remoteConn net.Conn
+// visitorAddr returns the address of a visitor: the remote address of its
+// connection if it is an IP address, otherwise, e.g. for Unix sockets and
+// forwarded visitors, the address reported in the login
+func visitorAddr(conn net.Conn, login *Login) string {
+	if login.Via == "" {
+		if _, _, ok := splitIPPort(conn.RemoteAddr().String()); ok {
+			return conn.RemoteAddr().String()
+		}
+	}
+	if login.Addr != "" {
+		return login.Addr
+	}
+	return conn.RemoteAddr().String()
+}
 
-	// Find the corresponding remote connection
-	if isServer {
-		value, ok := r.visitorConns.Load(connID)
-		if !ok {
-			return
+// via describes the peer router a visitor was forwarded by
+func via(login *Login) string {
+	if login.Via == "" {
+		return ""
+	}
+	return " via peer " + login.Via
+}
+
+// register adds a server to its proxy, see proxyGroup.add
+func (r *STCPRouter) register(p *proxy) (*proxy, error) {
+	if p.name == "" {
+		return nil, fmt.Errorf("proxy name is empty")
+	}
+	if p.runID == "" {
+		return nil, fmt.Errorf("run ID is empty")
+	}
+	r.proxiesMu.Lock()
+	defer r.proxiesMu.Unlock()
+	g := r.proxies[p.name]
+	if g == nil {
+		g = &proxyGroup{name: p.name}
+	}
+	replaced, err := g.add(p)
+	if err != nil {
+		return nil, err
+	}
+	r.proxies[p.name] = g
+	proxyMembers.WithLabelValues(p.name).Set(float64(len(g.members)))
+	return replaced, nil
+}
+
+// deregister removes a server from its proxy and closes its idle work connections
+func (r *STCPRouter) deregister(p *proxy) {
+	r.proxiesMu.Lock()
+	g := r.proxies[p.name]
+	registered := g != nil && g.remove(p)
+	if registered {
+		proxyMembers.WithLabelValues(p.name).Set(float64(len(g.members)))
+		if len(g.members) == 0 {
+			delete(r.proxies, p.name)
+			proxyMembers.DeleteLabelValues(p.name)
 		}
-		remoteConn = value.(net.Conn)
-	} else {
-		value, ok := r.serverConns.Load(connID)
-		if !ok {
+	}
+	r.proxiesMu.Unlock()
+	p.close()
+	if !registered {
+		return
+	}
+	r.announceProxies()
+	klog.Infof("Proxy %s server %s deregistered", p.name, p.runID)
+}
+
+// lookup returns the first registered server of the proxy with the given name
+func (r *STCPRouter) lookup(name string) *proxy {
+	r.proxiesMu.RLock()
+	defer r.proxiesMu.RUnlock()
+	if g := r.proxies[name]; g != nil {
+		return g.members[0]
+	}
+	return nil
+}
+
+// lookupAll returns all registered servers of the proxy with the given name
+func (r *STCPRouter) lookupAll(name string) []*proxy {
+	r.proxiesMu.RLock()
+	defer r.proxiesMu.RUnlock()
+	if g := r.proxies[name]; g != nil {
+		return append([]*proxy(nil), g.members...)
+	}
+	return nil
+}
+
+// lookupMember returns the server of the proxy with the given run ID
+func (r *STCPRouter) lookupMember(name, runID string) *proxy {
+	r.proxiesMu.RLock()
+	defer r.proxiesMu.RUnlock()
+	if g := r.proxies[name]; g != nil {
+		return g.member(runID)
+	}
+	return nil
+}
+
+// pick chooses a server among the candidates of a proxy
+func (r *STCPRouter) pick(name string, candidates []*proxy, key string) *proxy {
+	r.proxiesMu.RLock()
+	g := r.proxies[name]
+	r.proxiesMu.RUnlock()
+	if g == nil {
+		return candidates[0]
+	}
+	return g.pick(r.config.LoadBalance, candidates, key)
+}
+
+// poolCount returns the pool size granted for a requested pool size
+func (r *STCPRouter) poolCount(requested int) int {
+	max := r.config.MaxPoolCount
+	if max <= 0 {
+		max = defaultMaxPoolCount
+	}
+	if max > workConnQueueSize {
+		max = workConnQueueSize
+	}
+	if requested > max {
+		return max
+	}
+	if requested < 0 {
+		return 0
+	}
+	return requested
+}
+
+// requestWorkConn asks the server of the proxy to open a work connection
+func (r *STCPRouter) requestWorkConn(p *proxy) error {
+	p.ctlMu.Lock()
+	defer p.ctlMu.Unlock()
+	if err := WriteMsg(p.ctlConn, TypeNewWorkConn, &NewWorkConn{ProxyName: p.name}); err != nil {
+		return fmt.Errorf("failed to request work connection: %v", err)
+	}
+	return nil
+}
+
+// getWorkConn returns an idle work connection of the proxy, asking the
+// server for a new one if none is queued. Connections taken from the pool
+// are replaced in the background. The connection is started with start,
+// which describes the visitor to the server.
+func (r *STCPRouter) getWorkConn(p *proxy, start *StartWorkConn) (net.Conn, error) {
+	for {
+		var conn net.Conn
+		select {
+		case conn = <-p.workConns:
+			proxyPoolIdle.WithLabelValues(p.name).Dec()
+			proxyPoolRequests.WithLabelValues(p.name, "hit").Inc()
+			if p.poolCount > 0 {
+				go r.requestWorkConn(p)
+			}
+		default:
+			proxyPoolRequests.WithLabelValues(p.name, "miss").Inc()
+			if err := r.requestWorkConn(p); err != nil {
+				return nil, err
+			}
+
+			timer := time.NewTimer(workConnTimeout)
+			select {
+			case conn = <-p.workConns:
+				timer.Stop()
+				proxyPoolIdle.WithLabelValues(p.name).Dec()
+			case <-timer.C:
+				return nil, fmt.Errorf("timeout waiting for work connection of proxy %s", p.name)
+			case <-p.done:
+				timer.Stop()
+				return nil, fmt.Errorf("proxy %s deregistered", p.name)
+			case <-r.ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("router closed")
+			}
+		}
+
+		// Pooled connections may have died while idle, try the next one
+		if err := WriteMsg(conn, TypeStartWorkConn, start); err != nil {
+			klog.Warningf("Discarding broken work connection of proxy %s: %v", p.name, err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// putWorkConn queues an idle work connection, it reports false if the
+// proxy is closed or the queue is full
+func (p *proxy) putWorkConn(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.workConns <- conn:
+		proxyPoolIdle.WithLabelValues(p.name).Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+// close marks the proxy as closed and closes its idle work connections
+func (p *proxy) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+		proxyPoolSize.WithLabelValues(p.name).Sub(float64(p.poolCount))
+	}
+	for {
+		select {
+		case conn := <-p.workConns:
+			proxyPoolIdle.WithLabelValues(p.name).Dec()
+			conn.Close()
+		default:
 			return
 		}
-		remoteConn = value.(net.Conn)
 	}
+}
+
+// handleConnection handles the data transfer between a visitor session and
+// the server and accounts the traffic to the session and its proxy
+func (r *STCPRouter) handleConnection(s *session, remoteConn net.Conn) {
+	proxyName := s.proxyName
 
 	// Create encrypted streams if needed
-	var localStream, remoteStream io.ReadWriteCloser = conn, remoteConn
+	var localStream, remoteStream io.ReadWriteCloser = s.conn, remoteConn
 	if r.config.UseEncryption {
 		var err error
-		localStream, err = newEncryptedStream(conn, []byte(r.config.SecretKey))
+		localStream, err = newEncryptedStream(s.conn, []byte(r.config.SecretKey))
 		if err != nil {
 			return
 		}
@@ -198,91 +859,98 @@ func (r *STCPRouter) handleConnection(conn net.Conn, connID string, isServer boo
 		}
 	}
 
-	// Start bidirectional data transfer
-	go func() {
-		io.Copy(remoteStream, localStream)
-		remoteStream.Close()
-	}()
-	io.Copy(localStream, remoteStream)
-	localStream.Close()
-}
+	stats := r.trafficStats(proxyName)
+	atomic.AddInt64(&stats.active, 1)
+	defer atomic.AddInt64(&stats.active, -1)
+	proxyStreams.WithLabelValues(proxyName).Inc()
+	proxyActiveStreams.WithLabelValues(proxyName).Inc()
+	defer proxyActiveStreams.WithLabelValues(proxyName).Dec()
 
-// verifyAuth verifies the authentication message
-func (r *STCPRouter) verifyAuth(authMsg []byte) bool {
-	// TODO: Implement proper authentication
-	return true
+	buckets, release := r.sessionLimiters(s)
+	defer release()
+	join(r.newCountingStream(s, localStream, buckets), remoteStream)
 }
 
 // generateConnID generates a unique connection ID
 func generateConnID() string {
 	b := make([]byte, 16)
 	rand.Read(b)
-	return string(b)
+	return hex.EncodeToString(b)
 }
 
-// newEncryptedStream creates a new encrypted stream
-func newEncryptedStream(conn net.Conn, key []byte) (io.ReadWriteCloser, error) {
-	block, err := aes.NewCipher(key)
+// newEncryptedStream creates a new encrypted stream, the AES key is derived
+// from the secret key so any secret length can be used
+func newEncryptedStream(conn net.Conn, key []byte) (*encryptedStream, error) {
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
 	if err != nil {
 		return nil, err
 	}
 
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, err
-	}
-
 	return &encryptedStream{
-		conn:  conn,
+		Conn:  conn,
 		block: block,
-		iv:    iv,
 	}, nil
 }
 
-// encryptedStream implements encrypted communication
+// encryptedStream implements encrypted communication. Each direction starts
+// with a random IV followed by the AES-CTR key stream.
 type encryptedStream struct {
-	conn  net.Conn
+	net.Conn
 	block cipher.Block
-	iv    []byte
+	enc   cipher.Stream
+	dec   cipher.Stream
 }
 
 func (s *encryptedStream) Read(p []byte) (n int, err error) {
 	// Read IV
-	if _, err := io.ReadFull(s.conn, s.iv); err != nil {
-		return 0, err
-	}
-
-	// Read encrypted data
-	ciphertext := make([]byte, len(p))
-	n, err = s.conn.Read(ciphertext)
-	if err != nil {
-		return 0, err
+	if s.dec == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(s.Conn, iv); err != nil {
+			return 0, err
+		}
+		s.dec = cipher.NewCTR(s.block, iv)
 	}
 
-	// Decrypt
-	stream := cipher.NewCFBDecrypter(s.block, s.iv)
-	stream.XORKeyStream(p[:n], ciphertext[:n])
-	return n, nil
+	// Read and decrypt
+	n, err = s.Conn.Read(p)
+	s.dec.XORKeyStream(p[:n], p[:n])
+	return n, err
 }
 
 func (s *encryptedStream) Write(p []byte) (n int, err error) {
-	// Generate new IV
-	if _, err := io.ReadFull(rand.Reader, s.iv); err != nil {
-		return 0, err
+	// Generate and write IV
+	if s.enc == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			return 0, err
+		}
+		if _, err := s.Conn.Write(iv); err != nil {
+			return 0, err
+		}
+		s.enc = cipher.NewCTR(s.block, iv)
 	}
 
-	// Write IV
-	if _, err := s.conn.Write(s.iv); err != nil {
-		return 0, err
+	// Encrypt and write through a pooled buffer
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	for len(p) > 0 {
+		chunk := (*buf)[:min(len(p), len(*buf))]
+		s.enc.XORKeyStream(chunk, p[:len(chunk)])
+		m, err := s.Conn.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
 	}
-
-	// Encrypt and write
-	ciphertext := make([]byte, len(p))
-	stream := cipher.NewCFBEncrypter(s.block, s.iv)
-	stream.XORKeyStream(ciphertext, p)
-	return s.conn.Write(ciphertext)
+	return n, nil
 }
 
-func (s *encryptedStream) Close() error {
-	return s.conn.Close()
+// CloseWrite shuts down the write side of the underlying connection if supported
+func (s *encryptedStream) CloseWrite() error {
+	if cw, ok := s.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
 }
@@ -1,111 +1,124 @@
 package router
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestSTCPRouter(t *testing.T) {
-	// Create router instance
-	config := &STCPConfig{
-		SecretKey:      "test-secret-key",
-		UseEncryption:  true,
-		UseCompression: false,
-	}
-	router := NewSTCPRouter(config)
-
-	// Start server and visitor
-	err := router.StartServer("127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("Failed to start server: %v", err)
-	}
-	err = router.StartVisitor("127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("Failed to start visitor: %v", err)
-	}
-
-	// Get server and visitor addresses
-	serverAddr := router.serverListener.Addr().String()
-	visitorAddr := router.visitorListener.Addr().String()
-
-	// Create test server
+// startEchoServer starts a TCP server echoing back any data received
+func startEchoServer(t *testing.T) string {
 	server, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatalf("Failed to create test server: %v", err)
 	}
-	defer server.Close()
+	t.Cleanup(func() { server.Close() })
 
-	// Start test server
 	go func() {
-		conn, err := server.Accept()
-		if err != nil {
-			t.Errorf("Failed to accept connection: %v", err)
-			return
-		}
-		defer conn.Close()
-
-		// Echo back any data received
-		buf := make([]byte, 1024)
 		for {
-			n, err := conn.Read(buf)
+			conn, err := server.Accept()
 			if err != nil {
 				return
 			}
-			conn.Write(buf[:n])
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			}(conn)
 		}
 	}()
+	return server.Addr().String()
+}
 
-	// Connect to server through STCP
-	serverConn, err := net.Dial("tcp", serverAddr)
-	if err != nil {
-		t.Fatalf("Failed to connect to STCP server: %v", err)
+// startTestRouter starts a router with server and visitor listeners on random ports
+func startTestRouter(t *testing.T, config *STCPConfig) *STCPRouter {
+	router := NewSTCPRouter(config)
+	if err := router.StartServer("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
 	}
-	defer serverConn.Close()
-
-	// Connect to visitor through STCP
-	visitorConn, err := net.Dial("tcp", visitorAddr)
-	if err != nil {
-		t.Fatalf("Failed to connect to STCP visitor: %v", err)
+	if err := router.StartVisitor("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start visitor: %v", err)
 	}
-	defer visitorConn.Close()
+	t.Cleanup(router.Close)
+	return router
+}
 
-	// Test data transfer
-	testData := []byte("Hello, STCP!")
-	_, err = serverConn.Write(testData)
-	if err != nil {
-		t.Fatalf("Failed to write test data: %v", err)
+// startTestServerClient registers an exported proxy forwarding to localAddr
+func startTestServerClient(t *testing.T, config *ClientConfig, localAddr string) *ServerClient {
+	client := NewServerClient(config, localAddr)
+	if err := client.Start(); err != nil {
+		t.Fatalf("Failed to register proxy %s: %v", config.ProxyName, err)
 	}
+	t.Cleanup(client.Close)
+	return client
+}
 
-	buf := make([]byte, len(testData))
-	_, err = visitorConn.Read(buf)
-	if err != nil {
-		t.Fatalf("Failed to read test data: %v", err)
+// echo writes data to conn and checks that it is echoed back
+func echo(conn net.Conn, data string) error {
+	if _, err := conn.Write([]byte(data)); err != nil {
+		return fmt.Errorf("failed to write test data: %v", err)
 	}
-
-	if string(buf) != string(testData) {
-		t.Errorf("Data mismatch: got %s, want %s", string(buf), string(testData))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("failed to read test data: %v", err)
+	}
+	if string(buf) != data {
+		return fmt.Errorf("data mismatch: got %s, want %s", string(buf), data)
 	}
+	return nil
+}
 
-	// Test bidirectional communication
-	testData = []byte("Hello from visitor!")
-	_, err = visitorConn.Write(testData)
-	if err != nil {
-		t.Fatalf("Failed to write test data from visitor: %v", err)
+func TestSTCPRouter(t *testing.T) {
+	// Create router instance
+	config := &STCPConfig{
+		SecretKey:      "test-secret-key",
+		UseEncryption:  true,
+		UseCompression: false,
 	}
+	router := startTestRouter(t, config)
 
-	buf = make([]byte, len(testData))
-	_, err = serverConn.Read(buf)
+	// Get server and visitor addresses
+	serverAddr := router.serverListener.Addr().String()
+	visitorAddr := router.visitorListener.Addr().String()
+
+	// Register the test server through STCP
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr:    serverAddr,
+		SecretKey:     config.SecretKey,
+		ProxyName:     "echo",
+		UseEncryption: true,
+	}, startEchoServer(t))
+
+	// Connect to the test server through STCP
+	visitorConn, err := DialVisitor(&ClientConfig{
+		RouterAddr:    visitorAddr,
+		SecretKey:     config.SecretKey,
+		ProxyName:     "echo",
+		UseEncryption: true,
+	})
 	if err != nil {
-		t.Fatalf("Failed to read test data on server: %v", err)
+		t.Fatalf("Failed to connect to STCP visitor: %v", err)
 	}
+	defer visitorConn.Close()
 
-	if string(buf) != string(testData) {
-		t.Errorf("Data mismatch: got %s, want %s", string(buf), string(testData))
+	// Test bidirectional communication
+	if err := echo(visitorConn, "Hello, STCP!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(visitorConn, "Hello from visitor!"); err != nil {
+		t.Fatal(err)
 	}
-
-	// Cleanup
-	router.Close()
 }
 
 func TestSTCPRouterConcurrent(t *testing.T) {
@@ -115,49 +128,30 @@ func TestSTCPRouterConcurrent(t *testing.T) {
 		UseEncryption:  true,
 		UseCompression: false,
 	}
-	router := NewSTCPRouter(config)
-
-	// Start server and visitor
-	err := router.StartServer("127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("Failed to start server: %v", err)
-	}
-	err = router.StartVisitor("127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("Failed to start visitor: %v", err)
-	}
+	router := startTestRouter(t, config)
 
 	// Get server and visitor addresses
 	serverAddr := router.serverListener.Addr().String()
 	visitorAddr := router.visitorListener.Addr().String()
 
-	// Create test server
-	server, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("Failed to create test server: %v", err)
-	}
-	defer server.Close()
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr:    serverAddr,
+		SecretKey:     config.SecretKey,
+		ProxyName:     "echo",
+		UseEncryption: true,
+	}, startEchoServer(t))
 
-	// Start test server
-	go func() {
-		for {
-			conn, err := server.Accept()
-			if err != nil {
-				return
-			}
-			go func(conn net.Conn) {
-				defer conn.Close()
-				buf := make([]byte, 1024)
-				for {
-					n, err := conn.Read(buf)
-					if err != nil {
-						return
-					}
-					conn.Write(buf[:n])
-				}
-			}(conn)
-		}
-	}()
+	// Visit through a local visitor client
+	visitor := NewVisitorClient(&ClientConfig{
+		RouterAddr:    visitorAddr,
+		SecretKey:     config.SecretKey,
+		ProxyName:     "echo",
+		UseEncryption: true,
+	}, "127.0.0.1:0")
+	if err := visitor.Start(); err != nil {
+		t.Fatalf("Failed to start visitor client: %v", err)
+	}
+	defer visitor.Close()
 
 	// Test concurrent connections
 	const numConnections = 10
@@ -165,48 +159,18 @@ func TestSTCPRouterConcurrent(t *testing.T) {
 
 	for i := 0; i < numConnections; i++ {
 		go func(id int) {
-			// Connect to server through STCP
-			serverConn, err := net.Dial("tcp", serverAddr)
-			if err != nil {
-				t.Errorf("Failed to connect to STCP server: %v", err)
-				done <- true
-				return
-			}
-			defer serverConn.Close()
-
-			// Connect to visitor through STCP
-			visitorConn, err := net.Dial("tcp", visitorAddr)
-			if err != nil {
-				t.Errorf("Failed to connect to STCP visitor: %v", err)
-				done <- true
-				return
-			}
-			defer visitorConn.Close()
-
-			// Test data transfer
-			testData := []byte("Hello, STCP!")
-			_, err = serverConn.Write(testData)
-			if err != nil {
-				t.Errorf("Failed to write test data: %v", err)
-				done <- true
-				return
-			}
+			defer func() { done <- true }()
 
-			buf := make([]byte, len(testData))
-			_, err = visitorConn.Read(buf)
+			conn, err := net.Dial("tcp", visitor.Addr().String())
 			if err != nil {
-				t.Errorf("Failed to read test data: %v", err)
-				done <- true
+				t.Errorf("Failed to connect to visitor client: %v", err)
 				return
 			}
+			defer conn.Close()
 
-			if string(buf) != string(testData) {
-				t.Errorf("Data mismatch: got %s, want %s", string(buf), string(testData))
-				done <- true
-				return
+			if err := echo(conn, fmt.Sprintf("Hello, STCP! Connection %d", id)); err != nil {
+				t.Error(err)
 			}
-
-			done <- true
 		}(i)
 	}
 
@@ -215,11 +179,255 @@ func TestSTCPRouterConcurrent(t *testing.T) {
 		select {
 		case <-done:
 			continue
-		case <-time.After(5 * time.Second):
+		case <-time.After(10 * time.Second):
 			t.Fatal("Test timed out")
 		}
 	}
+}
 
-	// Cleanup
-	router.Close()
+func TestSTCPRouterAllowUsers(t *testing.T) {
+	config := &STCPConfig{SecretKey: "test-secret-key"}
+	router := startTestRouter(t, config)
+	serverAddr := router.serverListener.Addr().String()
+	visitorAddr := router.visitorListener.Addr().String()
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: serverAddr,
+		SecretKey:  config.SecretKey,
+		ProxyName:  "backend.default.svc.cluster-a:http",
+		User:       "backend",
+		AllowUsers: []string{"alice", "namespace:web"},
+	}, startEchoServer(t))
+
+	tests := []struct {
+		name    string
+		visitor ClientConfig
+		allowed bool
+	}{
+		{"allowed user", ClientConfig{User: "alice"}, true},
+		{"allowed namespace", ClientConfig{User: "frontend", Namespace: "web", Cluster: "cluster-b"}, true},
+		{"denied user", ClientConfig{User: "bob", Namespace: "default"}, false},
+		{"anonymous", ClientConfig{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.visitor
+			cfg.RouterAddr = visitorAddr
+			cfg.SecretKey = config.SecretKey
+			cfg.ProxyName = "backend.default.svc.cluster-a:http"
+
+			conn, err := DialVisitor(&cfg)
+			if !tt.allowed {
+				if err == nil {
+					conn.Close()
+					t.Fatal("Expected visitor to be rejected")
+				}
+				if !strings.Contains(err.Error(), "not allowed") {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to visit proxy: %v", err)
+			}
+			defer conn.Close()
+			if err := echo(conn, "Hello, "+tt.name); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSTCPRouterDefaultAllowUsers(t *testing.T) {
+	config := &STCPConfig{SecretKey: "test-secret-key", AllowUsers: []string{"cluster:cluster-b"}}
+	router := startTestRouter(t, config)
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  config.SecretKey,
+		ProxyName:  "echo",
+		User:       "backend",
+	}, startEchoServer(t))
+
+	visitor := &ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  config.SecretKey,
+		ProxyName:  "echo",
+		User:       "frontend",
+		Cluster:    "cluster-b",
+	}
+	conn, err := DialVisitor(visitor)
+	if err != nil {
+		t.Fatalf("Failed to visit proxy: %v", err)
+	}
+	conn.Close()
+
+	visitor.Cluster = "cluster-c"
+	if conn, err := DialVisitor(visitor); err == nil {
+		conn.Close()
+		t.Fatal("Expected visitor from another cluster to be rejected")
+	}
+}
+
+func TestSTCPRouterRejectsInvalidLogin(t *testing.T) {
+	config := &STCPConfig{SecretKey: "test-secret-key"}
+	router := startTestRouter(t, config)
+
+	// Wrong secret key
+	client := NewServerClient(&ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "wrong-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+	if err := client.Start(); err == nil {
+		client.Close()
+		t.Fatal("Expected login with wrong secret key to fail")
+	}
+
+	// Unknown proxy
+	_, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  config.SecretKey,
+		ProxyName:  "missing",
+	})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("Expected proxy not found error, got %v", err)
+	}
+
+	// Registration of a proxy owned by another user
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  config.SecretKey,
+		ProxyName:  "echo",
+		User:       "alice",
+	}, startEchoServer(t))
+	duplicate := NewServerClient(&ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  config.SecretKey,
+		ProxyName:  "echo",
+		User:       "mallory",
+	}, startEchoServer(t))
+	if err := duplicate.Start(); err == nil {
+		duplicate.Close()
+		t.Fatal("Expected registration by another owner to fail")
+	}
+}
+
+func TestSTCPRouterShutdownDrainsSessions(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+	visitorAddr := router.visitorListener.Addr().String()
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+
+	conn, err := DialVisitor(&ClientConfig{RouterAddr: visitorAddr, SecretKey: "test-secret-key", ProxyName: "echo"})
+	if err != nil {
+		t.Fatalf("Failed to connect visitor: %v", err)
+	}
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- router.Shutdown(ctx)
+	}()
+	waitFor(t, "listeners to close", router.isDraining)
+
+	// New visitors are refused while the active session keeps working
+	if _, err := DialVisitor(&ClientConfig{RouterAddr: visitorAddr, SecretKey: "test-secret-key", ProxyName: "echo", DialTimeout: time.Second}); err == nil {
+		t.Fatal("Expected new visitor to be refused during shutdown")
+	}
+	if err := echo(conn, "Still here"); err != nil {
+		t.Fatalf("Active session broken during shutdown: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned with an active session: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after the session finished")
+	}
+}
+
+func TestSTCPRouterShutdownDeadline(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key"})
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	}, startEchoServer(t))
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect visitor: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := router.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected active session to be force-closed")
+	}
+	waitFor(t, "proxy deregistration", func() bool { return router.lookup("echo") == nil })
+}
+
+func TestSTCPRouterWorkConnPool(t *testing.T) {
+	router := startTestRouter(t, &STCPConfig{SecretKey: "test-secret-key", MaxPoolCount: 4})
+
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "pool-echo",
+		PoolCount:  8,
+	}, startEchoServer(t))
+
+	// The requested pool is capped by the router
+	p := router.lookup("pool-echo")
+	if p.poolCount != 4 {
+		t.Fatalf("Pool size = %d; want 4", p.poolCount)
+	}
+	waitFor(t, "pool fill", func() bool { return len(p.workConns) == 4 })
+
+	hits := counterValue(proxyPoolRequests.WithLabelValues("pool-echo", "hit"))
+	for i := 0; i < 3; i++ {
+		conn, err := DialVisitor(&ClientConfig{
+			RouterAddr: router.visitorListener.Addr().String(),
+			SecretKey:  "test-secret-key",
+			ProxyName:  "pool-echo",
+		})
+		if err != nil {
+			t.Fatalf("Failed to visit proxy: %v", err)
+		}
+		if err := echo(conn, fmt.Sprintf("Hello, pool %d!", i)); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	if got := counterValue(proxyPoolRequests.WithLabelValues("pool-echo", "hit")) - hits; got != 3 {
+		t.Errorf("Pool hits = %v; want 3", got)
+	}
+	waitFor(t, "pool refill", func() bool { return len(p.workConns) == 4 })
 }
@@ -0,0 +1,271 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"k8s.io/klog"
+)
+
+// tlsReloadInterval is the minimum time between two checks of the
+// certificate files for rotation
+var tlsReloadInterval = 5 * time.Second
+
+// TLSConfig configures TLS 1.3 for router connections. Files are watched and
+// reloaded when they change, so rotated certificates are picked up by new
+// connections without a restart.
+type TLSConfig struct {
+	// CertFile and KeyFile hold the PEM certificate and key presented to the
+	// other side. They are required on the listening side and enable client
+	// certificates on the dialing side.
+	CertFile string
+	KeyFile  string
+	// CAFile holds the PEM CA certificates to verify the other side with.
+	// On the listening side it enables mutual TLS: clients must present a
+	// certificate signed by one of the CAs. On the dialing side it replaces
+	// the system roots.
+	CAFile string
+	// ServerName is the name verified in the router certificate when dialing,
+	// empty uses the host of the dialed address, or "localhost" for Unix sockets
+	ServerName string
+}
+
+// tlsReloader keeps the certificate and CA pool of a TLSConfig up to date
+type tlsReloader struct {
+	config *TLSConfig
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+// tlsReloaders caches the reloaders of client configurations
+var tlsReloaders sync.Map // map[*TLSConfig]*tlsReloader
+
+// newTLSReloader loads the files of a TLS configuration
+func newTLSReloader(config *TLSConfig) (*tlsReloader, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("TLS certificate and key files must be set together")
+	}
+	l := &tlsReloader{config: config}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	l.checked = time.Now()
+	return l, nil
+}
+
+// clientTLSReloader returns the shared reloader of a client configuration
+func clientTLSReloader(config *TLSConfig) (*tlsReloader, error) {
+	if value, ok := tlsReloaders.Load(config); ok {
+		return value.(*tlsReloader), nil
+	}
+	l, err := newTLSReloader(config)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := tlsReloaders.LoadOrStore(config, l)
+	return value.(*tlsReloader), nil
+}
+
+// load reads the certificate, key and CA files
+func (l *tlsReloader) load() error {
+	var cert *tls.Certificate
+	if l.config.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(l.config.CertFile, l.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if l.config.CAFile != "" {
+		pem, err := os.ReadFile(l.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS CA file: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in TLS CA file %s", l.config.CAFile)
+		}
+	}
+
+	l.cert, l.pool = cert, pool
+	l.modTimes = l.statFiles()
+	return nil
+}
+
+// statFiles returns the modification times of the configured files
+func (l *tlsReloader) statFiles() [3]time.Time {
+	var times [3]time.Time
+	for i, path := range []string{l.config.CertFile, l.config.KeyFile, l.config.CAFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// current returns the certificate and CA pool, reloading them if the files
+// changed. A failed reload keeps the previous files in use.
+func (l *tlsReloader) current() (*tls.Certificate, *x509.CertPool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.checked) >= tlsReloadInterval {
+		l.checked = now
+		if l.statFiles() != l.modTimes {
+			if err := l.load(); err != nil {
+				klog.Warningf("Failed to reload TLS files, keeping the previous ones: %v", err)
+			} else {
+				klog.Infof("Reloaded TLS certificate %s", l.config.CertFile)
+			}
+		}
+	}
+	return l.cert, l.pool
+}
+
+// serverConfig returns the TLS configuration of a listener
+func (l *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := l.current()
+			if cert == nil {
+				return nil, fmt.Errorf("no TLS certificate configured")
+			}
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				config.ClientCAs = pool
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// clientConfig returns the TLS configuration to dial addr with
+func (l *tlsReloader) clientConfig(addr string) *tls.Config {
+	cert, pool := l.current()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		RootCAs:    pool,
+		ServerName: l.config.ServerName,
+	}
+	if config.ServerName == "" {
+		config.ServerName = "localhost"
+		if network, address := ParseAddr(addr); network == "tcp" {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				config.ServerName = host
+			}
+		}
+	}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return config
+}
+
+// dialTLS connects to addr and completes the TLS handshake when l is set.
+// QUIC always uses TLS, the configuration of l is applied to the QUIC
+// handshake instead.
+func dialTLS(addr string, timeout time.Duration, l *tlsReloader, quicConf *quic.Config) (net.Conn, error) {
+	if network, address := ParseAddr(addr); network == "quic" && l != nil {
+		return dialQUIC(fmt.Sprintf("%p|%s", l, address), address, l.clientConfig(addr), quicConf, timeout)
+	}
+	conn, err := dial(addr, timeout, quicConf)
+	if err != nil || l == nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, l.clientConfig(addr))
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// CertIdentity maps a client certificate to an identity: the common name is
+// the user, the first organizational unit the namespace and the first
+// organization the cluster
+func CertIdentity(cert *x509.Certificate) Identity {
+	id := Identity{User: cert.Subject.CommonName}
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		id.Namespace = cert.Subject.OrganizationalUnit[0]
+	}
+	if len(cert.Subject.Organization) > 0 {
+		id.Cluster = cert.Subject.Organization[0]
+	}
+	return id
+}
+
+// tlsConn is a connection secured by TLS, either TLS over TCP or a QUIC stream
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// peerCertIdentity returns the identity of the verified client certificate
+// of conn, or false if conn is not TLS or carries no client certificate
+func peerCertIdentity(conn net.Conn) (Identity, bool) {
+	secured, ok := conn.(tlsConn)
+	if !ok {
+		return Identity{}, false
+	}
+	state := secured.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return Identity{}, false
+	}
+	return CertIdentity(state.PeerCertificates[0]), true
+}
+
+// applyCertIdentity binds a login to the client certificate of the connection.
+// The certificate identity replaces the claimed identity, claims that
+// contradict the certificate are rejected. Peers must present a certificate
+// for their router name, and visitors forwarded by a peer keep their
+// identity but must arrive from that peer.
+func applyCertIdentity(conn net.Conn, login *Login) error {
+	id, ok := peerCertIdentity(conn)
+	if !ok {
+		return nil
+	}
+	switch {
+	case login.Role == RolePeer:
+		if login.User != id.User {
+			return fmt.Errorf("peer name %q does not match certificate %s", login.User, id.User)
+		}
+	case login.Via != "":
+		if login.Via != id.User {
+			return fmt.Errorf("forwarding router %q does not match certificate %s", login.Via, id.User)
+		}
+	default:
+		if login.User != "" && login.User != id.User ||
+			login.Namespace != "" && id.Namespace != "" && login.Namespace != id.Namespace ||
+			login.Cluster != "" && id.Cluster != "" && login.Cluster != id.Cluster {
+			return fmt.Errorf("login identity %s does not match certificate %s", login.Identity(), id)
+		}
+		login.User = id.User
+		if id.Namespace != "" {
+			login.Namespace = id.Namespace
+		}
+		if id.Cluster != "" {
+			login.Cluster = id.Cluster
+		}
+	}
+	return nil
+}
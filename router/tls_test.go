@@ -0,0 +1,282 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate and key for subject into dir and returns their paths
+func (ca *testCA) issue(t *testing.T, dir, name string, subject pkix.Name) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+// writeFile replaces the content of a file
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTLSRouter starts a router with mutual TLS and returns the CA file the
+// clients trust
+func startTLSRouter(t *testing.T, ca *testCA, dir string) (*STCPRouter, string) {
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	certFile, keyFile := ca.issue(t, dir, "router", pkix.Name{CommonName: "router-a"})
+	router := startTestRouter(t, &STCPConfig{
+		SecretKey: "test-secret-key",
+		TLS:       &TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+	})
+	return router, caFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	router, caFile := startTLSRouter(t, ca, dir)
+
+	serverCert, serverKey := ca.issue(t, dir, "backend", pkix.Name{CommonName: "backend", OrganizationalUnit: []string{"default"}})
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		AllowUsers: []string{"alice"},
+		TLS:        &TLSConfig{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile},
+	}, startEchoServer(t))
+
+	// The owner identity comes from the certificate
+	if p := router.lookup("echo"); p.owner.User != "backend" || p.owner.Namespace != "default" {
+		t.Fatalf("Unexpected owner: %s", p.owner)
+	}
+
+	// The visitor is admitted by the common name of its certificate
+	aliceCert, aliceKey := ca.issue(t, dir, "alice", pkix.Name{CommonName: "alice"})
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		TLS:        &TLSConfig{CertFile: aliceCert, KeyFile: aliceKey, CAFile: caFile},
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy over mutual TLS: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello over TLS!"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Claiming another identity than the certificate is rejected
+	bobCert, bobKey := ca.issue(t, dir, "bob", pkix.Name{CommonName: "bob"})
+	_, err = DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		User:       "alice",
+		TLS:        &TLSConfig{CertFile: bobCert, KeyFile: bobKey, CAFile: caFile},
+	})
+	if err == nil || !strings.Contains(err.Error(), "does not match certificate") {
+		t.Fatalf("Expected identity mismatch to be rejected, got %v", err)
+	}
+
+	// Without a client certificate the handshake fails
+	_, err = DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		TLS:        &TLSConfig{CAFile: caFile},
+	})
+	if err == nil {
+		t.Fatal("Expected visitor without client certificate to be rejected")
+	}
+
+	// A certificate from another CA is not trusted
+	otherCert, otherKey := newTestCA(t).issue(t, dir, "other", pkix.Name{CommonName: "alice"})
+	_, err = DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		TLS:        &TLSConfig{CertFile: otherCert, KeyFile: otherKey, CAFile: caFile},
+	})
+	if err == nil {
+		t.Fatal("Expected certificate from an unknown CA to be rejected")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	interval := tlsReloadInterval
+	tlsReloadInterval = 0
+	defer func() { tlsReloadInterval = interval }()
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	router, caFile := startTLSRouter(t, ca, dir)
+
+	certFile, keyFile := ca.issue(t, dir, "client", pkix.Name{CommonName: "backend"})
+	clientTLS := &TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: router.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		TLS:        clientTLS,
+	}, startEchoServer(t))
+
+	// Rotate to a new CA on both sides, files are replaced in place
+	rotated := newTestCA(t)
+	writeFile(t, caFile, append(append([]byte{}, ca.pem...), rotated.pem...))
+	rotated.issue(t, dir, "router", pkix.Name{CommonName: "router-a"})
+	rotated.issue(t, dir, "client", pkix.Name{CommonName: "backend"})
+
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: router.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		User:       "backend",
+		TLS:        clientTLS,
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy after rotation: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello after rotation!"); err != nil {
+		t.Fatal(err)
+	}
+	routerCert := conn.(*tls.Conn).ConnectionState().PeerCertificates[0]
+	if err := routerCert.CheckSignatureFrom(rotated.cert); err != nil {
+		t.Fatalf("Expected router to present the rotated certificate: %v", err)
+	}
+}
+
+func TestPeerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+
+	newRouter := func(name string) *STCPRouter {
+		certFile, keyFile := ca.issue(t, dir, name, pkix.Name{CommonName: name})
+		router := startTestRouter(t, &STCPConfig{
+			SecretKey: "test-secret-key",
+			Name:      name,
+			TLS:       &TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+		})
+		return router
+	}
+	routerA := newRouter("router-a")
+	routerB := newRouter("router-b")
+	routerA.config.Peers = []PeerConfig{{Name: "router-b", Addr: routerB.serverListener.Addr().String()}}
+	routerB.config.Peers = []PeerConfig{{Name: "router-a", Addr: routerA.serverListener.Addr().String()}}
+	routerB.StartPeers()
+	waitFor(t, "peer link", func() bool {
+		return routerA.isPeer("router-b") && routerB.isPeer("router-a")
+	})
+
+	certFile, keyFile := ca.issue(t, dir, "backend", pkix.Name{CommonName: "backend"})
+	startTestServerClient(t, &ClientConfig{
+		RouterAddr: routerA.serverListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		AllowUsers: []string{"alice"},
+		TLS:        &TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+	}, startEchoServer(t))
+	waitFor(t, "proxy announcement", func() bool {
+		return routerB.lookupPeer("echo") != nil
+	})
+
+	// The visitor identity from router-b's certificate check is kept across the peer
+	aliceCert, aliceKey := ca.issue(t, dir, "alice", pkix.Name{CommonName: "alice"})
+	conn, err := DialVisitor(&ClientConfig{
+		RouterAddr: routerB.visitorListener.Addr().String(),
+		SecretKey:  "test-secret-key",
+		ProxyName:  "echo",
+		TLS:        &TLSConfig{CertFile: aliceCert, KeyFile: aliceKey, CAFile: caFile},
+	})
+	if err != nil {
+		t.Fatalf("Failed to visit proxy through TLS peer: %v", err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "Hello across TLS peers!"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer whose certificate does not match its router name is rejected
+	conn2, err := dialTLS(routerA.serverListener.Addr().String(), time.Second, routerB.tls, routerB.quicConfig())
+	if err != nil {
+		t.Fatalf("Failed to connect to router: %v", err)
+	}
+	defer conn2.Close()
+	login := &Login{Role: RolePeer, User: "router-x"}
+	login.Sign("test-secret-key")
+	WriteMsg(conn2, TypeLogin, login)
+	var resp LoginResp
+	if err := ReadMsgInto(conn2, TypeLoginResp, &resp); err != nil || !strings.Contains(resp.Error, "does not match certificate") {
+		t.Fatalf("Expected peer name mismatch to be rejected, got %v %q", err, resp.Error)
+	}
+}